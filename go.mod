@@ -3,16 +3,20 @@ module github.com/nehemming/oauthproxy
 go 1.16
 
 require (
+	github.com/apex/log v1.9.0
+	github.com/fsnotify/fsnotify v1.4.9
 	github.com/hashicorp/go-multierror v1.1.1
 	github.com/kr/text v0.2.0 // indirect
 	github.com/mitchellh/go-homedir v1.1.0
 	github.com/nehemming/cirocket v0.1.1
+	github.com/spf13/cast v1.3.1
 	github.com/spf13/cobra v1.2.1
 	github.com/spf13/viper v1.8.1
 	golang.org/x/net v0.0.0-20210614182718-04defd469f4e
 	golang.org/x/oauth2 v0.0.0-20210402161424-2e8d93401602
 	golang.org/x/sys v0.0.0-20210630005230-0f9fa26af87c // indirect
 	google.golang.org/protobuf v1.27.1 // indirect
+	gopkg.in/yaml.v2 v2.4.0
 )
 
 // Clean up of Vulnerable Dependencies
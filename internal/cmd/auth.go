@@ -0,0 +1,76 @@
+/*
+Copyright © 2018-2021 Neil Hemming
+*/
+
+package cmd
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/nehemming/oauthproxy/pkg/proxy"
+	"github.com/spf13/viper"
+)
+
+const (
+	cfgAuthAPIKeys      = "serve.auth.apiKeys"
+	cfgAuthMTLSSubjects = "serve.auth.mtlsSubjects"
+	cfgAuthHMACSecret   = "serve.auth.hmacSecret"
+	cfgAuthHMACMaxSkew  = "serve.auth.hmacMaxSkew"
+	cfgAuthRoutes       = "serve.auth.routes"
+
+	cfgTLSCertFile     = "serve.tls.certFile"
+	cfgTLSKeyFile      = "serve.tls.keyFile"
+	cfgTLSClientCAFile = "serve.tls.clientCAFile"
+
+	cfgIPAllow          = "serve.ipFilter.allow"
+	cfgIPDeny           = "serve.ipFilter.deny"
+	cfgIPTrustedProxies = "serve.ipFilter.trustedProxies"
+)
+
+// configureCallerAuth reads the caller authentication settings, resolving secret references in the keys.
+func configureCallerAuth(cas proxy.CallerAuthSettings, resolver *secretResolver) (proxy.CallerAuthSettings, error) {
+	cas.APIKeys = viper.GetStringSlice(cfgAuthAPIKeys)
+	cas.MTLSSubjects = viper.GetStringSlice(cfgAuthMTLSSubjects)
+	cas.HMACSecret = viper.GetString(cfgAuthHMACSecret)
+
+	if viper.IsSet(cfgAuthHMACMaxSkew) {
+		cas.HMACMaxSkew = configDuration(cfgAuthHMACMaxSkew, time.Second)
+	}
+
+	for i := range cas.APIKeys {
+		if err := resolver.resolveAll(&cas.APIKeys[i]); err != nil {
+			return cas, fmt.Errorf("%s: %w", cfgAuthAPIKeys, err)
+		}
+	}
+
+	if err := resolver.resolveAll(&cas.HMACSecret); err != nil {
+		return cas, fmt.Errorf("%s: %w", cfgAuthHMACSecret, err)
+	}
+
+	var routes map[string][]string
+	if err := viper.UnmarshalKey(cfgAuthRoutes, &routes); err != nil {
+		return cas, fmt.Errorf("%s: %w", cfgAuthRoutes, err)
+	}
+	cas.Routes = routes
+
+	return cas, nil
+}
+
+// configureListenerTLS reads the listener HTTPS settings.
+func configureListenerTLS(lts proxy.ListenerTLSSettings) proxy.ListenerTLSSettings {
+	lts.CertFile = viper.GetString(cfgTLSCertFile)
+	lts.KeyFile = viper.GetString(cfgTLSKeyFile)
+	lts.ClientCAFile = viper.GetString(cfgTLSClientCAFile)
+
+	return lts
+}
+
+// configureIPFilter reads the source address allow and deny lists.
+func configureIPFilter(ips proxy.IPFilterSettings) proxy.IPFilterSettings {
+	ips.Allow = viper.GetStringSlice(cfgIPAllow)
+	ips.Deny = viper.GetStringSlice(cfgIPDeny)
+	ips.TrustedProxies = viper.GetStringSlice(cfgIPTrustedProxies)
+
+	return ips
+}
@@ -9,6 +9,7 @@ import (
 	"context"
 	"fmt"
 	"os"
+	"strings"
 
 	homedir "github.com/mitchellh/go-homedir"
 	"github.com/nehemming/cirocket/pkg/loggee"
@@ -78,10 +79,13 @@ func Run(ctx context.Context, appName string, version string) int {
 	cli.rootCmd.PersistentFlags().StringVar(&cli.configFile, flagConfig, "",
 		fmt.Sprintf("specify a configuration file (default is ./%s)", cli.appName))
 
+	configCmd := cli.newConfigCmd()
+
 	cli.rootCmd.AddCommand(serverCmd)
 	cli.rootCmd.AddCommand(requestCmd)
+	cli.rootCmd.AddCommand(configCmd)
 
-	cli.bindServeFlagsAndConfig(serverCmd)
+	cli.bindServeFlagsAndConfig(serverCmd, configCmd)
 
 	// Register the config hook, until svr.rootCmd.Execute() is in progress
 	// the flags will not have been read.
@@ -122,7 +126,8 @@ func (cli *cli) initConfig() {
 	}
 
 	viper.SetEnvPrefix(envPrefix)
-	viper.AutomaticEnv() // read in environment variables that match
+	viper.SetEnvKeyReplacer(strings.NewReplacer(".", "_")) // serve.cacheTTL is read from OAP_SERVE_CACHETTL
+	viper.AutomaticEnv()                                   // read in environment variables that match
 
 	// If a config file is found, read it in.
 	err := viper.ReadInConfig()
@@ -0,0 +1,368 @@
+/*
+Copyright © 2018-2021 Neil Hemming
+*/
+
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/nehemming/oauthproxy/pkg/proxy"
+	"github.com/spf13/cast"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	flagForce = "force"
+
+	redacted = "REDACTED"
+)
+
+// starterConfig is the commented config written by config init.
+const starterConfig = `# oauthproxy configuration
+#
+# Periods accept duration strings such as 90s or 5m.  Secret values may be given as
+# env:VAR, file:/path, vault:path#field or https://secrets-store/path#field references
+# rather than plain values.
+
+serve:
+  # Base URL of the downstream provider, the inbound request path is appended to it.
+  # Or set issuer to discover the endpoints
+  downstream: https://auth.example.com
+  # issuer: https://auth.example.com
+  # discoveryRefresh: 60m
+
+  # Port the proxy listens on
+  port: 8090
+
+  # Default period responses are cached, shortened by a token's expiry
+  cacheTTL: 15m
+
+  # Time allowed for downstream requests and for requests to complete on shutdown
+  timeout: 30s
+  shutdown: 10s
+
+  # Number of workers making downstream requests
+  poolSize: 2
+
+  # Log output format (text or json) and minimum level (debug, info, warn or error)
+  logFormat: text
+  logLevel: info
+
+  # Lower bounds enforced on the periods above, lower them to test with short lived tokens
+  # limits:
+  #   minCacheTTL: 10m
+  #   minTimeout: 10s
+  #   minShutdown: 5s
+  #   minDiscoveryRefresh: 1m
+
+  # Client credentials injected into requests made with the alias as client_id
+  # clients:
+  #   myapp:
+  #     clientId: real-client-id
+  #     clientSecret: env:MYAPP_CLIENT_SECRET
+
+  # Credentials required from callers
+  # auth:
+  #   apiKeys:
+  #     - file:/run/secrets/oauthproxy-api-key
+
+# Vault used to resolve vault: references
+# secrets:
+#   vaultAddr: https://vault.example.com
+#   vaultToken: env:VAULT_TOKEN
+`
+
+// newConfigCmd creates the config command and its sub commands.
+func (cli *cli) newConfigCmd() *cobra.Command {
+	configCmd := &cobra.Command{
+		Use:   "config",
+		Short: "create, check and show the configuration",
+		Long:  "create, check and show the configuration used by the serve command",
+		Args:  cobra.NoArgs,
+	}
+
+	initCmd := &cobra.Command{
+		Use:           "init [file]",
+		Short:         "write a starter configuration file",
+		Long:          fmt.Sprintf("write a commented starter configuration file, by default ./.%s", cli.appName),
+		Args:          cobra.MaximumNArgs(1),
+		SilenceErrors: true,
+		RunE:          cli.runConfigInitCmd,
+	}
+	initCmd.Flags().Bool(flagForce, false, "replace an existing file")
+
+	validateCmd := &cobra.Command{
+		Use:           "validate [file]",
+		Short:         "check a configuration file",
+		Long:          "check a configuration file, reporting every problem found",
+		Args:          cobra.MaximumNArgs(1),
+		SilenceErrors: true,
+		RunE:          cli.runConfigValidateCmd,
+	}
+
+	printCmd := &cobra.Command{
+		Use:           "print",
+		Short:         "show the effective configuration",
+		Long:          "show the configuration merged from flags, environment variables and the config file, with secrets redacted",
+		Args:          cobra.NoArgs,
+		SilenceErrors: true,
+		RunE:          cli.runConfigPrintCmd,
+	}
+
+	configCmd.AddCommand(initCmd, validateCmd, printCmd)
+
+	return configCmd
+}
+
+func (cli *cli) runConfigInitCmd(cmd *cobra.Command, args []string) error {
+	cmd.SilenceUsage = true
+
+	path := "." + cli.appName
+	if len(args) > 0 {
+		path = args[0]
+	}
+
+	mode := os.O_WRONLY | os.O_CREATE | os.O_EXCL
+	if force, _ := cmd.Flags().GetBool(flagForce); force {
+		mode = os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	}
+
+	f, err := os.OpenFile(path, mode, 0o600)
+	if os.IsExist(err) {
+		return fmt.Errorf("%s already exists, use --%s to replace it", path, flagForce)
+	} else if err != nil {
+		return err
+	}
+
+	_, err = f.WriteString(starterConfig)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(cmd.OutOrStdout(), "wrote %s\n", path)
+
+	return nil
+}
+
+func (cli *cli) runConfigValidateCmd(cmd *cobra.Command, args []string) error {
+	cmd.SilenceUsage = true
+
+	if len(args) > 0 {
+		viper.SetConfigFile(args[0])
+		if err := viper.ReadInConfig(); err != nil {
+			return err
+		}
+	}
+
+	path := viper.ConfigFileUsed()
+	if path == "" {
+		return errors.New("no config file found")
+	}
+
+	if _, err := configureSettings(cli.ctx, proxy.DefaultSettings()); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+
+	fmt.Fprintf(cmd.OutOrStdout(), "%s: ok\n", path)
+
+	return nil
+}
+
+func (cli *cli) runConfigPrintCmd(cmd *cobra.Command, args []string) error {
+	cmd.SilenceUsage = true
+
+	b, err := yaml.Marshal(effectiveConfig())
+	if err != nil {
+		return err
+	}
+
+	_, err = cmd.OutOrStdout().Write(b)
+
+	return err
+}
+
+// effectiveConfig returns the value of every config key that is set, nested by key path.
+// Secrets are redacted.
+func effectiveConfig() map[string]interface{} {
+	cfg := make(map[string]interface{})
+
+	for _, ck := range configSchema {
+		value := ck.normalize(viper.Get(ck.key))
+		if value == nil || value == "" {
+			continue
+		}
+
+		path := strings.Split(ck.key, ".")
+		parent := cfg
+		for _, name := range path[:len(path)-1] {
+			child, ok := parent[name].(map[string]interface{})
+			if !ok {
+				child = make(map[string]interface{})
+				parent[name] = child
+			}
+			parent = child
+		}
+		parent[path[len(path)-1]] = ck.redact(value)
+	}
+
+	return cfg
+}
+
+// normalize converts value, as read from a flag, the environment or the config file, to the kind of the key.
+// Durations are shown in full, values that do not convert are returned unchanged.
+func (ck configKey) normalize(value interface{}) interface{} {
+	if value == nil {
+		return nil
+	}
+
+	var (
+		result interface{}
+		err    error
+	)
+
+	switch ck.kind {
+	case kindString:
+		result, err = cast.ToStringE(value)
+	case kindBool:
+		result, err = cast.ToBoolE(value)
+	case kindInt:
+		result, err = cast.ToInt64E(value)
+	case kindDuration:
+		var d time.Duration
+		if d, err = parseDuration(value, ck.unit); err == nil {
+			result = d.String()
+		}
+	case kindStringList:
+		result, err = cast.ToStringSliceE(value)
+	default:
+		return value
+	}
+
+	if err != nil {
+		return value
+	}
+
+	return result
+}
+
+// redact returns a copy of value with its secrets redacted.
+func (ck configKey) redact(value interface{}) interface{} {
+	if ck.secret {
+		return redactAll(value)
+	}
+
+	if ck.userinfo {
+		return redactUserinfo(value)
+	}
+
+	if len(ck.secretFields) == 0 {
+		return value
+	}
+
+	entries, err := cast.ToStringMapE(value)
+	if err != nil {
+		return value
+	}
+
+	result := make(map[string]interface{}, len(entries))
+	for name, entry := range entries {
+		fields, err := cast.ToStringMapE(entry)
+		if err != nil {
+			result[name] = entry
+			continue
+		}
+
+		copied := make(map[string]interface{}, len(fields))
+		for k, v := range fields {
+			if ck.isSecretField(k) {
+				v = redactAll(v)
+			}
+			copied[k] = v
+		}
+		result[name] = copied
+	}
+
+	return result
+}
+
+// isSecretField reports whether the map entry field holds a secret.
+func (ck configKey) isSecretField(field string) bool {
+	for _, f := range ck.secretFields {
+		if strings.EqualFold(f, field) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// redactUserinfo redacts the password of a URL's user info.
+// Values that cannot be parsed into a host are redacted in full if they may hold user info.
+func redactUserinfo(value interface{}) interface{} {
+	s, ok := value.(string)
+	if !ok {
+		return value
+	}
+
+	u, err := url.Parse(s)
+	if err != nil || u.Host == "" {
+		if strings.Contains(s, "@") {
+			return redacted
+		}
+		return s
+	}
+
+	if _, ok := u.User.Password(); ok {
+		u.User = url.UserPassword(u.User.Username(), redacted)
+	}
+
+	return u.String()
+}
+
+// redactAll redacts every value held in value.
+// Secret references are shown as they identify, rather than hold, the secret.
+func redactAll(value interface{}) interface{} {
+	switch v := value.(type) {
+	case string:
+		if v == "" || strings.HasPrefix(v, refEnv) || strings.HasPrefix(v, refFile) || strings.HasPrefix(v, refVault) {
+			return v
+		}
+		if isSecretURL(v) {
+			return redactUserinfo(v)
+		}
+		return redacted
+	case []string:
+		result := make([]interface{}, len(v))
+		for i, s := range v {
+			result[i] = redactAll(s)
+		}
+		return result
+	case []interface{}:
+		result := make([]interface{}, len(v))
+		for i, s := range v {
+			result[i] = redactAll(s)
+		}
+		return result
+	}
+
+	if m, err := cast.ToStringMapE(value); err == nil {
+		result := make(map[string]interface{}, len(m))
+		for k, v := range m {
+			result[k] = redactAll(v)
+		}
+		return result
+	}
+
+	return redacted
+}
@@ -0,0 +1,62 @@
+/*
+Copyright © 2018-2021 Neil Hemming
+*/
+
+package cmd
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/nehemming/oauthproxy/pkg/proxy"
+	"github.com/spf13/viper"
+)
+
+const (
+	cfgEventsWebhooks     = "serve.events.webhooks"
+	cfgEventsHeaders      = "serve.events.headers"
+	cfgEventsCommand      = "serve.events.command"
+	cfgEventsRetries      = "serve.events.retries"
+	cfgEventsRetryDelay   = "serve.events.retryDelay"
+	cfgEventsDedupeWindow = "serve.events.dedupeWindow"
+
+	cfgCircuitThreshold = "serve.circuitBreaker.threshold"
+	cfgCircuitCooldown  = "serve.circuitBreaker.cooldown"
+)
+
+// setEventDefaults sets the defaults of the event and circuit breaker settings.
+func setEventDefaults() {
+	viper.SetDefault(cfgEventsRetries, 3)
+	viper.SetDefault(cfgEventsRetryDelay, 1)
+	viper.SetDefault(cfgEventsDedupeWindow, 300)
+	viper.SetDefault(cfgCircuitCooldown, 30)
+}
+
+// configureEvents reads the event delivery settings, resolving secret references in the webhook headers.
+func configureEvents(es proxy.EventSettings, resolver *secretResolver) (proxy.EventSettings, error) {
+	es.Webhooks = viper.GetStringSlice(cfgEventsWebhooks)
+	es.Command = viper.GetStringSlice(cfgEventsCommand)
+	es.Retries = viper.GetInt(cfgEventsRetries)
+	es.RetryDelay = configDuration(cfgEventsRetryDelay, time.Second)
+	es.DedupeWindow = configDuration(cfgEventsDedupeWindow, time.Second)
+
+	headers := viper.GetStringMapString(cfgEventsHeaders)
+	for k, v := range headers {
+		resolved, err := resolver.resolve(v)
+		if err != nil {
+			return es, fmt.Errorf("%s.%s: %w", cfgEventsHeaders, k, err)
+		}
+		headers[k] = resolved
+	}
+	es.Headers = headers
+
+	return es, nil
+}
+
+// configureCircuitBreaker reads the circuit breaker settings.
+func configureCircuitBreaker(cbs proxy.CircuitBreakerSettings) proxy.CircuitBreakerSettings {
+	cbs.Threshold = viper.GetInt(cfgCircuitThreshold)
+	cbs.Cooldown = configDuration(cfgCircuitCooldown, time.Second)
+
+	return cbs
+}
@@ -0,0 +1,76 @@
+/*
+Copyright © 2018-2021 Neil Hemming
+*/
+
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/nehemming/oauthproxy/pkg/proxy"
+	"github.com/spf13/viper"
+)
+
+const (
+	cfgIdentities     = "serve.identities"
+	cfgIdentitiesFile = "serve.identitiesFile"
+)
+
+type (
+	// identityConfig is the config and secrets file form of a named identity.
+	identityConfig struct {
+		Username     string   `mapstructure:"username" json:"username,omitempty"`
+		Password     string   `mapstructure:"password" json:"password,omitempty"`
+		ClientID     string   `mapstructure:"clientId" json:"clientId,omitempty"`
+		ClientSecret string   `mapstructure:"clientSecret" json:"clientSecret,omitempty"`
+		Scopes       []string `mapstructure:"scopes" json:"scopes,omitempty"`
+		TokenPath    string   `mapstructure:"tokenPath" json:"tokenPath,omitempty"`
+	}
+)
+
+// configureIdentities reads the named identities from the config and the optional identities secrets file.
+// Identities in the secrets file replace those with the same name in the config.
+func configureIdentities(resolver *secretResolver) (map[string]proxy.Identity, error) {
+	var cfg map[string]identityConfig
+
+	if err := viper.UnmarshalKey(cfgIdentities, &cfg); err != nil {
+		return nil, fmt.Errorf("%s: %w", cfgIdentities, err)
+	}
+
+	identities := make(map[string]proxy.Identity, len(cfg))
+	for name, c := range cfg {
+		if err := c.resolve(resolver); err != nil {
+			return nil, fmt.Errorf("%s.%s: %w", cfgIdentities, name, err)
+		}
+		identities[name] = c.identity()
+	}
+
+	if path := viper.GetString(cfgIdentitiesFile); path != "" {
+		s, err := loadSecretsFile(path, resolver)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", cfgIdentitiesFile, err)
+		}
+
+		for name, c := range s.Identities {
+			identities[name] = c.identity()
+		}
+	}
+
+	return identities, nil
+}
+
+func (c identityConfig) identity() proxy.Identity {
+	return proxy.Identity{
+		Username:     c.Username,
+		Password:     c.Password,
+		ClientID:     c.ClientID,
+		ClientSecret: c.ClientSecret,
+		Scopes:       c.Scopes,
+		TokenPath:    c.TokenPath,
+	}
+}
+
+// resolve resolves the secret references of the identity.
+func (c *identityConfig) resolve(resolver *secretResolver) error {
+	return resolver.resolveAll(&c.Username, &c.Password, &c.ClientID, &c.ClientSecret)
+}
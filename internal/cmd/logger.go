@@ -0,0 +1,125 @@
+/*
+Copyright © 2018-2021 Neil Hemming
+*/
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/apex/log"
+	"github.com/apex/log/handlers/json"
+	"github.com/nehemming/cirocket/pkg/loggee"
+	"github.com/nehemming/cirocket/pkg/loggee/apexlog"
+	"github.com/nehemming/oauthproxy/pkg/proxy"
+	"github.com/spf13/viper"
+)
+
+const (
+	flagLogFormat = "log-format"
+	flagLogLevel  = "log-level"
+
+	cfgLogFormat = "serve.logFormat"
+	cfgLogLevel  = "serve.logLevel"
+
+	cfgAccessLogOutput        = "serve.accessLog.output"
+	cfgAccessLogFormat        = "serve.accessLog.format"
+	cfgAccessLogHashUsernames = "serve.accessLog.hashUsernames"
+	cfgAccessLogMaxSize       = "serve.accessLog.maxSize"
+	cfgAccessLogMaxBackups    = "serve.accessLog.maxBackups"
+
+	cfgAuditLogOutput = "serve.auditLog.output"
+
+	logFormatText = "text"
+	logFormatJSON = "json"
+)
+
+type (
+	// loggeeLogger passes the proxy's structured log messages to loggee.
+	loggeeLogger struct {
+		level proxy.Level
+	}
+)
+
+// configureLogger creates the proxy logger from the config, nil when silenced.
+// Only the proxy's own logger and level are configured, so it is safe to call while serving;
+// the process wide log handler is set once by installLogHandler.
+func configureLogger() (proxy.Logger, error) {
+	if viper.GetBool(cfgSilent) {
+		return nil, nil
+	}
+
+	level, err := proxy.ParseLevel(viper.GetString(cfgLogLevel))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", cfgLogLevel, err)
+	}
+
+	switch format := viper.GetString(cfgLogFormat); format {
+	case "", logFormatText, logFormatJSON:
+	default:
+		return nil, fmt.Errorf("%s: unknown log format %s", cfgLogFormat, format)
+	}
+
+	return loggeeLogger{level: level}, nil
+}
+
+// installLogHandler sets the process wide log handler for the configured format, returning the format.
+// It is called once as the serve command starts, the JSON format replaces the cli log handler with one
+// writing a JSON object per line to stderr.
+func installLogHandler() string {
+	format := viper.GetString(cfgLogFormat)
+	if viper.GetBool(cfgSilent) {
+		return format
+	}
+
+	if format == logFormatJSON {
+		loggee.SetLogger(apexlog.New(json.New(os.Stderr)))
+	}
+
+	// Level filtering is done by the proxy logger
+	log.SetLevel(log.DebugLevel)
+
+	return format
+}
+
+// Log implements proxy.Logger.
+func (l loggeeLogger) Log(level proxy.Level, msg string, fields proxy.Fields) {
+	if level < l.level {
+		return
+	}
+
+	var entry loggee.Entry = loggee.Default()
+	if len(fields) > 0 {
+		entry = entry.WithFields(loggee.Fields(fields))
+	}
+
+	switch level {
+	case proxy.LevelDebug:
+		entry.Debug(msg)
+	case proxy.LevelInfo:
+		entry.Info(msg)
+	case proxy.LevelWarn:
+		entry.Warn(msg)
+	default:
+		entry.Error(msg)
+	}
+}
+
+// configureAccessLog reads the access log settings, the maximum size is configured in megabytes.
+func configureAccessLog(als proxy.AccessLogSettings) proxy.AccessLogSettings {
+	als.Output = viper.GetString(cfgAccessLogOutput)
+	als.Format = viper.GetString(cfgAccessLogFormat)
+	als.HashUsernames = viper.GetBool(cfgAccessLogHashUsernames)
+	als.MaxSize = viper.GetInt64(cfgAccessLogMaxSize) * 1024 * 1024
+	als.MaxBackups = viper.GetInt(cfgAccessLogMaxBackups)
+
+	return als
+}
+
+// configureAuditLog reads the audit log settings.
+func configureAuditLog(als proxy.AuditLogSettings) proxy.AuditLogSettings {
+	als.Output = viper.GetString(cfgAuditLogOutput)
+
+	return als
+}
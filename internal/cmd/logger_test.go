@@ -0,0 +1,64 @@
+/*
+Copyright © 2018-2021 Neil Hemming
+*/
+
+package cmd
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/apex/log"
+	"github.com/nehemming/cirocket/pkg/loggee"
+	"github.com/nehemming/cirocket/pkg/loggee/apexlog"
+	"github.com/nehemming/oauthproxy/pkg/proxy"
+	"github.com/spf13/viper"
+)
+
+type recordingHandler struct {
+	lock    sync.Mutex
+	entries []*log.Entry
+}
+
+func (h *recordingHandler) HandleLog(e *log.Entry) error {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	h.entries = append(h.entries, e)
+	return nil
+}
+
+func TestConfigureLoggerKeepsGlobalHandler(t *testing.T) {
+	viper.Reset()
+	defer viper.Reset()
+
+	previous := log.Log.(*log.Logger).Handler
+	defer loggee.SetLogger(apexlog.New(previous))
+
+	h := &recordingHandler{}
+	loggee.SetLogger(apexlog.New(h))
+
+	viper.Set(cfgLogFormat, logFormatJSON)
+	viper.Set(cfgLogLevel, "warn")
+
+	logger, err := configureLogger()
+	if err != nil || logger == nil {
+		t.Fatal("configureLogger", logger, err)
+	}
+
+	if log.Log.(*log.Logger).Handler != log.Handler(h) {
+		t.Error("Global log handler replaced")
+	}
+
+	logger.Log(proxy.LevelInfo, "filtered", nil)
+	logger.Log(proxy.LevelWarn, "logged", nil)
+
+	if len(h.entries) != 1 || h.entries[0].Message != "logged" {
+		t.Error("Unexpected entries", h.entries)
+	}
+
+	viper.Set(cfgLogFormat, "xml")
+	if _, err := configureLogger(); err == nil {
+		t.Error("Unknown log format not caught")
+	}
+}
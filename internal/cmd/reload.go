@@ -0,0 +1,131 @@
+/*
+Copyright © 2018-2021 Neil Hemming
+*/
+
+package cmd
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/nehemming/cirocket/pkg/loggee"
+	"github.com/nehemming/oauthproxy/pkg/proxy"
+	"github.com/spf13/viper"
+)
+
+// watchConfig returns a channel delivering new settings whenever the config file changes or
+// SIGHUP is received.  Config that cannot be read or configured is logged and not delivered,
+// the proxy rejects settings that fail validation.  As viper is not safe for concurrent use
+// the config is only read by the goroutine started here.  The log format installed at startup
+// is not changed, a new format is reported as needing a restart.
+func watchConfig(ctx context.Context, logFormat string) <-chan proxy.Settings {
+	reload := make(chan proxy.Settings)
+
+	changed, stopWatching := watchFile(viper.ConfigFileUsed())
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	go func() {
+		defer signal.Stop(hup)
+		defer stopWatching()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-hup:
+			case <-changed:
+			}
+
+			settings, err := reloadSettings(ctx)
+			if err != nil {
+				loggee.Errorf("config reload: %s", err)
+				continue
+			}
+
+			if format := viper.GetString(cfgLogFormat); format != logFormat {
+				loggee.Warnf("config reload: %s changed to %s, requires a restart", cfgLogFormat, format)
+			}
+
+			select {
+			case reload <- settings:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return reload
+}
+
+// watchFile returns a channel signalled when the file is written, created or replaced, and a func
+// to stop watching.  The directory is watched so files replaced by editors or symlink swaps are seen.
+// If there is no file, or it cannot be watched, the channel is never signalled.
+func watchFile(file string) (<-chan struct{}, func()) {
+	if file == "" {
+		return nil, func() {}
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		loggee.Warnf("config watch: %s", err)
+		return nil, func() {}
+	}
+
+	file = filepath.Clean(file)
+	if err := watcher.Add(filepath.Dir(file)); err != nil {
+		loggee.Warnf("config watch: %s", err)
+		_ = watcher.Close()
+		return nil, func() {}
+	}
+
+	changed := make(chan struct{}, 1)
+	target, _ := filepath.EvalSymlinks(file)
+
+	go func() {
+		for {
+			select {
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+
+				current, _ := filepath.EvalSymlinks(file)
+				written := filepath.Clean(event.Name) == file && event.Op&(fsnotify.Write|fsnotify.Create) != 0
+				if !written && (current == "" || current == target) {
+					continue
+				}
+				target = current
+
+				select {
+				case changed <- struct{}{}:
+				default:
+				}
+
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				loggee.Warnf("config watch: %s", err)
+			}
+		}
+	}()
+
+	return changed, func() { _ = watcher.Close() }
+}
+
+// reloadSettings re-reads the config file, if one is used, and configures the settings from it.
+func reloadSettings(ctx context.Context) (proxy.Settings, error) {
+	if viper.ConfigFileUsed() != "" {
+		if err := viper.ReadInConfig(); err != nil {
+			return proxy.Settings{}, err
+		}
+	}
+
+	return configureSettings(ctx, proxy.DefaultSettings())
+}
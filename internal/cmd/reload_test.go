@@ -0,0 +1,51 @@
+/*
+Copyright © 2018-2021 Neil Hemming
+*/
+
+package cmd
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestWatchFileSignalsChanges(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "config.yaml")
+	if err := ioutil.WriteFile(file, []byte("serve: {}\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	changed, stop := watchFile(file)
+	defer stop()
+
+	if err := ioutil.WriteFile(filepath.Join(filepath.Dir(file), "other.yaml"), []byte("x: 1\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-changed:
+		t.Error("Change to another file signalled")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	if err := ioutil.WriteFile(file, []byte("serve:\n  port: 9000\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-changed:
+	case <-time.After(2 * time.Second):
+		t.Error("Change not signalled")
+	}
+}
+
+func TestWatchFileWithoutFile(t *testing.T) {
+	changed, stop := watchFile("")
+	defer stop()
+
+	if changed != nil {
+		t.Error("Channel returned without a file")
+	}
+}
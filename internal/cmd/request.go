@@ -16,6 +16,9 @@ import (
 type (
 	secretsFile struct {
 		Secrets clientSettings `json:"api"`
+
+		// Identities are named identities served by the proxy
+		Identities map[string]identityConfig `json:"identities,omitempty"`
 	}
 
 	clientSettings struct {
@@ -40,7 +43,12 @@ type (
 )
 
 func (cli *cli) requestTokenCmd(cmd *cobra.Command, args []string) error {
-	secrets, err := loadSecrets(args[0])
+	resolver, err := newSecretResolver(cli.ctx)
+	if err != nil {
+		return err
+	}
+
+	secrets, err := loadSecrets(args[0], resolver)
 	if err != nil {
 		return err
 	}
@@ -63,7 +71,17 @@ func (cli *cli) requestTokenCmd(cmd *cobra.Command, args []string) error {
 	return nil
 }
 
-func loadSecrets(secretsFilePath string) (*clientSettings, error) {
+func loadSecrets(secretsFilePath string, resolver *secretResolver) (*clientSettings, error) {
+	s, err := loadSecretsFile(secretsFilePath, resolver)
+	if err != nil {
+		return nil, err
+	}
+
+	return &s.Secrets, nil
+}
+
+// loadSecretsFile reads a secrets file, resolving any secret references it contains.
+func loadSecretsFile(secretsFilePath string, resolver *secretResolver) (*secretsFile, error) {
 	b, err := ioutil.ReadFile(secretsFilePath)
 	if err != nil {
 		return nil, err
@@ -76,5 +94,27 @@ func loadSecrets(secretsFilePath string) (*clientSettings, error) {
 		return nil, err
 	}
 
-	return &s.Secrets, nil
+	if err := s.resolve(resolver); err != nil {
+		return nil, fmt.Errorf("%s: %w", secretsFilePath, err)
+	}
+
+	return &s, nil
+}
+
+// resolve resolves the secret references in the file.
+func (s *secretsFile) resolve(resolver *secretResolver) error {
+	c := &s.Secrets
+
+	if err := resolver.resolveAll(&c.TokenURL, &c.UserName, &c.Password, &c.ClientID, &c.ClientSecret); err != nil {
+		return err
+	}
+
+	for name, identity := range s.Identities {
+		if err := identity.resolve(resolver); err != nil {
+			return fmt.Errorf("identity %s: %w", name, err)
+		}
+		s.Identities[name] = identity
+	}
+
+	return nil
 }
@@ -0,0 +1,348 @@
+/*
+Copyright © 2018-2021 Neil Hemming
+*/
+
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/go-multierror"
+	"github.com/nehemming/oauthproxy/pkg/proxy"
+	"github.com/spf13/cast"
+	"github.com/spf13/viper"
+)
+
+const (
+	cfgLimitsCacheTTL         = "serve.limits.minCacheTTL"
+	cfgLimitsTimeout          = "serve.limits.minTimeout"
+	cfgLimitsShutdown         = "serve.limits.minShutdown"
+	cfgLimitsDiscoveryRefresh = "serve.limits.minDiscoveryRefresh"
+)
+
+const (
+	kindString configKind = iota
+	kindBool
+	kindInt
+	kindDuration
+	kindStringList
+	kindMap
+)
+
+type (
+	// configKind is the type of value a config key holds.
+	configKind int
+
+	// configKey describes a config key.
+	// Durations accept Go duration strings, bare integers are read in the key's legacy unit.
+	// Non blank strings with values are restricted to one of them, ignoring case.
+	// Numbers and durations cannot be negative unless signed.
+	// Secret values, the secretFields of map entries and the passwords of userinfo URLs are redacted
+	// when the config is printed.
+	configKey struct {
+		key          string
+		kind         configKind
+		unit         time.Duration
+		values       []string
+		signed       bool
+		secret       bool
+		secretFields []string
+		userinfo     bool
+	}
+)
+
+// configSchema lists every config key read by the application.
+var configSchema = []configKey{
+	{key: cfgEndpoint, kind: kindString},
+	{key: cfgIssuer, kind: kindString},
+	{key: cfgRefresh, kind: kindDuration, unit: time.Minute},
+	{key: cfgPort, kind: kindInt},
+	{key: cfgCacheTTL, kind: kindDuration, unit: time.Minute},
+	{key: cfgTimeout, kind: kindDuration, unit: time.Second},
+	{key: cfgShutdown, kind: kindDuration, unit: time.Second},
+	{key: cfgSilent, kind: kindBool},
+	{key: cfgPoolSize, kind: kindInt},
+	{key: cfgDocTTLMin, kind: kindDuration, unit: time.Minute},
+	{key: cfgDocTTLMax, kind: kindDuration, unit: time.Minute},
+	{key: cfgIntrospectionFallback, kind: kindBool},
+	{key: cfgClients, kind: kindMap, secretFields: []string{"clientSecret", "privateKey"}},
+	{key: cfgIdentities, kind: kindMap, secretFields: []string{"password", "clientSecret"}},
+	{key: cfgIdentitiesFile, kind: kindString},
+	{key: cfgLogFormat, kind: kindString, values: []string{logFormatText, logFormatJSON}},
+	{key: cfgLogLevel, kind: kindString, values: []string{"debug", "info", "warn", "warning", "error"}},
+
+	{key: cfgLimitsCacheTTL, kind: kindDuration, unit: time.Minute},
+	{key: cfgLimitsTimeout, kind: kindDuration, unit: time.Second},
+	{key: cfgLimitsShutdown, kind: kindDuration, unit: time.Second},
+	{key: cfgLimitsDiscoveryRefresh, kind: kindDuration, unit: time.Minute},
+
+	{key: cfgTransportHTTPProxy, kind: kindString, userinfo: true},
+	{key: cfgTransportHTTPSProxy, kind: kindString, userinfo: true},
+	{key: cfgTransportNoProxy, kind: kindString},
+	{key: cfgTransportCAFiles, kind: kindStringList},
+	{key: cfgTransportClientCert, kind: kindString},
+	{key: cfgTransportClientKey, kind: kindString},
+	{key: cfgTransportTLSMinVersion, kind: kindString},
+	{key: cfgTransportMaxIdleConns, kind: kindInt},
+	{key: cfgTransportMaxIdleConnsPerHost, kind: kindInt},
+	{key: cfgTransportMaxConnsPerHost, kind: kindInt},
+	{key: cfgTransportIdleConnTimeout, kind: kindDuration, unit: time.Second},
+	{key: cfgTransportKeepAlive, kind: kindDuration, unit: time.Second, signed: true},
+
+	{key: cfgAuthAPIKeys, kind: kindStringList, secret: true},
+	{key: cfgAuthMTLSSubjects, kind: kindStringList},
+	{key: cfgAuthHMACSecret, kind: kindString, secret: true},
+	{key: cfgAuthHMACMaxSkew, kind: kindDuration, unit: time.Second},
+	{key: cfgAuthRoutes, kind: kindMap},
+	{key: cfgTLSCertFile, kind: kindString},
+	{key: cfgTLSKeyFile, kind: kindString},
+	{key: cfgTLSClientCAFile, kind: kindString},
+	{key: cfgIPAllow, kind: kindStringList},
+	{key: cfgIPDeny, kind: kindStringList},
+	{key: cfgIPTrustedProxies, kind: kindStringList},
+
+	{key: cfgAccessLogOutput, kind: kindString},
+	{key: cfgAccessLogFormat, kind: kindString},
+	{key: cfgAccessLogHashUsernames, kind: kindBool},
+	{key: cfgAccessLogMaxSize, kind: kindInt},
+	{key: cfgAccessLogMaxBackups, kind: kindInt},
+	{key: cfgAuditLogOutput, kind: kindString},
+
+	{key: cfgTracingEndpoint, kind: kindString},
+	{key: cfgTracingServiceName, kind: kindString},
+	{key: cfgTracingHeaders, kind: kindMap, secret: true},
+	{key: cfgTracingFlushInterval, kind: kindDuration, unit: time.Second},
+
+	{key: cfgEventsWebhooks, kind: kindStringList},
+	{key: cfgEventsHeaders, kind: kindMap, secret: true},
+	{key: cfgEventsCommand, kind: kindStringList},
+	{key: cfgEventsRetries, kind: kindInt},
+	{key: cfgEventsRetryDelay, kind: kindDuration, unit: time.Second},
+	{key: cfgEventsDedupeWindow, kind: kindDuration, unit: time.Second},
+	{key: cfgCircuitThreshold, kind: kindInt},
+	{key: cfgCircuitCooldown, kind: kindDuration, unit: time.Second},
+
+	{key: cfgVaultAddr, kind: kindString},
+	{key: cfgVaultToken, kind: kindString, secret: true},
+}
+
+// settingKeys maps the proxy settings reported by validation to the config keys that set them.
+var settingKeys = map[string]string{
+	"CacheTTL":            cfgCacheTTL,
+	"RequestTimeout":      cfgTimeout,
+	"ShutdownGracePeriod": cfgShutdown,
+	"HTTPListenAddr":      cfgPort,
+	"Endpoint":            cfgEndpoint,
+	"DiscoveryRefresh":    cfgRefresh,
+	"PoolSize":            cfgPoolSize,
+	"DocumentTTLMin":      cfgDocTTLMin,
+	"DocumentTTLMax":      cfgDocTTLMax,
+	"Clients":             cfgClients,
+	"Identities":          cfgIdentities,
+	"Limits":              "serve.limits",
+	"CallerAuth":          "serve.auth",
+	"IPFilter":            "serve.ipFilter",
+	"AccessLog":           "serve.accessLog",
+	"AuditLog":            "serve.auditLog",
+	"Tracing":             "serve.tracing",
+	"Events":              "serve.events",
+	"CircuitBreaker":      "serve.circuitBreaker",
+	"Transport":           "serve.transport",
+}
+
+// parseDuration parses a config duration.
+// Integers, including strings of digits, are read in unit, anything else must be a Go duration string.
+func parseDuration(value interface{}, unit time.Duration) (time.Duration, error) {
+	switch v := value.(type) {
+	case nil:
+		return 0, nil
+	case time.Duration:
+		return v, nil
+	case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64:
+		n, err := cast.ToInt64E(v)
+		if err != nil {
+			return 0, err
+		}
+		return time.Duration(n) * unit, nil
+	case float32, float64:
+		f := cast.ToFloat64(v)
+		if f != float64(int64(f)) {
+			return 0, fmt.Errorf("%v is not a whole number, use a duration such as 90s", v)
+		}
+		return time.Duration(f) * unit, nil
+	case string:
+		s := strings.TrimSpace(v)
+		if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+			return time.Duration(n) * unit, nil
+		}
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return 0, fmt.Errorf("%q is not a duration, use a value such as 90s or 5m", v)
+		}
+		return d, nil
+	default:
+		return 0, fmt.Errorf("%v is not a duration", v)
+	}
+}
+
+// configDuration reads the duration held by key.
+// Values that cannot be parsed read as zero, validateConfig reports them.
+func configDuration(key string, unit time.Duration) time.Duration {
+	d, _ := parseDuration(viper.Get(key), unit)
+	return d
+}
+
+// checkValue checks value is the kind of value expected by ck.
+func (ck configKey) checkValue(value interface{}) error {
+	var err error
+
+	switch ck.kind {
+	case kindString:
+		var s string
+		if s, err = cast.ToStringE(value); err == nil && !ck.permits(s) {
+			err = fmt.Errorf("unknown value %s, expected one of %s", s, strings.Join(ck.values, ", "))
+		}
+	case kindBool:
+		_, err = cast.ToBoolE(value)
+	case kindInt:
+		var n int64
+		if n, err = cast.ToInt64E(value); err == nil && n < 0 && !ck.signed {
+			err = errors.New("cannot be negative")
+		}
+	case kindDuration:
+		var d time.Duration
+		if d, err = parseDuration(value, ck.unit); err == nil && d < 0 && !ck.signed {
+			err = errors.New("cannot be negative")
+		}
+	case kindStringList:
+		_, err = cast.ToStringSliceE(value)
+	case kindMap:
+		_, err = cast.ToStringMapE(value)
+	}
+
+	return err
+}
+
+// permits reports whether s is one of the values permitted by ck.
+func (ck configKey) permits(s string) bool {
+	if len(ck.values) == 0 || s == "" {
+		return true
+	}
+
+	for _, v := range ck.values {
+		if strings.EqualFold(s, v) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// validateConfig checks the config against configSchema, returning every problem found keyed by config key.
+// Keys under serve that are not in the schema are reported as unknown.
+func validateConfig() map[string]error {
+	problems := make(map[string]error)
+
+	known := make(map[string]configKey, len(configSchema))
+	for _, ck := range configSchema {
+		known[strings.ToLower(ck.key)] = ck
+
+		value := viper.Get(ck.key)
+		if value == nil {
+			continue
+		}
+
+		if err := ck.checkValue(value); err != nil {
+			problems[ck.key] = err
+		}
+	}
+
+	for _, key := range viper.AllKeys() {
+		if !strings.HasPrefix(key, "serve.") || isKnownKey(key, known) {
+			continue
+		}
+		problems[key] = errors.New("unknown setting")
+	}
+
+	return problems
+}
+
+// isKnownKey reports whether the lower case key is in the schema or held within a map key.
+func isKnownKey(key string, known map[string]configKey) bool {
+	if _, ok := known[key]; ok {
+		return true
+	}
+
+	for i := strings.LastIndex(key, "."); i > 0; i = strings.LastIndex(key[:i], ".") {
+		if ck, ok := known[key[:i]]; ok {
+			return ck.kind == kindMap
+		}
+	}
+
+	return false
+}
+
+// settingsProblems adds the problems found validating the proxy settings to problems,
+// keyed by the config key setting them. Problems already found in a key, or within it, are kept
+// in preference as the settings built from a bad value are not meaningful.
+func settingsProblems(settings proxy.Settings, problems map[string]error) {
+	err := settings.Validate()
+	if err == nil {
+		return
+	}
+
+	var merr *multierror.Error
+	if !errors.As(err, &merr) {
+		merr = &multierror.Error{Errors: []error{err}}
+	}
+
+	for _, e := range merr.Errors {
+		key := "serve"
+
+		var se *proxy.SettingError
+		if errors.As(e, &se) {
+			if k, ok := settingKeys[se.Setting]; ok {
+				key = k
+			}
+			e = se.Err
+		}
+
+		if _, ok := problems[key]; ok || hasKeyPrefix(problems, key) {
+			continue
+		}
+		problems[key] = e
+	}
+}
+
+// hasKeyPrefix reports whether any problem key is a child of key.
+func hasKeyPrefix(problems map[string]error, key string) bool {
+	prefix := strings.ToLower(key) + "."
+	for k := range problems {
+		if strings.HasPrefix(strings.ToLower(k), prefix) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// problemsError combines the problems into a single error, ordered by config key.
+func problemsError(problems map[string]error) error {
+	keys := make([]string, 0, len(problems))
+	for k := range problems {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var result error
+	for _, k := range keys {
+		result = multierror.Append(result, fmt.Errorf("%s: %w", k, problems[k]))
+	}
+
+	return result
+}
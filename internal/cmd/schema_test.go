@@ -0,0 +1,121 @@
+/*
+Copyright © 2018-2021 Neil Hemming
+*/
+
+package cmd
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nehemming/oauthproxy/pkg/proxy"
+	"github.com/spf13/viper"
+)
+
+func TestParseDuration(t *testing.T) {
+	tests := []struct {
+		value interface{}
+		unit  time.Duration
+		want  time.Duration
+	}{
+		{15, time.Minute, 15 * time.Minute},
+		{uint64(30), time.Second, 30 * time.Second},
+		{float64(2), time.Second, 2 * time.Second},
+		{"45", time.Second, 45 * time.Second},
+		{"90s", time.Minute, 90 * time.Second},
+		{"5m", time.Second, 5 * time.Minute},
+		{" 1h30m ", time.Second, 90 * time.Minute},
+		{nil, time.Second, 0},
+	}
+
+	for _, tt := range tests {
+		got, err := parseDuration(tt.value, tt.unit)
+		if err != nil || got != tt.want {
+			t.Errorf("parseDuration(%v) = %s, %v want %s", tt.value, got, err, tt.want)
+		}
+	}
+}
+
+func TestParseDurationInvalid(t *testing.T) {
+	for _, value := range []interface{}{"soon", "5 minutes", 1.5, true} {
+		if _, err := parseDuration(value, time.Second); err == nil {
+			t.Errorf("parseDuration(%v) not caught", value)
+		}
+	}
+}
+
+func TestValidateConfigReportsEveryKey(t *testing.T) {
+	viper.Reset()
+	defer viper.Reset()
+
+	viper.Set(cfgCacheTTL, "soon")
+	viper.Set(cfgPoolSize, -1)
+	viper.Set(cfgTransportKeepAlive, "-1s")
+	viper.Set(cfgLogLevel, "loud")
+	viper.Set("serve.cacheTtls", 5)
+	viper.Set(cfgClients, map[string]interface{}{"alias": map[string]interface{}{"clientId": "id"}})
+
+	problems := validateConfig()
+
+	for _, key := range []string{cfgCacheTTL, cfgPoolSize, cfgLogLevel, "serve.cachettls"} {
+		if problems[key] == nil {
+			t.Error("problem not reported", key, problems)
+		}
+	}
+
+	if len(problems) != 4 {
+		t.Error("unexpected problems", problems)
+	}
+}
+
+func TestSettingsProblemsUseConfigKeys(t *testing.T) {
+	settings := proxy.DefaultSettings()
+	settings.CacheTTL = time.Minute
+
+	problems := map[string]error{}
+	settingsProblems(settings, problems)
+
+	for _, key := range []string{cfgCacheTTL, cfgEndpoint} {
+		if problems[key] == nil {
+			t.Error("problem not reported", key, problems)
+		}
+	}
+
+	err := problemsError(problems)
+	if err == nil || !strings.Contains(err.Error(), cfgCacheTTL+": cache TTL must be at least 10m0s") {
+		t.Error("unexpected error", err)
+	}
+}
+
+func TestSettingsProblemsKeepSchemaProblems(t *testing.T) {
+	settings := proxy.DefaultSettings().WithEndpoint("test")
+	settings.CacheTTL = 0
+
+	errSchema := errors.New("schema")
+	problems := map[string]error{cfgCacheTTL: errSchema}
+	settingsProblems(settings, problems)
+
+	if problems[cfgCacheTTL] != errSchema || len(problems) != 1 {
+		t.Error("schema problem replaced", problems)
+	}
+}
+
+func TestConfigureLimits(t *testing.T) {
+	viper.Reset()
+	defer viper.Reset()
+
+	viper.Set(cfgLimitsCacheTTL, "30s")
+	viper.Set(cfgLimitsTimeout, 2)
+
+	limits := configureLimits(proxy.DefaultLimits())
+
+	if limits.CacheTTL != 30*time.Second || limits.RequestTimeout != 2*time.Second {
+		t.Error("limits not configured", limits)
+	}
+
+	if limits.ShutdownGracePeriod != proxy.ShutdownGracePeriodMinValue {
+		t.Error("default limit changed", limits.ShutdownGracePeriod)
+	}
+}
@@ -0,0 +1,228 @@
+/*
+Copyright © 2018-2021 Neil Hemming
+*/
+
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+	"golang.org/x/net/context/ctxhttp"
+)
+
+const (
+	cfgVaultAddr  = "secrets.vaultAddr"
+	cfgVaultToken = "secrets.vaultToken"
+
+	refEnv   = "env:"
+	refFile  = "file:"
+	refVault = "vault:"
+
+	vaultTimeout = 10 * time.Second
+)
+
+type (
+	// secretResolver resolves secret references of the form env:VAR, file:/path, vault:path#field and
+	// http(s)://host/path#field.  Values without a reference prefix, and URLs without a field, are
+	// returned unchanged.
+	secretResolver struct {
+		ctx        context.Context
+		vaultAddr  string
+		vaultToken string
+		client     *http.Client
+
+		// secrets read from the secrets store during this resolution pass, by url
+		vaultCache map[string]map[string]interface{}
+	}
+)
+
+// newSecretResolver creates a resolver using the vault settings from the config, falling back to
+// the VAULT_ADDR and VAULT_TOKEN environment variables.  The vault token may itself be a reference.
+func newSecretResolver(ctx context.Context) (*secretResolver, error) {
+	r := &secretResolver{
+		ctx:        ctx,
+		vaultAddr:  viper.GetString(cfgVaultAddr),
+		vaultToken: viper.GetString(cfgVaultToken),
+		vaultCache: make(map[string]map[string]interface{}),
+	}
+
+	if r.vaultAddr == "" {
+		r.vaultAddr = os.Getenv("VAULT_ADDR")
+	}
+	if r.vaultToken == "" {
+		r.vaultToken = os.Getenv("VAULT_TOKEN")
+	}
+
+	if strings.HasPrefix(r.vaultToken, refVault) || isSecretURL(r.vaultToken) {
+		return nil, errors.New("vault token cannot be a secrets store reference")
+	}
+
+	token, err := r.resolve(r.vaultToken)
+	if err != nil {
+		return nil, fmt.Errorf("vault token: %w", err)
+	}
+	r.vaultToken = token
+
+	return r, nil
+}
+
+// resolveAll resolves each of the passed values in place.
+func (r *secretResolver) resolveAll(values ...*string) error {
+	for _, v := range values {
+		resolved, err := r.resolve(*v)
+		if err != nil {
+			return err
+		}
+		*v = resolved
+	}
+
+	return nil
+}
+
+// resolve returns the value of a secret reference.
+func (r *secretResolver) resolve(value string) (string, error) {
+	switch {
+	case strings.HasPrefix(value, refEnv):
+		name := strings.TrimPrefix(value, refEnv)
+		v, ok := os.LookupEnv(name)
+		if !ok {
+			return "", fmt.Errorf("environment variable %s is not set", name)
+		}
+		return v, nil
+
+	case strings.HasPrefix(value, refFile):
+		b, err := ioutil.ReadFile(strings.TrimPrefix(value, refFile))
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimRight(string(b), "\r\n"), nil
+
+	case strings.HasPrefix(value, refVault):
+		return r.resolveVault(strings.TrimPrefix(value, refVault))
+
+	case isSecretURL(value):
+		return r.resolveURL(value)
+	}
+
+	return value, nil
+}
+
+// isSecretURL reports if the value is an http or https url with a #field fragment.
+func isSecretURL(value string) bool {
+	return (strings.HasPrefix(value, "http://") || strings.HasPrefix(value, "https://")) && strings.Contains(value, "#")
+}
+
+// resolveURL reads a field from the secret at a url serving the Vault compatible KV API, url#field.
+// The request is authenticated with the vault token, if one is configured.
+func (r *secretResolver) resolveURL(ref string) (string, error) {
+	u, err := url.Parse(ref)
+	if err != nil || u.Host == "" || u.Fragment == "" {
+		return "", errors.New("secrets store reference must be of the form http(s)://host/path#field")
+	}
+
+	field := u.Fragment
+	u.Fragment = ""
+
+	return r.readField(u.String(), field)
+}
+
+// resolveVault reads a field from a Vault compatible KV secrets engine at the vault address, path#field.
+func (r *secretResolver) resolveVault(ref string) (string, error) {
+	parts := strings.SplitN(ref, "#", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", fmt.Errorf("vault reference %s must be of the form path#field", ref)
+	}
+
+	if r.vaultAddr == "" {
+		return "", errors.New("vault address is not configured")
+	}
+
+	return r.readField(strings.TrimSuffix(r.vaultAddr, "/")+"/v1/"+strings.Trim(parts[0], "/"), parts[1])
+}
+
+// readField returns a field of the secret at the url, each secret is read once per resolution pass.
+func (r *secretResolver) readField(secretURL, field string) (string, error) {
+	name := redactedSecretURL(secretURL)
+
+	data, ok := r.vaultCache[secretURL]
+	if !ok {
+		var err error
+		if data, err = r.readVault(secretURL); err != nil {
+			return "", fmt.Errorf("secret %s: %w", name, err)
+		}
+		r.vaultCache[secretURL] = data
+	}
+
+	v, ok := data[field]
+	if !ok {
+		return "", fmt.Errorf("secret %s has no field %s", name, field)
+	}
+
+	if s, ok := v.(string); ok {
+		return s, nil
+	}
+
+	return fmt.Sprint(v), nil
+}
+
+// redactedSecretURL returns the url with any password hidden, for use in messages.
+func redactedSecretURL(secretURL string) string {
+	if u, err := url.Parse(secretURL); err == nil {
+		return u.Redacted()
+	}
+
+	return secretURL
+}
+
+// readVault reads the data of a secret from a url serving the Vault compatible KV API.
+// Both the KV version 1 and version 2 response formats are supported.
+func (r *secretResolver) readVault(secretURL string) (map[string]interface{}, error) {
+	req, err := http.NewRequest("GET", secretURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	if r.vaultToken != "" {
+		req.Header.Set("X-Vault-Token", r.vaultToken)
+	}
+
+	ctx, cancel := context.WithTimeout(r.ctx, vaultTimeout)
+	defer cancel()
+
+	resp, err := ctxhttp.Do(ctx, r.client, req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("read returned status %d", resp.StatusCode)
+	}
+
+	var body struct {
+		Data map[string]interface{} `json:"data"`
+	}
+
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&body); err != nil {
+		return nil, fmt.Errorf("read: %w", err)
+	}
+
+	// KV version 2 nests the secret inside data.data
+	if nested, ok := body.Data["data"].(map[string]interface{}); ok {
+		if _, hasMeta := body.Data["metadata"]; hasMeta {
+			return nested, nil
+		}
+	}
+
+	return body.Data, nil
+}
@@ -0,0 +1,139 @@
+/*
+Copyright © 2018-2021 Neil Hemming
+*/
+
+package cmd
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func newTestResolver(vaultAddr string) *secretResolver {
+	return &secretResolver{
+		ctx:        context.Background(),
+		vaultAddr:  vaultAddr,
+		vaultToken: "root",
+		vaultCache: make(map[string]map[string]interface{}),
+	}
+}
+
+func TestResolvePlainValueUnchanged(t *testing.T) {
+	r := newTestResolver("")
+
+	if v, err := r.resolve("plain"); err != nil || v != "plain" {
+		t.Error("Plain value changed", v, err)
+	}
+}
+
+func TestResolveEnv(t *testing.T) {
+	os.Setenv("OAP_TEST_SECRET", "from-env")
+	defer os.Unsetenv("OAP_TEST_SECRET")
+
+	r := newTestResolver("")
+
+	if v, err := r.resolve("env:OAP_TEST_SECRET"); err != nil || v != "from-env" {
+		t.Error("Env not resolved", v, err)
+	}
+
+	if _, err := r.resolve("env:OAP_TEST_MISSING"); err == nil {
+		t.Error("Missing env not caught")
+	}
+}
+
+func TestResolveFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "secret")
+	if err := ioutil.WriteFile(path, []byte("from-file\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	r := newTestResolver("")
+
+	if v, err := r.resolve("file:" + path); err != nil || v != "from-file" {
+		t.Error("File not resolved", v, err)
+	}
+}
+
+func TestResolveVaultKV2(t *testing.T) {
+	calls := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if r.URL.Path != "/v1/secret/data/app" || r.Header.Get("X-Vault-Token") != "root" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		_, _ = w.Write([]byte("{\"data\":{\"data\":{\"password\":\"pw\",\"secret\":\"s\"},\"metadata\":{\"version\":1}}}"))
+	}))
+	defer srv.Close()
+
+	r := newTestResolver(srv.URL)
+
+	password, secret := "vault:secret/data/app#password", "vault:secret/data/app#secret"
+	if err := r.resolveAll(&password, &secret); err != nil {
+		t.Fatal("resolveAll", err)
+	}
+
+	if password != "pw" || secret != "s" {
+		t.Error("Vault not resolved", password, secret)
+	}
+
+	if calls != 1 {
+		t.Error("Vault secret not cached within pass", calls)
+	}
+
+	if _, err := r.resolve("vault:secret/data/app#missing"); err == nil {
+		t.Error("Missing field not caught")
+	}
+}
+
+func TestResolveVaultKV1(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("{\"data\":{\"password\":\"pw\"}}"))
+	}))
+	defer srv.Close()
+
+	r := newTestResolver(srv.URL)
+
+	if v, err := r.resolve("vault:kv/app#password"); err != nil || v != "pw" {
+		t.Error("Vault KV1 not resolved", v, err)
+	}
+}
+
+func TestResolveSecretsStoreURL(t *testing.T) {
+	calls := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if r.URL.Path != "/v1/secret/data/app" || r.Header.Get("X-Vault-Token") != "root" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		_, _ = w.Write([]byte("{\"data\":{\"data\":{\"password\":\"pw\",\"secret\":\"s\"},\"metadata\":{\"version\":1}}}"))
+	}))
+	defer srv.Close()
+
+	// The store's url is part of the reference, no vault address is needed
+	r := newTestResolver("")
+
+	password, secret := srv.URL+"/v1/secret/data/app#password", srv.URL+"/v1/secret/data/app#secret"
+	if err := r.resolveAll(&password, &secret); err != nil {
+		t.Fatal("resolveAll", err)
+	}
+
+	if password != "pw" || secret != "s" || calls != 1 {
+		t.Error("Secrets store url not resolved", password, secret, calls)
+	}
+
+	if _, err := r.resolve(srv.URL + "/v1/secret/data/other#password"); err == nil {
+		t.Error("Forbidden read not caught")
+	}
+
+	// Urls without a field are plain values
+	if v, err := r.resolve("https://auth.example.com/oauth2/token"); err != nil || v != "https://auth.example.com/oauth2/token" {
+		t.Error("Plain url changed", v, err)
+	}
+}
@@ -5,26 +5,59 @@ Copyright © 2018-2021 Neil Hemming
 package cmd
 
 import (
+	"context"
+	"fmt"
 	"time"
 
-	"github.com/nehemming/cirocket/pkg/loggee"
-	"github.com/nehemming/oauthproxy/internal/proxy"
+	"github.com/nehemming/oauthproxy/pkg/proxy"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 )
 
 const (
 	flagEndpoint = "downstream"
+	flagIssuer   = "issuer"
 	flagPort     = "port"
 	flagSilent   = "silent"
 
-	cfgEndpoint = "serve.downstream"
-	cfgPort     = "serve.port"
-	cfgCacheTTL = "serve.cacheTTL"
-	cfgTimeout  = "serve.timeout"
-	cfgShutdown = "serve.shutdown"
-	cfgSilent   = "serve.silent"
-	cfgPoolSize = "serve.poolSize"
+	cfgEndpoint  = "serve.downstream"
+	cfgIssuer    = "serve.issuer"
+	cfgRefresh   = "serve.discoveryRefresh"
+	cfgPort      = "serve.port"
+	cfgCacheTTL  = "serve.cacheTTL"
+	cfgTimeout   = "serve.timeout"
+	cfgShutdown  = "serve.shutdown"
+	cfgSilent    = "serve.silent"
+	cfgPoolSize  = "serve.poolSize"
+	cfgDocTTLMin = "serve.documentTTLMin"
+	cfgDocTTLMax = "serve.documentTTLMax"
+
+	cfgIntrospectionFallback = "serve.introspectionFallback"
+	cfgClients               = "serve.clients"
+
+	cfgTransportHTTPProxy           = "serve.transport.httpProxy"
+	cfgTransportHTTPSProxy          = "serve.transport.httpsProxy"
+	cfgTransportNoProxy             = "serve.transport.noProxy"
+	cfgTransportCAFiles             = "serve.transport.caFiles"
+	cfgTransportClientCert          = "serve.transport.clientCert"
+	cfgTransportClientKey           = "serve.transport.clientKey"
+	cfgTransportTLSMinVersion       = "serve.transport.tlsMinVersion"
+	cfgTransportMaxIdleConns        = "serve.transport.maxIdleConns"
+	cfgTransportMaxIdleConnsPerHost = "serve.transport.maxIdleConnsPerHost"
+	cfgTransportMaxConnsPerHost     = "serve.transport.maxConnsPerHost"
+	cfgTransportIdleConnTimeout     = "serve.transport.idleConnTimeout"
+	cfgTransportKeepAlive           = "serve.transport.keepAlive"
+)
+
+type (
+	// clientConfig is the config file form of proxy held client credentials.
+	clientConfig struct {
+		ClientID     string `mapstructure:"clientId"`
+		ClientSecret string `mapstructure:"clientSecret"`
+		PrivateKey   string `mapstructure:"privateKey"`
+		KeyID        string `mapstructure:"keyId"`
+		AuthMethod   string `mapstructure:"authMethod"`
+	}
 )
 
 func (cli *cli) runServerCmd(cmd *cobra.Command, args []string) error {
@@ -32,57 +65,211 @@ func (cli *cli) runServerCmd(cmd *cobra.Command, args []string) error {
 	cmd.SilenceUsage = true
 
 	// coonfigure the proxy settings based off defaults and viper settings
-	settings := configureSettings(proxy.DefaultSettings())
+	settings, err := configureSettings(cli.ctx, proxy.DefaultSettings())
+	if err != nil {
+		return err
+	}
 
-	// Run the service and return any errors
-	return proxy.Run(cli.ctx, settings)
+	logFormat := installLogHandler()
+
+	// Run the service, applying config changes while running, and return any errors
+	return proxy.RunWithReload(cli.ctx, settings, watchConfig(cli.ctx, logFormat))
 }
 
-func (cli *cli) bindServeFlagsAndConfig(cmd *cobra.Command) {
-	pf := cmd.PersistentFlags()
+// bindServeFlagsAndConfig adds the serve flags to each command and sets the config defaults.
+// The flags are bound to the config when one of the commands, or a sub command, is run.
+func (cli *cli) bindServeFlagsAndConfig(cmds ...*cobra.Command) {
+	for _, cmd := range cmds {
+		pf := cmd.PersistentFlags()
 
-	pf.String(flagEndpoint, "", "downstream url")
-	_ = viper.BindPFlag(cfgEndpoint, pf.Lookup(flagEndpoint))
+		pf.String(flagEndpoint, "", "downstream url")
+		pf.String(flagIssuer, "", "openid issuer url used to discover the downstream endpoints")
+		pf.Uint(flagPort, 8090, "port proxy listening on")
+		pf.Bool(flagSilent, false, "silence all output logging")
+		pf.String(flagLogFormat, logFormatText, "log output format, text or json")
+		pf.String(flagLogLevel, "info", "minimum log level, debug, info, warn or error")
 
-	pf.Uint(flagPort, 8090, "port proxy listening on")
-	_ = viper.BindPFlag(cfgPort, pf.Lookup(flagPort))
-	viper.SetDefault(cfgPort, 8090)
+		cmd.PersistentPreRun = bindServeFlags
+	}
 
+	viper.SetDefault(cfgPort, 8090)
 	viper.SetDefault(cfgCacheTTL, 15)
 	viper.SetDefault(cfgShutdown, 10)
 	viper.SetDefault(cfgTimeout, 30)
 	viper.SetDefault(cfgPoolSize, 2)
-
-	pf.Bool(flagSilent, false, "silence all output logging")
-	_ = viper.BindPFlag(cfgSilent, pf.Lookup(flagSilent))
+	viper.SetDefault(cfgRefresh, 60)
+	viper.SetDefault(cfgDocTTLMin, 1)
+	viper.SetDefault(cfgDocTTLMax, 1440)
+	viper.SetDefault(cfgAccessLogMaxBackups, 3)
 	viper.SetDefault(cfgSilent, false)
+	setEventDefaults()
+}
+
+// bindServeFlags binds the serve flags of the command being run to the config.
+func bindServeFlags(cmd *cobra.Command, args []string) {
+	flags := cmd.Flags()
+
+	_ = viper.BindPFlag(cfgEndpoint, flags.Lookup(flagEndpoint))
+	_ = viper.BindPFlag(cfgIssuer, flags.Lookup(flagIssuer))
+	_ = viper.BindPFlag(cfgPort, flags.Lookup(flagPort))
+	_ = viper.BindPFlag(cfgSilent, flags.Lookup(flagSilent))
+	_ = viper.BindPFlag(cfgLogFormat, flags.Lookup(flagLogFormat))
+	_ = viper.BindPFlag(cfgLogLevel, flags.Lookup(flagLogLevel))
 }
 
 // configureSettings configures the applications settings.
-func configureSettings(settings proxy.Settings) proxy.Settings {
+// Secret references in the config are resolved each time the settings are configured.
+// Every problem found in the config, and the settings built from it, is reported against its config key.
+func configureSettings(ctx context.Context, settings proxy.Settings) (proxy.Settings, error) {
+	problems := validateConfig()
+
 	// Add in the settings
 	endpoint := viper.GetString(cfgEndpoint)
+	issuer := viper.GetString(cfgIssuer)
 	port := viper.GetUint(cfgPort)
 
-	settings.CacheTTL = time.Duration(viper.GetUint64(cfgCacheTTL)) * time.Minute
-	settings.ShutdownGracePeriod = time.Duration(viper.GetUint64(cfgShutdown)) * time.Second
-	settings.RequestTimeout = time.Duration(viper.GetUint64(cfgTimeout)) * time.Second
+	settings.CacheTTL = configDuration(cfgCacheTTL, time.Minute)
+	settings.ShutdownGracePeriod = configDuration(cfgShutdown, time.Second)
+	settings.RequestTimeout = configDuration(cfgTimeout, time.Second)
 	settings.PoolSize = viper.GetInt(cfgPoolSize)
+	settings.DiscoveryRefresh = configDuration(cfgRefresh, time.Minute)
+	settings.DocumentTTLMin = configDuration(cfgDocTTLMin, time.Minute)
+	settings.DocumentTTLMax = configDuration(cfgDocTTLMax, time.Minute)
+	settings.Limits = configureLimits(settings.Limits)
+	settings.IntrospectionFallback = viper.GetBool(cfgIntrospectionFallback)
+	settings.Transport = configureTransport(settings.Transport)
 
-	var logger proxy.LoggerFunc
+	resolver, err := newSecretResolver(ctx)
+	if err != nil {
+		return settings, err
+	}
 
-	if !viper.GetBool(cfgSilent) {
-		logger = func(isError bool, format string, args ...interface{}) {
-			if isError {
-				loggee.Errorf(format, args...)
-			} else {
-				loggee.Infof(format, args...)
-			}
-		}
+	clients, err := configureClients(resolver)
+	if err != nil {
+		return settings, err
+	}
+	settings.Clients = clients
+
+	identities, err := configureIdentities(resolver)
+	if err != nil {
+		return settings, err
+	}
+	settings.Identities = identities
+
+	callerAuth, err := configureCallerAuth(settings.CallerAuth, resolver)
+	if err != nil {
+		return settings, err
+	}
+	settings.CallerAuth = callerAuth
+	settings.ListenerTLS = configureListenerTLS(settings.ListenerTLS)
+	settings.IPFilter = configureIPFilter(settings.IPFilter)
+	settings.AccessLog = configureAccessLog(settings.AccessLog)
+	settings.AuditLog = configureAuditLog(settings.AuditLog)
+
+	tracing, err := configureTracing(settings.Tracing, resolver)
+	if err != nil {
+		return settings, err
+	}
+	settings.Tracing = tracing
+
+	events, err := configureEvents(settings.Events, resolver)
+	if err != nil {
+		return settings, err
 	}
+	settings.Events = events
+	settings.CircuitBreaker = configureCircuitBreaker(settings.CircuitBreaker)
 
-	return settings.
+	logger, err := configureLogger()
+	if err != nil && len(problems) == 0 {
+		// Bad log settings are otherwise reported by the schema along with every other problem
+		return settings, err
+	}
+
+	settings = settings.
 		WithEndpoint(endpoint).
+		WithIssuer(issuer).
 		WithLogger(logger).
 		WithHTTPPort(port)
+
+	settingsProblems(settings, problems)
+	if len(problems) > 0 {
+		return settings, problemsError(problems)
+	}
+
+	return settings, nil
+}
+
+// configureLimits reads the lower bounds validation enforces, values not in the config retain their defaults.
+func configureLimits(limits proxy.Limits) proxy.Limits {
+	if viper.IsSet(cfgLimitsCacheTTL) {
+		limits.CacheTTL = configDuration(cfgLimitsCacheTTL, time.Minute)
+	}
+	if viper.IsSet(cfgLimitsTimeout) {
+		limits.RequestTimeout = configDuration(cfgLimitsTimeout, time.Second)
+	}
+	if viper.IsSet(cfgLimitsShutdown) {
+		limits.ShutdownGracePeriod = configDuration(cfgLimitsShutdown, time.Second)
+	}
+	if viper.IsSet(cfgLimitsDiscoveryRefresh) {
+		limits.DiscoveryRefresh = configDuration(cfgLimitsDiscoveryRefresh, time.Minute)
+	}
+
+	return limits
+}
+
+// configureClients reads the client credentials held by the proxy.
+func configureClients(resolver *secretResolver) (map[string]proxy.ClientCredentials, error) {
+	var cfg map[string]clientConfig
+
+	if err := viper.UnmarshalKey(cfgClients, &cfg); err != nil {
+		return nil, fmt.Errorf("%s: %w", cfgClients, err)
+	}
+
+	clients := make(map[string]proxy.ClientCredentials, len(cfg))
+	for alias, c := range cfg {
+		if err := resolver.resolveAll(&c.ClientID, &c.ClientSecret, &c.PrivateKey); err != nil {
+			return nil, fmt.Errorf("%s.%s: %w", cfgClients, alias, err)
+		}
+
+		clients[alias] = proxy.ClientCredentials{
+			ClientID:     c.ClientID,
+			ClientSecret: c.ClientSecret,
+			PrivateKey:   c.PrivateKey,
+			KeyID:        c.KeyID,
+			AuthMethod:   c.AuthMethod,
+		}
+	}
+
+	return clients, nil
+}
+
+// configureTransport configures the outbound transport, values not in the config retain their defaults.
+func configureTransport(ts proxy.TransportSettings) proxy.TransportSettings {
+	ts.HTTPProxy = viper.GetString(cfgTransportHTTPProxy)
+	ts.HTTPSProxy = viper.GetString(cfgTransportHTTPSProxy)
+	ts.NoProxy = viper.GetString(cfgTransportNoProxy)
+	ts.CAFiles = viper.GetStringSlice(cfgTransportCAFiles)
+	ts.ClientCertFile = viper.GetString(cfgTransportClientCert)
+	ts.ClientKeyFile = viper.GetString(cfgTransportClientKey)
+
+	if viper.IsSet(cfgTransportTLSMinVersion) {
+		ts.TLSMinVersion = viper.GetString(cfgTransportTLSMinVersion)
+	}
+	if viper.IsSet(cfgTransportMaxIdleConns) {
+		ts.MaxIdleConns = viper.GetInt(cfgTransportMaxIdleConns)
+	}
+	if viper.IsSet(cfgTransportMaxIdleConnsPerHost) {
+		ts.MaxIdleConnsPerHost = viper.GetInt(cfgTransportMaxIdleConnsPerHost)
+	}
+	if viper.IsSet(cfgTransportMaxConnsPerHost) {
+		ts.MaxConnsPerHost = viper.GetInt(cfgTransportMaxConnsPerHost)
+	}
+	if viper.IsSet(cfgTransportIdleConnTimeout) {
+		ts.IdleConnTimeout = configDuration(cfgTransportIdleConnTimeout, time.Second)
+	}
+	if viper.IsSet(cfgTransportKeepAlive) {
+		ts.KeepAlive = configDuration(cfgTransportKeepAlive, time.Second)
+	}
+
+	return ts
 }
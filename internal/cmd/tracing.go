@@ -0,0 +1,42 @@
+/*
+Copyright © 2018-2021 Neil Hemming
+*/
+
+package cmd
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/nehemming/oauthproxy/pkg/proxy"
+	"github.com/spf13/viper"
+)
+
+const (
+	cfgTracingEndpoint      = "serve.tracing.endpoint"
+	cfgTracingServiceName   = "serve.tracing.serviceName"
+	cfgTracingHeaders       = "serve.tracing.headers"
+	cfgTracingFlushInterval = "serve.tracing.flushInterval"
+)
+
+// configureTracing reads the trace export settings, resolving secret references in the headers.
+func configureTracing(ts proxy.TracingSettings, resolver *secretResolver) (proxy.TracingSettings, error) {
+	ts.Endpoint = viper.GetString(cfgTracingEndpoint)
+	ts.ServiceName = viper.GetString(cfgTracingServiceName)
+
+	if viper.IsSet(cfgTracingFlushInterval) {
+		ts.FlushInterval = configDuration(cfgTracingFlushInterval, time.Second)
+	}
+
+	headers := viper.GetStringMapString(cfgTracingHeaders)
+	for k, v := range headers {
+		resolved, err := resolver.resolve(v)
+		if err != nil {
+			return ts, fmt.Errorf("%s.%s: %w", cfgTracingHeaders, k, err)
+		}
+		headers[k] = resolved
+	}
+	ts.Headers = headers
+
+	return ts, nil
+}
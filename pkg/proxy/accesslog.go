@@ -0,0 +1,347 @@
+/*
+Copyright © 2018-2021 Neil Hemming
+*/
+
+package proxy
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	multierror "github.com/hashicorp/go-multierror"
+)
+
+const (
+	// AccessLogCommon writes access log lines in the common log format followed by the proxy's fields.
+	AccessLogCommon = "common"
+
+	// AccessLogJSON writes each access log line as a JSON object.
+	AccessLogJSON = "json"
+
+	// AccessLogStdout is the access log output writing to standard output.
+	AccessLogStdout = "stdout"
+
+	// Cache outcomes recorded in the access log.
+	outcomeHit       = "hit"
+	outcomeMiss      = "miss"
+	outcomeCoalesced = "coalesced"
+	outcomeStale     = "stale"
+)
+
+type (
+	// AccessLogSettings configures the access log written for each inbound request.
+	// Only the listed request fields are logged, form bodies and Authorization headers never are.
+	AccessLogSettings struct {
+		// Output is stdout or the path of the log file, blank disables the access log
+		Output string
+
+		// Format is common or json, defaults to common
+		Format string
+
+		// HashUsernames logs a hash of the username rather than the username itself
+		HashUsernames bool
+
+		// MaxSize is the size in bytes at which the log file is rotated, zero never rotates
+		MaxSize int64
+
+		// MaxBackups is the number of rotated files kept
+		MaxBackups int
+	}
+
+	// accessRecord collects the details of a request logged in the access log.
+	// It is only updated by the goroutine handling the request.
+	accessRecord struct {
+		start            time.Time
+		remoteAddr       string
+		method           string
+		path             string
+		requestID        string
+		clientID         string
+		username         string
+		outcome          string
+		downstreamStatus int
+	}
+
+	// accessLogLine is the JSON form of an access log line.
+	accessLogLine struct {
+		Time             string  `json:"time"`
+		RemoteAddr       string  `json:"remote_addr"`
+		Method           string  `json:"method"`
+		Path             string  `json:"path"`
+		Status           int     `json:"status"`
+		Bytes            int64   `json:"bytes"`
+		RequestID        string  `json:"request_id,omitempty"`
+		ClientID         string  `json:"client_id,omitempty"`
+		Username         string  `json:"username,omitempty"`
+		Cache            string  `json:"cache,omitempty"`
+		DownstreamStatus int     `json:"downstream_status,omitempty"`
+		LatencyMS        float64 `json:"latency_ms"`
+	}
+
+	// accessWriter captures the status and size of the reply.
+	accessWriter struct {
+		http.ResponseWriter
+		status int
+		bytes  int64
+	}
+
+	// accessLogger writes the access log.
+	accessLogger struct {
+		mu     sync.Mutex
+		out    io.Writer
+		closer io.Closer
+		format string
+		hash   bool
+	}
+
+	// rotatingFile is a log file rotated when it exceeds its maximum size.
+	rotatingFile struct {
+		path       string
+		maxSize    int64
+		maxBackups int
+		file       *os.File
+		size       int64
+	}
+
+	// accessRecordKey is the context key of the request's access record.
+	accessRecordKey struct{}
+)
+
+func (als AccessLogSettings) validateSettings() error {
+	var result error
+
+	if als.Format != "" && als.Format != AccessLogCommon && als.Format != AccessLogJSON {
+		result = multierror.Append(result, fmt.Errorf("unknown access log format %s", als.Format))
+	}
+
+	if als.MaxSize < 0 || als.MaxBackups < 0 {
+		result = multierror.Append(result, errors.New("access log rotation limits cannot be negative"))
+	}
+
+	return result
+}
+
+// newAccessLogger opens the access log, nil if the access log is disabled.
+func (als AccessLogSettings) newAccessLogger() (*accessLogger, error) {
+	al := &accessLogger{format: als.Format, hash: als.HashUsernames}
+
+	switch als.Output {
+	case "":
+		return nil, nil
+	case AccessLogStdout:
+		al.out = os.Stdout
+	default:
+		rf, err := openRotatingFile(als.Output, als.MaxSize, als.MaxBackups)
+		if err != nil {
+			return nil, fmt.Errorf("open access log: %w", err)
+		}
+		al.out, al.closer = rf, rf
+	}
+
+	return al, nil
+}
+
+// close closes the access log file.
+func (al *accessLogger) close() error {
+	if al == nil || al.closer == nil {
+		return nil
+	}
+
+	al.mu.Lock()
+	defer al.mu.Unlock()
+
+	return al.closer.Close()
+}
+
+// write logs the completed request.
+func (al *accessLogger) write(rec *accessRecord, aw *accessWriter, now time.Time) {
+	username := rec.username
+	if al.hash && username != "" {
+		username = hashUsername(username)
+	}
+
+	line := accessLogLine{
+		Time:             rec.start.UTC().Format(time.RFC3339Nano),
+		RemoteAddr:       rec.remoteAddr,
+		Method:           rec.method,
+		Path:             rec.path,
+		Status:           aw.status,
+		Bytes:            aw.bytes,
+		RequestID:        rec.requestID,
+		ClientID:         rec.clientID,
+		Username:         username,
+		Cache:            rec.outcome,
+		DownstreamStatus: rec.downstreamStatus,
+		LatencyMS:        float64(now.Sub(rec.start).Microseconds()) / 1000,
+	}
+
+	var b []byte
+	if al.format == AccessLogJSON {
+		b, _ = json.Marshal(line)
+		b = append(b, '\n')
+	} else {
+		b = []byte(line.common())
+	}
+
+	al.mu.Lock()
+	defer al.mu.Unlock()
+
+	_, _ = al.out.Write(b)
+}
+
+// common formats the line in the common log format followed by the proxy's fields.
+func (line accessLogLine) common() string {
+	dash := func(s string) string {
+		if s == "" {
+			return "-"
+		}
+		return s
+	}
+
+	host, _, err := net.SplitHostPort(line.RemoteAddr)
+	if err != nil {
+		host = line.RemoteAddr
+	}
+
+	t, _ := time.Parse(time.RFC3339Nano, line.Time)
+
+	downstream := "-"
+	if line.DownstreamStatus != 0 {
+		downstream = strconv.Itoa(line.DownstreamStatus)
+	}
+
+	return fmt.Sprintf("%s - %s [%s] \"%s %s\" %d %d client_id=%s cache=%s downstream=%s latency_ms=%.3f request_id=%s\n",
+		dash(host), dash(line.Username), t.Format("02/Jan/2006:15:04:05 -0700"),
+		line.Method, line.Path, line.Status, line.Bytes,
+		dash(line.ClientID), dash(line.Cache), downstream, line.LatencyMS, dash(line.RequestID))
+}
+
+// hashUsername returns a short stable hash of the username.
+func hashUsername(username string) string {
+	sum := sha256.Sum256([]byte(username))
+	return hex.EncodeToString(sum[:8])
+}
+
+// WriteHeader records the status of the reply.
+func (aw *accessWriter) WriteHeader(statusCode int) {
+	if aw.status == 0 {
+		aw.status = statusCode
+	}
+	aw.ResponseWriter.WriteHeader(statusCode)
+}
+
+// Write records the size of the reply.
+func (aw *accessWriter) Write(b []byte) (int, error) {
+	if aw.status == 0 {
+		aw.status = http.StatusOK
+	}
+	n, err := aw.ResponseWriter.Write(b)
+	aw.bytes += int64(n)
+	return n, err
+}
+
+// withAccessRecord attaches a new access record to the request context.
+func withAccessRecord(r *http.Request, now time.Time) (*http.Request, *accessRecord) {
+	rec := &accessRecord{
+		start:      now,
+		remoteAddr: r.RemoteAddr,
+		method:     r.Method,
+		path:       r.URL.Path,
+		requestID:  requestID(r.Context()),
+	}
+
+	return r.WithContext(context.WithValue(r.Context(), accessRecordKey{}, rec)), rec
+}
+
+// accessRecordFrom returns the request's access record, nil if the request is not being logged.
+func accessRecordFrom(ctx context.Context) *accessRecord {
+	rec, _ := ctx.Value(accessRecordKey{}).(*accessRecord)
+	return rec
+}
+
+// setOutcome records the cache outcome of the request in its access record.
+func setOutcome(ctx context.Context, outcome string) {
+	if rec := accessRecordFrom(ctx); rec != nil {
+		rec.outcome = outcome
+	}
+}
+
+// openRotatingFile opens the log file for appending.
+func openRotatingFile(path string, maxSize int64, maxBackups int) (*rotatingFile, error) {
+	rf := &rotatingFile{path: path, maxSize: maxSize, maxBackups: maxBackups}
+
+	if err := rf.open(); err != nil {
+		return nil, err
+	}
+
+	return rf, nil
+}
+
+func (rf *rotatingFile) open() error {
+	f, err := os.OpenFile(rf.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	rf.file, rf.size = f, info.Size()
+	return nil
+}
+
+// Write appends to the file, rotating it first if the write would exceed the maximum size.
+func (rf *rotatingFile) Write(b []byte) (int, error) {
+	if rf.maxSize > 0 && rf.size > 0 && rf.size+int64(len(b)) > rf.maxSize {
+		if err := rf.rotate(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := rf.file.Write(b)
+	rf.size += int64(n)
+	return n, err
+}
+
+// rotate renames the file to path.1, shifting older backups up and removing the oldest.
+func (rf *rotatingFile) rotate() error {
+	if err := rf.file.Close(); err != nil {
+		return err
+	}
+
+	if rf.maxBackups == 0 {
+		if err := os.Remove(rf.path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return rf.open()
+	}
+
+	for i := rf.maxBackups - 1; i > 0; i-- {
+		_ = os.Rename(fmt.Sprintf("%s.%d", rf.path, i), fmt.Sprintf("%s.%d", rf.path, i+1))
+	}
+
+	if err := os.Rename(rf.path, rf.path+".1"); err != nil {
+		return err
+	}
+
+	return rf.open()
+}
+
+// Close closes the file.
+func (rf *rotatingFile) Close() error {
+	return rf.file.Close()
+}
@@ -0,0 +1,70 @@
+/*
+Copyright © 2018-2021 Neil Hemming
+*/
+
+package proxy
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestAccessLogValidateSettings(t *testing.T) {
+	if err := (AccessLogSettings{Format: "xml", MaxSize: -1}).validateSettings(); err == nil {
+		t.Error("Bad access log settings not caught")
+	}
+
+	if err := (AccessLogSettings{Output: AccessLogStdout, Format: AccessLogJSON}).validateSettings(); err != nil {
+		t.Error("Unexpected", err)
+	}
+}
+
+func TestAccessLogCommonFormat(t *testing.T) {
+	line := accessLogLine{
+		Time:       time.Date(2021, 7, 1, 10, 0, 0, 0, time.UTC).Format(time.RFC3339Nano),
+		RemoteAddr: "127.0.0.1:5000",
+		Method:     "POST",
+		Path:       "/token",
+		Status:     200,
+		Bytes:      10,
+		ClientID:   "c1",
+		Cache:      outcomeStale,
+		LatencyMS:  1.5,
+	}
+
+	expected := `127.0.0.1 - - [01/Jul/2021:10:00:00 +0000] "POST /token" 200 10 client_id=c1 cache=stale downstream=- latency_ms=1.500 request_id=-` + "\n"
+	if s := line.common(); s != expected {
+		t.Error("Unexpected", s)
+	}
+}
+
+func TestRotatingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+
+	rf, err := openRotatingFile(path, 10, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, s := range []string{"aaaaaaaa\n", "bbbbbbbb\n", "cccccccc\n"} {
+		if _, err := rf.Write([]byte(s)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rf.Close()
+
+	if b, _ := ioutil.ReadFile(path); string(b) != "cccccccc\n" {
+		t.Error("Unexpected current file", string(b))
+	}
+
+	if b, _ := ioutil.ReadFile(path + ".1"); string(b) != "bbbbbbbb\n" {
+		t.Error("Unexpected backup file", string(b))
+	}
+
+	if _, err := os.Stat(path + ".2"); !os.IsNotExist(err) {
+		t.Error("Too many backups kept")
+	}
+}
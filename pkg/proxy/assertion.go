@@ -0,0 +1,282 @@
+/*
+Copyright © 2018-2021 Neil Hemming
+*/
+
+package proxy
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// clientAssertionTypeJWT is the client_assertion_type of private_key_jwt and client_secret_jwt authentication.
+	clientAssertionTypeJWT = "urn:ietf:params:oauth:client-assertion-type:jwt-bearer"
+)
+
+type (
+	// assertionClaims are the identifying claims of a JWT assertion.
+	assertionClaims struct {
+		Issuer   string          `json:"iss"`
+		Subject  string          `json:"sub"`
+		Audience json.RawMessage `json:"aud"`
+		Expiry   int64           `json:"exp"`
+		ID       string          `json:"jti"`
+	}
+
+	// jwtHeader is the JOSE header of a JWT.
+	jwtHeader struct {
+		Algorithm string `json:"alg"`
+		KeyID     string `json:"kid"`
+	}
+
+	// verificationKey is a public key assertions are verified with.
+	verificationKey struct {
+		keyID string
+		key   crypto.PublicKey
+	}
+
+	// jsonWebKeySet is a JSON web key set (RFC 7517).
+	jsonWebKeySet struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+
+	// jsonWebKey is the subset of a JSON web key used to verify RS256 and ES256 signatures.
+	jsonWebKey struct {
+		KeyType  string `json:"kty"`
+		KeyID    string `json:"kid"`
+		Use      string `json:"use"`
+		Modulus  string `json:"n"`
+		Exponent string `json:"e"`
+		Curve    string `json:"crv"`
+		X        string `json:"x"`
+		Y        string `json:"y"`
+	}
+)
+
+// identifyAssertions records the identities of the request's assertions that can be verified.
+// Verified assertions are cached by identity so the response is reused by later assertions for the
+// same identity, unverified assertions are cached as sent and so are never reused.
+func (rt *runtime) identifyAssertions(tr *tokenRequest) {
+	if tr.clientAssertion == "" && tr.assertion == "" {
+		return
+	}
+
+	keys := rt.verificationKeys()
+	now := time.Now().UTC()
+
+	tr.clientAssertionID, _ = verifiedIdentity(tr.clientAssertion, keys, now)
+	tr.assertionID, _ = verifiedIdentity(tr.assertion, keys, now)
+}
+
+// verificationKeys returns the keys assertions can be verified with, the public keys of the
+// injected private_key_jwt clients and the keys of the provider JWKS documents held in the cache.
+func (rt *runtime) verificationKeys() []verificationKey {
+	var keys []verificationKey
+
+	for _, client := range rt.config().clients {
+		if client.signer != nil {
+			keys = append(keys, verificationKey{keyID: client.keyID, key: client.signer.Public()})
+		}
+	}
+
+	now := time.Now().UTC()
+	rt.cache.Range(func(k CacheKey, e CacheEntry) bool {
+		if k.tr.kind == documentKind && e.StatusCode == http.StatusOK && e.Expiry.After(now) &&
+			!strings.HasSuffix(k.tr.path, discoveryPath) {
+			keys = append(keys, parseJWKS(e.Body)...)
+		}
+		return true
+	})
+
+	return keys
+}
+
+// verifiedIdentity returns the identity of a JWT assertion that is unexpired and signed by one of the keys.
+func verifiedIdentity(jwt string, keys []verificationKey, now time.Time) (string, bool) {
+	claims, ok := parseAssertionClaims(jwt)
+	if !ok || claims.Expiry == 0 || !time.Unix(claims.Expiry, 0).After(now) {
+		return "", false
+	}
+
+	if !verifyJWTSignature(jwt, keys) {
+		return "", false
+	}
+
+	return assertionIdentity(jwt)
+}
+
+// verifyJWTSignature reports if a RS256 or ES256 signed JWT verifies with one of the keys.
+// When the JWT names its key only keys with that ID are tried.
+func verifyJWTSignature(jwt string, keys []verificationKey) bool {
+	parts := strings.Split(jwt, ".")
+	if len(parts) != 3 {
+		return false
+	}
+
+	var header jwtHeader
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return false
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[2], "="))
+	if err != nil {
+		return false
+	}
+
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+
+	for _, vk := range keys {
+		if header.KeyID != "" && vk.keyID != "" && header.KeyID != vk.keyID {
+			continue
+		}
+
+		switch key := vk.key.(type) {
+		case *rsa.PublicKey:
+			if header.Algorithm == "RS256" && rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], sig) == nil {
+				return true
+			}
+		case *ecdsa.PublicKey:
+			if header.Algorithm == "ES256" && key.Curve == elliptic.P256() && len(sig) == 64 &&
+				ecdsa.Verify(key, digest[:], new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// parseJWKS returns the RSA and P-256 EC signing keys of a JSON web key set, ignoring keys it cannot use.
+func parseJWKS(body []byte) []verificationKey {
+	var set jsonWebKeySet
+	if err := json.Unmarshal(body, &set); err != nil {
+		return nil
+	}
+
+	var keys []verificationKey
+	for _, jwk := range set.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+
+		if key := jwk.publicKey(); key != nil {
+			keys = append(keys, verificationKey{keyID: jwk.KeyID, key: key})
+		}
+	}
+
+	return keys
+}
+
+// publicKey returns the key described by the JSON web key, nil if it is not a RSA or P-256 EC key.
+func (jwk jsonWebKey) publicKey() crypto.PublicKey {
+	enc := base64.RawURLEncoding
+
+	switch jwk.KeyType {
+	case "RSA":
+		n, err := enc.DecodeString(jwk.Modulus)
+		if err != nil {
+			return nil
+		}
+		e, err := enc.DecodeString(jwk.Exponent)
+		if err != nil || len(e) == 0 || len(e) > 4 {
+			return nil
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+
+	case "EC":
+		if jwk.Curve != "P-256" {
+			return nil
+		}
+		x, err := enc.DecodeString(jwk.X)
+		if err != nil {
+			return nil
+		}
+		y, err := enc.DecodeString(jwk.Y)
+		if err != nil {
+			return nil
+		}
+		key := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !key.Curve.IsOnCurve(key.X, key.Y) {
+			return nil
+		}
+		return key
+	}
+
+	return nil
+}
+
+// decodeSegment decodes a base64url encoded JSON segment of a JWT.
+func decodeSegment(segment string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(segment, "="))
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(data, v)
+}
+
+// assertionIdentity returns a stable identity for a JWT assertion built from its iss, sub and aud claims.
+// The signature is not verified, only verified assertions are cached by identity.
+func assertionIdentity(jwt string) (string, bool) {
+	claims, ok := parseAssertionClaims(jwt)
+	if !ok || claims.Issuer == "" {
+		return "", false
+	}
+
+	audience := audienceList(claims.Audience)
+
+	return "jwt iss=" + claims.Issuer + " sub=" + claims.Subject + " aud=" + strings.Join(audience, ","), true
+}
+
+// jwtExpiry returns the exp claim of a JWT, if it has one.
+func jwtExpiry(jwt string) (time.Time, bool) {
+	claims, ok := parseAssertionClaims(jwt)
+	if !ok || claims.Expiry == 0 {
+		return time.Time{}, false
+	}
+
+	return time.Unix(claims.Expiry, 0).UTC(), true
+}
+
+// parseAssertionClaims decodes the unverified claims of a JWT.
+func parseAssertionClaims(jwt string) (assertionClaims, bool) {
+	var claims assertionClaims
+
+	parts := strings.Split(jwt, ".")
+	if len(parts) != 3 {
+		return claims, false
+	}
+
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return claims, false
+	}
+
+	return claims, true
+}
+
+// audienceList decodes an aud claim, which may be a single string or an array, into a sorted list.
+func audienceList(raw json.RawMessage) []string {
+	var single string
+	if err := json.Unmarshal(raw, &single); err == nil {
+		return []string{single}
+	}
+
+	var list []string
+	if err := json.Unmarshal(raw, &list); err != nil {
+		return nil
+	}
+
+	sort.Strings(list)
+	return list
+}
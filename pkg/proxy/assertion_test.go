@@ -0,0 +1,220 @@
+/*
+Copyright © 2018-2021 Neil Hemming
+*/
+
+package proxy
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestJWT(claims string) string {
+	enc := base64.RawURLEncoding
+	return enc.EncodeToString([]byte("{\"alg\":\"RS256\"}")) + "." + enc.EncodeToString([]byte(claims)) + ".sig"
+}
+
+func TestAssertionIdentityIgnoresSingleUseClaims(t *testing.T) {
+	a1 := newTestJWT("{\"iss\":\"c1\",\"sub\":\"c1\",\"aud\":[\"b\",\"a\"],\"jti\":\"1\",\"exp\":100}")
+	a2 := newTestJWT("{\"iss\":\"c1\",\"sub\":\"c1\",\"aud\":[\"a\",\"b\"],\"jti\":\"2\",\"exp\":200}")
+
+	id1, ok1 := assertionIdentity(a1)
+	id2, ok2 := assertionIdentity(a2)
+
+	if !ok1 || !ok2 || id1 != id2 {
+		t.Error("Identities differ", id1, id2)
+	}
+
+	if id, ok := assertionIdentity("not.a.jwt"); ok {
+		t.Error("Invalid jwt has identity", id)
+	}
+}
+
+func TestCacheKeyKeepsUnparsableAssertion(t *testing.T) {
+	tr := tokenRequest{assertion: "opaque"}
+
+	if key := tr.cacheKey(); key.assertion != "opaque" {
+		t.Error("Unparsable assertion replaced", key.assertion)
+	}
+}
+
+func newTestSigningKey(t *testing.T) (*ecdsa.PrivateKey, string) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return key, string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}))
+}
+
+func signTestAssertion(t *testing.T, key *ecdsa.PrivateKey, iss string, now time.Time) string {
+	t.Helper()
+
+	signer := &injectedClient{clientID: iss, signer: key, alg: "ES256"}
+	jwt, err := signer.signAssertion("https://p.com/token", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return jwt
+}
+
+func TestHandlerFuncClientAssertionReused(t *testing.T) {
+	key, pemKey := newTestSigningKey(t)
+
+	settings := DefaultSettings().WithEndpoint("https://p.com")
+	settings.Clients = map[string]ClientCredentials{
+		"app": {ClientID: "c1", AuthMethod: AuthMethodPrivateKeyJWT, PrivateKey: pemKey},
+	}
+	rt := newRuntime(context.Background(), settings)
+	defer rt.close()
+
+	now := time.Now()
+	assertions := []string{
+		signTestAssertion(t, key, "c1", now),
+		signTestAssertion(t, key, "c1", now),
+	}
+
+	calls := 0
+	rt.requester = func(ctx context.Context, req *http.Request) (*http.Response, error) {
+		calls++
+		if err := req.ParseForm(); err != nil || req.PostFormValue("client_assertion") == "" ||
+			req.PostFormValue("client_assertion_type") != clientAssertionTypeJWT {
+			t.Error("Client assertion not forwarded", err)
+		}
+
+		w := httptest.NewRecorder()
+		w.WriteHeader(http.StatusOK)
+		_, err := w.WriteString("{\"access_token\":\"a1\"}")
+		return w.Result(), err
+	}
+
+	post := func(assertion string) {
+		v := url.Values{
+			"grant_type":            {grantTypePassword},
+			"username":              {"u1"},
+			"password":              {"p1"},
+			"client_assertion_type": {clientAssertionTypeJWT},
+			"client_assertion":      {assertion},
+		}
+		req, _ := http.NewRequest("POST", "http:/token", strings.NewReader(v.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+		w := httptest.NewRecorder()
+		rt.handleRequest(w, req)
+
+		if w.Code != http.StatusOK {
+			t.Error("Unexpected status", w.Code)
+		}
+	}
+
+	for _, assertion := range assertions {
+		post(assertion)
+	}
+
+	if calls != 1 {
+		t.Error("Assertion response not reused, calls", calls)
+	}
+
+	// Unsigned and expired assertions for the same identity are not answered from the cache
+	forged := newTestJWT(fmt.Sprintf("{\"iss\":\"c1\",\"sub\":\"c1\",\"aud\":\"https://p.com/token\",\"exp\":%d}", now.Add(time.Minute).Unix()))
+	post(forged)
+
+	other, _ := newTestSigningKey(t)
+	post(signTestAssertion(t, other, "c1", now))
+
+	post(signTestAssertion(t, key, "c1", now.Add(-time.Hour)))
+
+	if calls != 4 {
+		t.Error("Unverified assertion answered from cache, calls", calls)
+	}
+}
+
+func TestIdentifyAssertionsWithProviderJWKS(t *testing.T) {
+	settings := DefaultSettings().WithEndpoint("https://p.com")
+	rt := newRuntime(context.Background(), settings)
+	defer rt.close()
+
+	key, _ := newTestSigningKey(t)
+	enc := base64.RawURLEncoding
+	jwks := fmt.Sprintf("{\"keys\":[{\"kty\":\"EC\",\"crv\":\"P-256\",\"use\":\"sig\",\"x\":%q,\"y\":%q}]}",
+		enc.EncodeToString(padInt(key.X, 32)), enc.EncodeToString(padInt(key.Y, 32)))
+
+	tr := tokenRequest{grantType: grantTypeJWTBearer, assertion: signTestAssertion(t, key, "idp", time.Now())}
+
+	rt.identifyAssertions(&tr)
+	if tr.assertionID != "" {
+		t.Error("Assertion verified without keys", tr.assertionID)
+	}
+
+	rt.update(tokenRequest{kind: documentKind, path: jwksPath}, http.Header{}, []byte(jwks), http.StatusOK)
+
+	rt.identifyAssertions(&tr)
+	if tr.assertionID != "jwt iss=idp sub=idp aud=https://p.com/token" || tr.cacheKey().assertion != tr.assertionID {
+		t.Error("Assertion not verified with the provider JWKS", tr.assertionID)
+	}
+}
+
+func TestPrepareRequestJWTBearerGrant(t *testing.T) {
+	tr := tokenRequest{grantType: grantTypeJWTBearer, assertion: "a.b.c", authMode: authInHeader}
+
+	req, err := tr.prepareRequest("down")
+	if err != nil {
+		t.Fatal("prepareRequest", err)
+	}
+
+	if err := req.ParseForm(); err != nil {
+		t.Fatal("ParseForm", err)
+	}
+
+	if req.PostFormValue("grant_type") != grantTypeJWTBearer || req.PostFormValue("assertion") != "a.b.c" {
+		t.Error("Unexpected form", req.PostForm)
+	}
+}
+
+func TestVerifyJWTSignatureRS256(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signer := &injectedClient{clientID: "c1", signer: key, alg: "RS256", keyID: "k1"}
+	jwt, err := signer.signAssertion("https://p.com/token", time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	enc := base64.RawURLEncoding
+	jwks := fmt.Sprintf("{\"keys\":[{\"kty\":\"RSA\",\"kid\":\"k1\",\"n\":%q,\"e\":%q}]}",
+		enc.EncodeToString(key.N.Bytes()), enc.EncodeToString(big.NewInt(int64(key.E)).Bytes()))
+
+	keys := parseJWKS([]byte(jwks))
+	if len(keys) != 1 || !verifyJWTSignature(jwt, keys) {
+		t.Error("RS256 signature not verified", len(keys))
+	}
+
+	keys[0].keyID = "k2"
+	if verifyJWTSignature(jwt, keys) {
+		t.Error("Key with another kid used")
+	}
+}
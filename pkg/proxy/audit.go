@@ -0,0 +1,195 @@
+/*
+Copyright © 2018-2021 Neil Hemming
+*/
+
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// AuditSyslog is the audit log output writing to the local syslog daemon.
+	// Remote daemons are addressed as syslog+udp://host:port or syslog+tcp://host:port.
+	AuditSyslog = "syslog"
+
+	// auditSyslogTag is the syslog tag of audit records.
+	auditSyslogTag = "oauthproxy"
+)
+
+type (
+	// AuditLogSettings configures the audit trail of downstream token acquisitions.
+	// The audit log is kept separate from the operational log.
+	AuditLogSettings struct {
+		// Output is the path of the append only audit file, or a syslog destination, blank disables the audit log
+		Output string
+	}
+
+	// auditRecord is a single audit log entry.
+	auditRecord struct {
+		Time      string `json:"time"`
+		Identity  string `json:"identity,omitempty"`
+		ClientID  string `json:"client_id,omitempty"`
+		GrantType string `json:"grant_type"`
+		Scopes    string `json:"scopes,omitempty"`
+		Provider  string `json:"provider"`
+		Status    int    `json:"status"`
+		Error     string `json:"error,omitempty"`
+		TokenID   string `json:"jti,omitempty"`
+		Expiry    string `json:"expiry,omitempty"`
+	}
+
+	// auditLogger writes the audit log.
+	auditLogger struct {
+		mu  sync.Mutex
+		out io.WriteCloser
+	}
+)
+
+func (als AuditLogSettings) validateSettings() error {
+	if strings.HasPrefix(als.Output, AuditSyslog+"+") {
+		_, _, err := syslogAddress(als.Output)
+		return err
+	}
+
+	return nil
+}
+
+// newAuditLogger opens the audit log, nil if the audit log is disabled.
+func (als AuditLogSettings) newAuditLogger() (*auditLogger, error) {
+	var out io.WriteCloser
+	var err error
+
+	switch {
+	case als.Output == "":
+		return nil, nil
+	case als.Output == AuditSyslog:
+		out, err = openSyslog("", "")
+	case strings.HasPrefix(als.Output, AuditSyslog+"+"):
+		network, addr, aerr := syslogAddress(als.Output)
+		if aerr != nil {
+			return nil, aerr
+		}
+		out, err = openSyslog(network, addr)
+	default:
+		out, err = os.OpenFile(als.Output, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("open audit log: %w", err)
+	}
+
+	return &auditLogger{out: out}, nil
+}
+
+// syslogAddress splits a syslog+network://host:port destination.
+func syslogAddress(output string) (string, string, error) {
+	u, err := url.Parse(output)
+	if err != nil {
+		return "", "", fmt.Errorf("audit log output %s: %w", output, err)
+	}
+
+	network := strings.TrimPrefix(u.Scheme, AuditSyslog+"+")
+	if (network != "udp" && network != "tcp") || u.Host == "" {
+		return "", "", fmt.Errorf("audit log output %s must be syslog+udp://host:port or syslog+tcp://host:port", output)
+	}
+
+	return network, u.Host, nil
+}
+
+// close closes the audit log.
+func (al *auditLogger) close() error {
+	if al == nil {
+		return nil
+	}
+
+	al.mu.Lock()
+	defer al.mu.Unlock()
+
+	return al.out.Close()
+}
+
+// write appends the record to the audit log.
+func (al *auditLogger) write(rec auditRecord) error {
+	b, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+
+	al.mu.Lock()
+	defer al.mu.Unlock()
+
+	_, err = al.out.Write(append(b, '\n'))
+	return err
+}
+
+// audit records a downstream token acquisition.  The body of a successful response
+// provides the token's jti, when the access token is a JWT, and its expiry.
+func (rt *runtime) audit(tr tokenRequest, provider *url.URL, status int, body []byte, failure error) {
+	if rt.auditLog == nil || tr.kind != tokenKind {
+		return
+	}
+
+	now := time.Now().UTC()
+
+	rec := auditRecord{
+		Time:      now.Format(time.RFC3339Nano),
+		ClientID:  tr.clientID,
+		GrantType: tr.grantType,
+		Scopes:    tr.scopes,
+		Provider:  provider.Scheme + "://" + provider.Host + provider.Path,
+		Status:    status,
+	}
+
+	if rec.GrantType == "" {
+		rec.GrantType = grantTypePassword
+	}
+
+	if identity := auditIdentity(tr); identity != "" {
+		rec.Identity = hashUsername(identity)
+	}
+
+	if failure != nil {
+		rec.Error = failure.Error()
+	}
+
+	if info, ok := parseTokenResponse(body, now); ok {
+		if info.scope != "" {
+			rec.Scopes = info.scope
+		}
+		if claims, ok := parseAssertionClaims(info.accessToken); ok {
+			rec.TokenID = claims.ID
+		}
+		if !info.expiry.IsZero() {
+			rec.Expiry = info.expiry.Format(time.RFC3339)
+		}
+	}
+
+	if err := rt.auditLog.write(rec); err != nil {
+		rt.log(LevelError, "audit log write failed", Fields{"error": err.Error()})
+	}
+}
+
+// auditIdentity returns the identity a token is requested for, blank if the token is for the client itself.
+func auditIdentity(tr tokenRequest) string {
+	if tr.username != "" {
+		return tr.username
+	}
+
+	if identity, ok := assertionIdentity(tr.assertion); ok {
+		return identity
+	}
+
+	if identity, ok := assertionIdentity(tr.exchange.subjectToken); ok {
+		return identity
+	}
+
+	return ""
+}
@@ -0,0 +1,18 @@
+//go:build windows || plan9
+// +build windows plan9
+
+/*
+Copyright © 2018-2021 Neil Hemming
+*/
+
+package proxy
+
+import (
+	"errors"
+	"io"
+)
+
+// openSyslog is not supported on this platform.
+func openSyslog(network, addr string) (io.WriteCloser, error) {
+	return nil, errors.New("syslog is not supported on this platform")
+}
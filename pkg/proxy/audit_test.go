@@ -0,0 +1,107 @@
+/*
+Copyright © 2018-2021 Neil Hemming
+*/
+
+package proxy
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestAuditLogValidateSettings(t *testing.T) {
+	for _, output := range []string{"syslog+http://host:514", "syslog+udp://"} {
+		if err := (AuditLogSettings{Output: output}).validateSettings(); err == nil {
+			t.Error("Bad syslog address not caught", output)
+		}
+	}
+
+	for _, output := range []string{"", "syslog", "syslog+tcp://host:514", "/var/log/audit.log"} {
+		if err := (AuditLogSettings{Output: output}).validateSettings(); err != nil {
+			t.Error("Unexpected", output, err)
+		}
+	}
+}
+
+func TestAuditRecordsTokenAcquisition(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+
+	al, err := AuditLogSettings{Output: path}.newAuditLogger()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rt := newRuntime(context.Background(), DefaultSettings().WithEndpoint("http://test"))
+	defer rt.close()
+	rt.auditLog = al
+
+	claims := base64.RawURLEncoding.EncodeToString([]byte(`{"jti":"id-1","sub":"u1"}`))
+	body := `{"access_token":"h.` + claims + `.s","expires_in":3600,"scope":"read"}`
+
+	rt.requester = func(ctx context.Context, req *http.Request) (*http.Response, error) {
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Header:     http.Header{},
+			Body:       ioutil.NopCloser(strings.NewReader(body)),
+		}, nil
+	}
+
+	tr := tokenRequest{kind: tokenKind, path: "/token", clientID: "c1", clientSecret: "s1", username: "u1", password: "p1"}
+	rt.getDownstreamToken(tr, "", spanContext{})
+
+	// Only token acquisitions are audited
+	rt.getDownstreamToken(tokenRequest{kind: documentKind, path: "/keys"}, "", spanContext{})
+
+	al.close()
+
+	b, _ := ioutil.ReadFile(path)
+	lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+	if len(lines) != 1 {
+		t.Fatal("Expected 1 record got", len(lines), string(b))
+	}
+
+	if strings.Contains(lines[0], "u1") || strings.Contains(lines[0], "s1") || strings.Contains(lines[0], "p1") {
+		t.Error("Identity or secrets not protected", lines[0])
+	}
+
+	var rec auditRecord
+	if err := json.Unmarshal([]byte(lines[0]), &rec); err != nil {
+		t.Fatal(err)
+	}
+
+	if rec.Identity != hashUsername("u1") || rec.ClientID != "c1" || rec.GrantType != grantTypePassword ||
+		rec.Scopes != "read" || rec.Provider != "http://test/token" || rec.Status != http.StatusOK ||
+		rec.TokenID != "id-1" || rec.Expiry == "" {
+		t.Error("Unexpected record", lines[0])
+	}
+}
+
+func TestAuditIdentity(t *testing.T) {
+	claims := base64.RawURLEncoding.EncodeToString([]byte(`{"iss":"i","sub":"s","aud":"a"}`))
+	jwt := "h." + claims + ".sig"
+
+	if id := auditIdentity(tokenRequest{assertion: jwt}); id != "jwt iss=i sub=s aud=a" {
+		t.Error("Unexpected assertion identity", id)
+	}
+
+	if id := auditIdentity(tokenRequest{exchange: tokenExchange{subjectToken: jwt}}); id == "" {
+		t.Error("Expected subject token identity")
+	}
+
+	if id := auditIdentity(tokenRequest{clientID: "c1"}); id != "" {
+		t.Error("Unexpected client identity", id)
+	}
+}
+
+func TestSyslogAddress(t *testing.T) {
+	network, addr, err := syslogAddress("syslog+udp://localhost:514")
+	if err != nil || network != "udp" || addr != "localhost:514" {
+		t.Error("Unexpected", network, addr, err)
+	}
+}
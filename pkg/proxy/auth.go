@@ -0,0 +1,360 @@
+/*
+Copyright © 2018-2021 Neil Hemming
+*/
+
+package proxy
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	multierror "github.com/hashicorp/go-multierror"
+)
+
+const (
+	// AuthAPIKey authenticates callers presenting a static API key in the X-API-Key header.
+	AuthAPIKey = "apikey"
+
+	// AuthMTLS authenticates callers presenting a verified client certificate whose subject is allowed.
+	AuthMTLS = "mtls"
+
+	// AuthHMAC authenticates callers signing the request with the shared HMAC secret.
+	AuthHMAC = "hmac"
+
+	// AuthNone explicitly allows unauthenticated callers.
+	AuthNone = "none"
+
+	// RouteDefault is the route whose methods apply to routes without their own entry.
+	RouteDefault = "*"
+
+	// Route names used to configure caller authentication.
+	RouteToken      = "token"
+	RouteDocument   = "document"
+	RouteIntrospect = "introspect"
+	RouteRevoke     = "revoke"
+	RouteUserinfo   = "userinfo"
+	RouteDevice     = "device"
+	RouteIdentities = "identities"
+
+	// apiKeyHeader is the header carrying the caller's API key.
+	apiKeyHeader = "X-API-Key"
+
+	// signatureHeader is the header carrying the caller's HMAC signature, t=<unix time>,sig=<hex>.
+	signatureHeader = "X-OAP-Signature"
+)
+
+type (
+	// CallerAuthSettings configures optional authentication of callers to the proxy.
+	CallerAuthSettings struct {
+		// APIKeys are the static API keys accepted by the apikey method
+		APIKeys []string
+
+		// MTLSSubjects are the client certificate subject common names or DNS names accepted by the mtls method
+		MTLSSubjects []string
+
+		// HMACSecret is the shared secret of the hmac method
+		HMACSecret string
+
+		// HMACMaxSkew is the largest difference permitted between the signature time and now
+		HMACMaxSkew time.Duration
+
+		// Routes maps a route name, or RouteDefault, to the methods any one of which authenticates the caller.
+		// Routes without an entry, when no default is configured, are open.
+		Routes map[string][]string
+	}
+
+	// ListenerTLSSettings configures HTTPS for the proxy's listener.
+	ListenerTLSSettings struct {
+		// CertFile is the PEM server certificate, when set the listener uses HTTPS
+		CertFile string
+
+		// KeyFile is the PEM private key of the server certificate
+		KeyFile string
+
+		// ClientCAFile is the PEM bundle of CAs used to verify caller certificates
+		ClientCAFile string
+	}
+)
+
+// routeNames are the valid route names.
+var routeNames = []string{
+	RouteDefault, RouteToken, RouteDocument, RouteIntrospect,
+	RouteRevoke, RouteUserinfo, RouteDevice, RouteIdentities,
+}
+
+func (cas CallerAuthSettings) validateSettings(listener ListenerTLSSettings) error {
+	var result error
+
+	for route, methods := range cas.Routes {
+		if !containsString(routeNames, route) {
+			result = multierror.Append(result, fmt.Errorf("unknown auth route %s", route))
+		}
+
+		for _, method := range methods {
+			switch method {
+			case AuthNone:
+			case AuthAPIKey:
+				if len(cas.APIKeys) == 0 {
+					result = multierror.Append(result, fmt.Errorf("route %s uses apikey auth but no API keys are configured", route))
+				}
+			case AuthHMAC:
+				if cas.HMACSecret == "" {
+					result = multierror.Append(result, fmt.Errorf("route %s uses hmac auth but no HMAC secret is configured", route))
+				}
+			case AuthMTLS:
+				if listener.ClientCAFile == "" {
+					result = multierror.Append(result, fmt.Errorf("route %s uses mtls auth but no client CA is configured", route))
+				}
+				if len(cas.MTLSSubjects) == 0 {
+					result = multierror.Append(result, fmt.Errorf("route %s uses mtls auth but no certificate subjects are configured", route))
+				}
+			default:
+				result = multierror.Append(result, fmt.Errorf("route %s has unknown auth method %s", route, method))
+			}
+		}
+	}
+
+	if listener.CertFile != "" && listener.KeyFile == "" {
+		result = multierror.Append(result, errors.New("listener certificate requires a key file"))
+	}
+
+	if listener.ClientCAFile != "" && listener.CertFile == "" {
+		result = multierror.Append(result, errors.New("client CA requires the listener to use HTTPS"))
+	}
+
+	return result
+}
+
+// tlsConfig returns the listener's tls config, nil if the listener is not using HTTPS.
+func (lts ListenerTLSSettings) tlsConfig() (*tls.Config, error) {
+	if lts.CertFile == "" {
+		return nil, nil
+	}
+
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	if lts.ClientCAFile != "" {
+		pem, err := ioutil.ReadFile(lts.ClientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("read client CA file: %w", err)
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in client CA file %s", lts.ClientCAFile)
+		}
+
+		cfg.ClientCAs = pool
+		cfg.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+
+	return cfg, nil
+}
+
+// routeName classifies the request into the route name used to select caller authentication.
+func routeName(r *http.Request) string {
+	path := r.URL.Path
+
+	if r.Method == "GET" {
+		switch {
+		case isDocumentPath(path):
+			return RouteDocument
+		case isUserinfoPath(path):
+			return RouteUserinfo
+		}
+
+		if _, ok := identityName(path); ok {
+			return RouteIdentities
+		}
+	}
+
+	switch kind, _ := postKind(path); kind {
+	case introspectKind:
+		return RouteIntrospect
+	case revokeKind:
+		return RouteRevoke
+	case deviceCodeKind:
+		return RouteDevice
+	}
+
+	return RouteToken
+}
+
+// authorizeCaller checks the caller is authenticated for the route, replying Unauthorized if not.
+func (rt *runtime) authorizeCaller(w http.ResponseWriter, r *http.Request) bool {
+	route := routeName(r)
+
+	routes := rt.config().callerAuth.Routes
+
+	methods, ok := routes[route]
+	if !ok {
+		methods, ok = routes[RouteDefault]
+	}
+
+	if !ok || len(methods) == 0 {
+		return true
+	}
+
+	for _, method := range methods {
+		if rt.callerAuthenticated(method, r) {
+			return true
+		}
+	}
+
+	rt.logError("caller not authenticated for %s route %s", route, r.URL.Path)
+	replyUnauthorized(w)
+	return false
+}
+
+// routeAuthenticated reports if callers of the route must authenticate with a method other than none.
+func (rt *runtime) routeAuthenticated(route string) bool {
+	routes := rt.config().callerAuth.Routes
+
+	methods, ok := routes[route]
+	if !ok {
+		methods = routes[RouteDefault]
+	}
+
+	for _, method := range methods {
+		if method == AuthNone {
+			return false
+		}
+	}
+
+	return len(methods) > 0
+}
+
+// callerAuthenticated reports if the request passes the authentication method.
+func (rt *runtime) callerAuthenticated(method string, r *http.Request) bool {
+	cas := rt.config().callerAuth
+
+	switch method {
+	case AuthNone:
+		return true
+	case AuthAPIKey:
+		return matchAPIKey(cas.APIKeys, r.Header.Get(apiKeyHeader))
+	case AuthMTLS:
+		return matchCertSubject(cas.MTLSSubjects, r)
+	case AuthHMAC:
+		return verifySignature(cas.HMACSecret, cas.HMACMaxSkew, r, time.Now())
+	}
+
+	return false
+}
+
+// matchAPIKey compares the key against the allowed keys in constant time.
+func matchAPIKey(keys []string, key string) bool {
+	if key == "" {
+		return false
+	}
+
+	matched := 0
+	for _, k := range keys {
+		matched |= subtle.ConstantTimeCompare([]byte(k), []byte(key))
+	}
+
+	return matched == 1
+}
+
+// matchCertSubject checks the verified client certificate's common name or DNS names are allowed.
+func matchCertSubject(subjects []string, r *http.Request) bool {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return false
+	}
+
+	cert := r.TLS.VerifiedChains[0][0]
+
+	if containsString(subjects, cert.Subject.CommonName) {
+		return true
+	}
+
+	for _, name := range cert.DNSNames {
+		if containsString(subjects, name) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// SignRequest computes the X-OAP-Signature header value for a request body signed at time t.
+func SignRequest(secret string, t time.Time, method, path string, body []byte) string {
+	ts := strconv.FormatInt(t.Unix(), 10)
+	return "t=" + ts + ",sig=" + hex.EncodeToString(signature(secret, ts, method, path, body))
+}
+
+// signature is the HMAC-SHA256 of the time, method, path and body.
+func signature(secret, ts, method, path string, body []byte) []byte {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(ts + "\n" + method + "\n" + path + "\n"))
+	mac.Write(body)
+	return mac.Sum(nil)
+}
+
+// verifySignature checks the request's HMAC signature header.
+// The body is read to verify the signature and then restored for later parsing.
+func verifySignature(secret string, maxSkew time.Duration, r *http.Request, now time.Time) bool {
+	var ts, sig string
+
+	for _, part := range strings.Split(r.Header.Get(signatureHeader), ",") {
+		kv := strings.SplitN(strings.TrimSpace(part), "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		switch kv[0] {
+		case "t":
+			ts = kv[1]
+		case "sig":
+			sig = kv[1]
+		}
+	}
+
+	unix, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil || sig == "" {
+		return false
+	}
+
+	if skew := now.Sub(time.Unix(unix, 0)); skew > maxSkew || skew < -maxSkew {
+		return false
+	}
+
+	expected, err := hex.DecodeString(sig)
+	if err != nil {
+		return false
+	}
+
+	var body []byte
+	if r.Body != nil {
+		if body, err = ioutil.ReadAll(io.LimitReader(r.Body, 1<<20)); err != nil {
+			return false
+		}
+		r.Body.Close()
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+
+	return hmac.Equal(expected, signature(secret, ts, r.Method, r.URL.Path, body))
+}
+
+// containsString reports if s is in list.
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,148 @@
+/*
+Copyright © 2018-2021 Neil Hemming
+*/
+
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRouteName(t *testing.T) {
+	tests := []struct {
+		method, path, route string
+	}{
+		{"POST", "/oauth2/token", RouteToken},
+		{"GET", "/.well-known/openid-configuration", RouteDocument},
+		{"GET", "/userinfo", RouteUserinfo},
+		{"GET", "/identities/admin/token", RouteIdentities},
+		{"POST", "/introspect", RouteIntrospect},
+		{"POST", "/revoke", RouteRevoke},
+		{"POST", "/device/code", RouteDevice},
+	}
+
+	for _, test := range tests {
+		req, _ := http.NewRequest(test.method, "http:"+test.path, nil)
+		if route := routeName(req); route != test.route {
+			t.Errorf("%s %s expected %s got %s", test.method, test.path, test.route, route)
+		}
+	}
+}
+
+func TestValidateCallerAuthSettings(t *testing.T) {
+	cas := CallerAuthSettings{
+		Routes: map[string][]string{
+			"bad":      {AuthNone},
+			RouteToken: {AuthAPIKey, AuthHMAC, AuthMTLS, "other"},
+		},
+	}
+
+	if err := cas.validateSettings(ListenerTLSSettings{}); err == nil {
+		t.Error("Bad caller auth not caught")
+	}
+}
+
+func TestValidateCallerAuthMTLSRequiresSubjects(t *testing.T) {
+	cas := CallerAuthSettings{Routes: map[string][]string{RouteToken: {AuthMTLS}}}
+	listener := ListenerTLSSettings{CertFile: "c.pem", KeyFile: "k.pem", ClientCAFile: "ca.pem"}
+
+	err := cas.validateSettings(listener)
+	if err == nil || !strings.Contains(err.Error(), "no certificate subjects") {
+		t.Error("Missing mtls subjects not caught", err)
+	}
+
+	cas.MTLSSubjects = []string{"caller"}
+	if err := cas.validateSettings(listener); err != nil {
+		t.Error("Valid mtls settings rejected", err)
+	}
+}
+
+func TestHandlerFuncRequiresAPIKey(t *testing.T) {
+	settings := DefaultSettings().WithEndpoint("test")
+	settings.CallerAuth.APIKeys = []string{"k1", "k2"}
+	settings.CallerAuth.Routes = map[string][]string{
+		RouteDefault:  {AuthAPIKey},
+		RouteDocument: {AuthNone},
+	}
+	rt := newRuntime(context.Background(), settings)
+	defer rt.close()
+
+	req, _ := http.NewRequest("GET", "http:/identities/admin/token", nil)
+	w := httptest.NewRecorder()
+	rt.handleRequest(w, req)
+
+	if w.Code != http.StatusUnauthorized {
+		t.Error("Missing API key not rejected", w.Code)
+	}
+
+	req.Header.Set(apiKeyHeader, "k2")
+	w = httptest.NewRecorder()
+	rt.handleRequest(w, req)
+
+	// Authenticated, then not found as there are no identities
+	if w.Code != http.StatusNotFound {
+		t.Error("API key not accepted", w.Code)
+	}
+
+	if !rt.authorizeCaller(httptest.NewRecorder(), httptest.NewRequest("GET", "/keys", nil)) {
+		t.Error("Open route rejected")
+	}
+}
+
+func TestVerifySignature(t *testing.T) {
+	now := time.Now()
+	body := "grant_type=password&username=u1"
+
+	req := httptest.NewRequest("POST", "/token", strings.NewReader(body))
+	req.Header.Set(signatureHeader, SignRequest("secret", now, "POST", "/token", []byte(body)))
+
+	if !verifySignature("secret", time.Minute, req, now) {
+		t.Error("Valid signature rejected")
+	}
+
+	if b, _ := ioutil.ReadAll(req.Body); string(b) != body {
+		t.Error("Body not restored", string(b))
+	}
+
+	req = httptest.NewRequest("POST", "/token", strings.NewReader(body+"&x=1"))
+	req.Header.Set(signatureHeader, SignRequest("secret", now, "POST", "/token", []byte(body)))
+
+	if verifySignature("secret", time.Minute, req, now) {
+		t.Error("Tampered body accepted")
+	}
+
+	req = httptest.NewRequest("POST", "/token", strings.NewReader(body))
+	req.Header.Set(signatureHeader, SignRequest("secret", now.Add(-time.Hour), "POST", "/token", []byte(body)))
+
+	if verifySignature("secret", time.Minute, req, now) {
+		t.Error("Stale signature accepted")
+	}
+}
+
+func TestMatchCertSubject(t *testing.T) {
+	req := httptest.NewRequest("POST", "/token", nil)
+
+	if matchCertSubject([]string{"svc"}, req) {
+		t.Error("Plain HTTP accepted")
+	}
+
+	cert := &x509.Certificate{Subject: pkix.Name{CommonName: "svc"}, DNSNames: []string{"svc.local"}}
+	req.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}}
+
+	if !matchCertSubject([]string{"svc"}, req) || !matchCertSubject([]string{"svc.local"}, req) {
+		t.Error("Allowed subject rejected")
+	}
+
+	if matchCertSubject([]string{"other"}, req) {
+		t.Error("Unknown subject accepted")
+	}
+}
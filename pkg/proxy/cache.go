@@ -0,0 +1,164 @@
+/*
+Copyright © 2018-2021 Neil Hemming
+*/
+
+package proxy
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+type (
+	// CacheKey identifies a cached downstream response.  Keys are comparable and may be used as map keys.
+	CacheKey struct {
+		tr tokenRequest
+	}
+
+	// CacheEntry is a cached downstream response.
+	CacheEntry struct {
+		// StatusCode is the downstream response status
+		StatusCode int
+
+		// Header holds the downstream response headers
+		Header http.Header
+
+		// Body is the downstream response body
+		Body []byte
+
+		// Expiry is the time after which the entry is no longer used
+		Expiry time.Time
+
+		// info holds the token details parsed from successful token responses
+		info tokenInfo
+	}
+
+	// Cache stores downstream responses.  Implementations must be safe for concurrent use and
+	// store entries as given, including their unexported fields.
+	Cache interface {
+		// Get returns the entry held for key
+		Get(key CacheKey) (CacheEntry, bool)
+
+		// Set stores the entry for key, replacing any existing entry
+		Set(key CacheKey, entry CacheEntry)
+
+		// Delete removes the entry for key
+		Delete(key CacheKey)
+
+		// Range calls fn for each entry until fn returns false.  fn must not call the cache.
+		Range(fn func(key CacheKey, entry CacheEntry) bool)
+	}
+
+	// memoryCache is the default in process cache.
+	memoryCache struct {
+		lock    sync.RWMutex
+		entries map[CacheKey]CacheEntry
+	}
+)
+
+// NewMemoryCache creates the in process cache used when no cache is provided.
+func NewMemoryCache() Cache {
+	return &memoryCache{entries: make(map[CacheKey]CacheEntry)}
+}
+
+// Path returns the request path of the cached request.
+func (key CacheKey) Path() string {
+	return key.tr.path
+}
+
+// ClientID returns the client id of the cached request.
+func (key CacheKey) ClientID() string {
+	return key.tr.clientID
+}
+
+// Username returns the resource owner of a password grant request.
+func (key CacheKey) Username() string {
+	return key.tr.username
+}
+
+// GrantType returns the grant type of a token request, blank for the password grant.
+func (key CacheKey) GrantType() string {
+	return key.tr.grantType
+}
+
+// Scopes returns the scopes requested.
+func (key CacheKey) Scopes() string {
+	return key.tr.scopes
+}
+
+// Get implements Cache.
+func (mc *memoryCache) Get(key CacheKey) (CacheEntry, bool) {
+	mc.lock.RLock()
+	defer mc.lock.RUnlock()
+
+	e, ok := mc.entries[key]
+	return e, ok
+}
+
+// Set implements Cache.
+func (mc *memoryCache) Set(key CacheKey, entry CacheEntry) {
+	mc.lock.Lock()
+	defer mc.lock.Unlock()
+
+	mc.entries[key] = entry
+}
+
+// Delete implements Cache.
+func (mc *memoryCache) Delete(key CacheKey) {
+	mc.lock.Lock()
+	defer mc.lock.Unlock()
+
+	delete(mc.entries, key)
+}
+
+// Range implements Cache.
+func (mc *memoryCache) Range(fn func(key CacheKey, entry CacheEntry) bool) {
+	mc.lock.RLock()
+	defer mc.lock.RUnlock()
+
+	for k, e := range mc.entries {
+		if !fn(k, e) {
+			return
+		}
+	}
+}
+
+// cacheLen returns the number of entries held by the cache.
+func cacheLen(cache Cache) int {
+	n := 0
+	cache.Range(func(CacheKey, CacheEntry) bool {
+		n++
+		return true
+	})
+
+	return n
+}
+
+// lookup checks the cache for an existing entry for the request.
+func (rt *runtime) lookup(tr tokenRequest) CacheEntry {
+	e, _ := rt.cache.Get(CacheKey{tr: tr.cacheKey()})
+	return e
+}
+
+// clean removes the entries expired by now.
+func (rt *runtime) clean(now time.Time) {
+	rt.logInfo("running housekeeping")
+
+	var expired []CacheKey
+	rt.cache.Range(func(k CacheKey, e CacheEntry) bool {
+		if e.Expiry.Before(now) {
+			expired = append(expired, k)
+		}
+		return true
+	})
+
+	for _, k := range expired {
+		rt.cache.Delete(k)
+		if k.tr.kind == tokenKind {
+			rt.health.forget(credentialKey(k.tr))
+		}
+	}
+
+	rt.forgetRevoked(now)
+}
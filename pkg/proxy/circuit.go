@@ -0,0 +1,107 @@
+/*
+Copyright © 2018-2021 Neil Hemming
+*/
+
+package proxy
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+type (
+	// CircuitBreakerSettings configures the circuit breaker protecting the provider.
+	// After Threshold consecutive provider failures, transport errors or 5xx responses, downstream
+	// requests are answered with Service Unavailable until Cooldown has passed.  A single trial
+	// request is then sent, its success closes the circuit and its failure reopens it.
+	CircuitBreakerSettings struct {
+		// Threshold is the number of consecutive failures opening the circuit, zero disables the breaker
+		Threshold int
+
+		// Cooldown is how long the circuit stays open before a trial request is allowed
+		Cooldown time.Duration
+	}
+
+	// circuitBreaker tracks consecutive provider failures.
+	// The circuit is half open once cooled down, trial is set while the trial request is outstanding.
+	circuitBreaker struct {
+		mu        sync.Mutex
+		threshold int
+		cooldown  time.Duration
+		failures  int
+		openUntil time.Time
+		trial     bool
+	}
+)
+
+func (cbs CircuitBreakerSettings) validateSettings() error {
+	if cbs.Threshold < 0 || cbs.Cooldown < 0 {
+		return errors.New("circuit breaker threshold and cooldown cannot be negative")
+	}
+
+	if cbs.Threshold > 0 && cbs.Cooldown == 0 {
+		return errors.New("circuit breaker cooldown must be set when the breaker is enabled")
+	}
+
+	return nil
+}
+
+// newCircuitBreaker creates the breaker, nil if it is disabled.
+func (cbs CircuitBreakerSettings) newCircuitBreaker() *circuitBreaker {
+	if cbs.Threshold <= 0 {
+		return nil
+	}
+
+	return &circuitBreaker{threshold: cbs.Threshold, cooldown: cbs.Cooldown}
+}
+
+// allow reports if a downstream request may be made.
+// Once the cooldown has passed only one trial request is allowed until its outcome is recorded.
+func (cb *circuitBreaker) allow(now time.Time) bool {
+	if cb == nil {
+		return true
+	}
+
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	if now.Before(cb.openUntil) {
+		return false
+	}
+
+	if cb.failures >= cb.threshold {
+		if cb.trial {
+			return false
+		}
+		cb.trial = true
+	}
+
+	return true
+}
+
+// record records the outcome of a downstream request, returning true if the failure opened the circuit.
+// A failed trial request after the cooldown reopens the circuit, a successful one closes it.
+func (cb *circuitBreaker) record(failed bool, now time.Time) bool {
+	if cb == nil {
+		return false
+	}
+
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	if !failed {
+		cb.failures = 0
+		cb.trial = false
+		return false
+	}
+
+	cb.failures++
+	if cb.failures < cb.threshold {
+		return false
+	}
+
+	cb.trial = false
+	cb.openUntil = now.Add(cb.cooldown)
+	return true
+}
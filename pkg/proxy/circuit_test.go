@@ -0,0 +1,72 @@
+/*
+Copyright © 2018-2021 Neil Hemming
+*/
+
+package proxy
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCircuitBreakerValidateSettings(t *testing.T) {
+	if err := (CircuitBreakerSettings{Threshold: 3}).validateSettings(); err == nil {
+		t.Error("Missing cooldown not caught")
+	}
+
+	if err := (CircuitBreakerSettings{}).validateSettings(); err != nil {
+		t.Error("Unexpected", err)
+	}
+
+	if (CircuitBreakerSettings{}).newCircuitBreaker() != nil {
+		t.Error("Disabled breaker created")
+	}
+}
+
+func TestCircuitBreakerOpensAndCloses(t *testing.T) {
+	cb := CircuitBreakerSettings{Threshold: 2, Cooldown: time.Minute}.newCircuitBreaker()
+	now := time.Now()
+
+	if cb.record(true, now) || !cb.allow(now) {
+		t.Error("Opened before threshold")
+	}
+
+	if !cb.record(true, now) {
+		t.Error("Not opened at threshold")
+	}
+
+	if cb.allow(now.Add(30 * time.Second)) {
+		t.Error("Allowed while open")
+	}
+
+	if !cb.allow(now.Add(time.Minute)) {
+		t.Error("Trial not allowed after cooldown")
+	}
+
+	// A failed trial reopens, success resets
+	if !cb.record(true, now.Add(time.Minute)) {
+		t.Error("Failed trial did not reopen")
+	}
+
+	cb.record(false, now.Add(2*time.Minute))
+	if cb.record(true, now.Add(2*time.Minute)) {
+		t.Error("Success did not reset failures")
+	}
+}
+
+func TestCircuitBreakerAllowsOneTrial(t *testing.T) {
+	cb := CircuitBreakerSettings{Threshold: 1, Cooldown: time.Minute}.newCircuitBreaker()
+	now := time.Now()
+
+	cb.record(true, now)
+
+	trial := now.Add(time.Minute)
+	if !cb.allow(trial) || cb.allow(trial) {
+		t.Error("Expected a single trial request")
+	}
+
+	cb.record(false, trial)
+	if !cb.allow(trial) || !cb.allow(trial) {
+		t.Error("Successful trial did not close the circuit")
+	}
+}
@@ -0,0 +1,295 @@
+/*
+Copyright © 2018-2021 Neil Hemming
+*/
+
+package proxy
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+
+	multierror "github.com/hashicorp/go-multierror"
+)
+
+const (
+	// AuthMethodClientSecretBasic sends the client secret in the Authorization header.
+	AuthMethodClientSecretBasic = "client_secret_basic"
+
+	// AuthMethodClientSecretPost sends the client secret in the request body.
+	AuthMethodClientSecretPost = "client_secret_post"
+
+	// AuthMethodPrivateKeyJWT authenticates with a client_assertion JWT signed by the client's private key.
+	AuthMethodPrivateKeyJWT = "private_key_jwt"
+
+	// clientAssertionLifetime is how long a generated client assertion is valid for.
+	clientAssertionLifetime = 5 * time.Minute
+)
+
+type (
+	// ClientCredentials are the credentials of a downstream client held by the proxy.
+	// Inbound requests presenting only the client ID, or the local alias the credentials are registered under,
+	// have the credentials injected before being forwarded.
+	ClientCredentials struct {
+		// ClientID is the client ID known to the provider
+		ClientID string
+
+		// ClientSecret is the client secret used by the client_secret_basic and client_secret_post methods
+		ClientSecret string
+
+		// PrivateKey is the PEM encoded RSA or EC private key used by the private_key_jwt method
+		PrivateKey string
+
+		// KeyID is the optional kid header of generated client assertions
+		KeyID string
+
+		// AuthMethod is the authentication method used with the provider, defaults to client_secret_basic
+		AuthMethod string
+	}
+
+	// injectedClient is a registered client whose credentials are injected into downstream requests.
+	injectedClient struct {
+		alias        string
+		clientID     string
+		clientSecret string
+		authMode     authType
+		signer       crypto.Signer
+		alg          string
+		keyID        string
+	}
+
+	// clientRegistry holds the injected clients by alias.
+	clientRegistry map[string]*injectedClient
+
+	// clientAuth is the client authentication applied to a downstream request.
+	clientAuth struct {
+		authMode        authType
+		clientID        string
+		clientSecret    string
+		clientAssertion string
+	}
+)
+
+// newClientRegistry creates the registry of injected clients from their settings.
+func newClientRegistry(clients map[string]ClientCredentials) (clientRegistry, error) {
+	var result error
+
+	registry := make(clientRegistry)
+
+	for alias, creds := range clients {
+		client, err := newInjectedClient(alias, creds)
+		if err != nil {
+			result = multierror.Append(result, fmt.Errorf("client %s: %w", alias, err))
+			continue
+		}
+		registry[strings.ToLower(alias)] = client
+	}
+
+	return registry, result
+}
+
+// newInjectedClient validates client credentials and prepares them for use.
+func newInjectedClient(alias string, creds ClientCredentials) (*injectedClient, error) {
+	if creds.ClientID == "" {
+		return nil, errors.New("client ID cannot be blank")
+	}
+
+	client := &injectedClient{
+		alias:        alias,
+		clientID:     creds.ClientID,
+		clientSecret: creds.ClientSecret,
+		keyID:        creds.KeyID,
+	}
+
+	switch creds.AuthMethod {
+	case "", AuthMethodClientSecretBasic:
+		client.authMode = authInHeader
+	case AuthMethodClientSecretPost:
+		client.authMode = authInBody
+	case AuthMethodPrivateKeyJWT:
+		signer, alg, err := parsePrivateKey(creds.PrivateKey)
+		if err != nil {
+			return nil, err
+		}
+		client.authMode = authWithAssertion
+		client.signer = signer
+		client.alg = alg
+	default:
+		return nil, fmt.Errorf("unknown auth method %s", creds.AuthMethod)
+	}
+
+	if client.authMode != authWithAssertion && creds.ClientSecret == "" {
+		return nil, errors.New("client secret cannot be blank")
+	}
+
+	return client, nil
+}
+
+// find returns the client registered under the alias or, failing that, with the client ID.
+// Aliases are case insensitive.
+func (registry clientRegistry) find(aliasOrID string) *injectedClient {
+	if client, ok := registry[strings.ToLower(aliasOrID)]; ok {
+		return client
+	}
+
+	for _, client := range registry {
+		if client.clientID == aliasOrID {
+			return client
+		}
+	}
+
+	return nil
+}
+
+// injectClient attaches registered client credentials to requests presenting only a client ID or alias.
+func (rt *runtime) injectClient(tr *tokenRequest) {
+	if tr.clientID == "" || tr.clientSecret != "" || tr.authMode == authWithAssertion {
+		return
+	}
+
+	client := rt.config().clients.find(tr.clientID)
+	if client == nil {
+		return
+	}
+
+	tr.client = client
+	tr.clientAlias = strings.ToLower(client.alias)
+	tr.clientID = client.clientID
+	tr.authMode = client.authMode
+}
+
+// auth returns the client authentication for a downstream request to audience.
+func (client *injectedClient) auth(audience string) (clientAuth, error) {
+	auth := clientAuth{
+		authMode:     client.authMode,
+		clientID:     client.clientID,
+		clientSecret: client.clientSecret,
+	}
+
+	if client.authMode == authWithAssertion {
+		assertion, err := client.signAssertion(audience, time.Now().UTC())
+		if err != nil {
+			return auth, err
+		}
+		auth.clientAssertion = assertion
+	}
+
+	return auth, nil
+}
+
+// signAssertion creates a private_key_jwt client assertion for the audience.
+func (client *injectedClient) signAssertion(audience string, now time.Time) (string, error) {
+	jti := make([]byte, 16)
+	if _, err := rand.Read(jti); err != nil {
+		return "", err
+	}
+
+	header := map[string]string{"alg": client.alg, "typ": "JWT"}
+	if client.keyID != "" {
+		header["kid"] = client.keyID
+	}
+
+	claims := map[string]interface{}{
+		"iss": client.clientID,
+		"sub": client.clientID,
+		"aud": audience,
+		"jti": hex.EncodeToString(jti),
+		"iat": now.Unix(),
+		"exp": now.Add(clientAssertionLifetime).Unix(),
+	}
+
+	h, err := json.Marshal(header)
+	if err != nil {
+		return "", err
+	}
+	c, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	enc := base64.RawURLEncoding
+	signingInput := enc.EncodeToString(h) + "." + enc.EncodeToString(c)
+
+	sig, err := client.sign([]byte(signingInput))
+	if err != nil {
+		return "", err
+	}
+
+	return signingInput + "." + enc.EncodeToString(sig), nil
+}
+
+// sign signs the JWT signing input using the client's key.
+func (client *injectedClient) sign(data []byte) ([]byte, error) {
+	digest := sha256.Sum256(data)
+
+	switch key := client.signer.(type) {
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, key, digest[:])
+		if err != nil {
+			return nil, err
+		}
+		// JWS uses the fixed length r || s form rather than ASN.1
+		return append(padInt(r, 32), padInt(s, 32)...), nil
+	default:
+		return client.signer.Sign(rand.Reader, digest[:], crypto.SHA256)
+	}
+}
+
+// padInt returns the big endian bytes of n left padded to size.
+func padInt(n *big.Int, size int) []byte {
+	b := n.Bytes()
+	if len(b) >= size {
+		return b
+	}
+
+	return append(make([]byte, size-len(b)), b...)
+}
+
+// parsePrivateKey parses a PEM encoded RSA or P-256 EC private key returning its JWS algorithm.
+func parsePrivateKey(pemData string) (crypto.Signer, string, error) {
+	block, _ := pem.Decode([]byte(pemData))
+	if block == nil {
+		return nil, "", errors.New("private key is not PEM encoded")
+	}
+
+	var key interface{}
+	var err error
+
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	default:
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+
+	if err != nil {
+		return nil, "", fmt.Errorf("parse private key: %w", err)
+	}
+
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		return k, "RS256", nil
+	case *ecdsa.PrivateKey:
+		if k.Curve != elliptic.P256() {
+			return nil, "", errors.New("only P-256 EC private keys are supported")
+		}
+		return k, "ES256", nil
+	}
+
+	return nil, "", errors.New("unsupported private key type")
+}
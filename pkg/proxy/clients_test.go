@@ -0,0 +1,75 @@
+/*
+Copyright © 2018-2021 Neil Hemming
+*/
+
+package proxy
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+
+	multierror "github.com/hashicorp/go-multierror"
+)
+
+func TestNewClientRegistryValidates(t *testing.T) {
+	_, err := newClientRegistry(map[string]ClientCredentials{
+		"noid":     {ClientSecret: "s"},
+		"nosecret": {ClientID: "c"},
+		"badkey":   {ClientID: "c", AuthMethod: AuthMethodPrivateKeyJWT, PrivateKey: "bad"},
+		"method":   {ClientID: "c", ClientSecret: "s", AuthMethod: "other"},
+	})
+	if err == nil {
+		t.Fatal("Invalid clients not caught")
+	}
+
+	if merr, ok := err.(*multierror.Error); !ok || len(merr.Errors) != 4 {
+		t.Error("Expected 4 errors", err)
+	}
+}
+
+func TestInjectedPrivateKeyJWTVerifies(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pemKey := string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}))
+
+	client, err := newInjectedClient("app", ClientCredentials{ClientID: "c1", AuthMethod: AuthMethodPrivateKeyJWT, PrivateKey: pemKey, KeyID: "k1"})
+	if err != nil {
+		t.Fatal("newInjectedClient", err)
+	}
+
+	jwt, err := client.signAssertion("https://p.com/token", time.Now())
+	if err != nil {
+		t.Fatal("signAssertion", err)
+	}
+
+	parts := strings.Split(jwt, ".")
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil || len(sig) != 64 {
+		t.Fatal("Bad signature encoding", err)
+	}
+
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	r, s := new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])
+	if !ecdsa.Verify(&key.PublicKey, digest[:], r, s) {
+		t.Error("Signature does not verify")
+	}
+
+	if id, ok := assertionIdentity(jwt); !ok || id != "jwt iss=c1 sub=c1 aud=https://p.com/token" {
+		t.Error("Unexpected claims", id)
+	}
+}
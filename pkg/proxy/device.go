@@ -0,0 +1,77 @@
+/*
+Copyright © 2018-2021 Neil Hemming
+*/
+
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// clientAuthParams are the form parameters carrying client authentication, these are replaced
+// by the authentication used downstream.
+var clientAuthParams = []string{"client_id", "client_secret", "client_assertion", "client_assertion_type"}
+
+// isDeviceCodePath reports if the path is for device authorization.
+func isDeviceCodePath(path string) bool {
+	return strings.HasSuffix(path, "/device/code")
+}
+
+// parseDeviceCodeRequest extracts the parameters of a device authorization request.
+// The form is forwarded as sent, less the client authentication and any blank scope.
+func parseDeviceCodeRequest(r *http.Request, tr tokenRequest) (tokenRequest, bool) {
+	tr.kind = deviceCodeKind
+	tr.scopes = r.PostFormValue("scope")
+
+	params := url.Values{}
+	for key, values := range r.PostForm {
+		params[key] = values
+	}
+
+	for _, key := range clientAuthParams {
+		params.Del(key)
+	}
+
+	if tr.scopes == "" {
+		params.Del("scope")
+	}
+
+	tr.params = params.Encode()
+
+	return tr, true
+}
+
+// prepareDeviceCodeRequest creates the downstream device authorization request.
+func (tr *tokenRequest) prepareDeviceCodeRequest(requestURL string) (*http.Request, error) {
+	params, err := url.ParseQuery(tr.params)
+	if err != nil {
+		return nil, err
+	}
+
+	return tr.newFormRequest(requestURL, params)
+}
+
+// deviceAuthorizationURL returns the downstream device authorization endpoint.
+func (rt *runtime) deviceAuthorizationURL(tr tokenRequest) string {
+	if md := rt.providerMetadata(); md != nil && md.DeviceAuthorizationEndpoint != "" {
+		return md.DeviceAuthorizationEndpoint
+	}
+
+	return rt.config().endpoint + tr.path
+}
+
+// isPendingResponse reports if a device grant response indicates the user has yet to complete authorization.
+func isPendingResponse(body []byte) bool {
+	var resp struct {
+		Error string `json:"error"`
+	}
+
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return false
+	}
+
+	return resp.Error == "authorization_pending" || resp.Error == "slow_down"
+}
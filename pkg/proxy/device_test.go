@@ -0,0 +1,111 @@
+/*
+Copyright © 2018-2021 Neil Hemming
+*/
+
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func newDevicePollRequest() *http.Request {
+	reader := strings.NewReader("client_id=cli&grant_type=urn%3Aietf%3Aparams%3Aoauth%3Agrant-type%3Adevice_code&device_code=dc1")
+	req, _ := http.NewRequest("POST", "http:/oauth2/token", reader)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return req
+}
+
+func TestIsPendingResponse(t *testing.T) {
+	if !isPendingResponse([]byte("{\"error\":\"authorization_pending\"}")) {
+		t.Error("authorization_pending not pending")
+	}
+	if !isPendingResponse([]byte("{\"error\":\"slow_down\"}")) {
+		t.Error("slow_down not pending")
+	}
+	if isPendingResponse([]byte("{\"error\":\"expired_token\"}")) {
+		t.Error("expired_token pending")
+	}
+}
+
+func TestParseRequestMatchDeviceGrant(t *testing.T) {
+	settings := DefaultSettings().WithEndpoint("test")
+	rt := newRuntime(context.Background(), settings)
+	defer rt.close()
+
+	w := httptest.NewRecorder()
+	tr, match := rt.parseRequest(w, newDevicePollRequest())
+
+	if !match {
+		t.Fatal("Expected a match")
+	}
+
+	expected := tokenRequest{
+		grantType:  grantTypeDeviceCode,
+		path:       "/oauth2/token",
+		clientID:   "cli",
+		authMode:   authInBody,
+		deviceCode: "dc1",
+	}
+
+	if tr != expected {
+		t.Error("Unexpected token returned", tr)
+	}
+}
+
+func TestDevicePollFromPublicClient(t *testing.T) {
+	settings := DefaultSettings().WithEndpoint("test")
+	rt := newRuntime(context.Background(), settings)
+	defer rt.close()
+
+	tr, match := rt.parseRequest(httptest.NewRecorder(), newDevicePollRequest())
+	if !match {
+		t.Fatal("Expected a match")
+	}
+
+	down, err := tr.prepareRequest("https://p.com/oauth2/token")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := down.ParseForm(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := down.PostForm["client_secret"]; ok || down.PostFormValue("client_id") != "cli" || down.PostFormValue("device_code") != "dc1" {
+		t.Error("Unexpected downstream form", down.PostForm)
+	}
+}
+
+func TestDeviceCodeRequestOmitsBlankScope(t *testing.T) {
+	req, _ := http.NewRequest("POST", "http:/oauth2/device/code", strings.NewReader("client_id=cli&client_secret=s&scope=&resource=r1"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth("cli", "s")
+	if err := req.ParseForm(); err != nil {
+		t.Fatal(err)
+	}
+
+	tr := tokenRequest{path: "/oauth2/device/code"}
+	parseClientAuth(req, &tr)
+	tr, _ = parseDeviceCodeRequest(req, tr)
+
+	down, err := tr.prepareRequest("https://p.com/oauth2/device/code")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := down.ParseForm(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := down.PostForm["scope"]; ok || down.PostFormValue("resource") != "r1" || down.PostFormValue("client_secret") != "" {
+		t.Error("Unexpected downstream form", down.PostForm)
+	}
+
+	if u, p, ok := down.BasicAuth(); !ok || u != "cli" || p != "s" {
+		t.Error("Client auth not sent", u, p)
+	}
+}
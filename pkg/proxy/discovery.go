@@ -0,0 +1,137 @@
+/*
+Copyright © 2018-2021 Neil Hemming
+*/
+
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	// discoveryPath is the well known path of the openid configuration document.
+	discoveryPath = "/.well-known/openid-configuration"
+)
+
+type (
+	// providerMetadata contains the subset of the openid provider configuration used by the proxy.
+	providerMetadata struct {
+		Issuer                      string `json:"issuer"`
+		TokenEndpoint               string `json:"token_endpoint"`
+		JWKSURI                     string `json:"jwks_uri,omitempty"`
+		UserinfoEndpoint            string `json:"userinfo_endpoint,omitempty"`
+		IntrospectionEndpoint       string `json:"introspection_endpoint,omitempty"`
+		RevocationEndpoint          string `json:"revocation_endpoint,omitempty"`
+		DeviceAuthorizationEndpoint string `json:"device_authorization_endpoint,omitempty"`
+	}
+)
+
+// discoveryURL returns the url of the openid configuration document for an issuer.
+func discoveryURL(issuer string) string {
+	return strings.TrimSuffix(issuer, "/") + discoveryPath
+}
+
+// discover fetches the provider metadata from the issuer and stores it in the runtime.
+func (rt *runtime) discover() error {
+	ctxTimeout, cancel := context.WithTimeout(rt.ctx, rt.config().requestTimeout)
+	defer cancel()
+
+	md, err := rt.fetchMetadata(ctxTimeout, rt.issuer)
+	if err != nil {
+		return err
+	}
+
+	rt.logInfo("discovered token endpoint %s for issuer %s", md.TokenEndpoint, rt.issuer)
+
+	rt.metaLock.Lock()
+	defer rt.metaLock.Unlock()
+	rt.metadata = md
+
+	return nil
+}
+
+// fetchMetadata requests and validates the openid configuration document for an issuer.
+func (rt *runtime) fetchMetadata(ctx context.Context, issuer string) (*providerMetadata, error) {
+	req, err := http.NewRequest("GET", discoveryURL(issuer), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := rt.requester(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("discovery %s returned status %d", req.URL, resp.StatusCode)
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+
+	md := &providerMetadata{}
+	if err := json.Unmarshal(body, md); err != nil {
+		return nil, fmt.Errorf("discovery document: %w", err)
+	}
+
+	if md.TokenEndpoint == "" {
+		return nil, errors.New("discovery document has no token_endpoint")
+	}
+
+	if md.Issuer != "" && strings.TrimSuffix(md.Issuer, "/") != strings.TrimSuffix(issuer, "/") {
+		return nil, fmt.Errorf("discovery issuer %s does not match %s", md.Issuer, issuer)
+	}
+
+	return md, nil
+}
+
+// providerMetadata returns the current discovered metadata or nil if discovery is not in use.
+func (rt *runtime) providerMetadata() *providerMetadata {
+	rt.metaLock.RLock()
+	defer rt.metaLock.RUnlock()
+
+	return rt.metadata
+}
+
+// tokenURL returns the downstream url a token request is forwarded to.
+func (rt *runtime) tokenURL(tr tokenRequest) string {
+	if md := rt.providerMetadata(); md != nil {
+		return md.TokenEndpoint
+	}
+
+	return rt.config().endpoint + tr.path
+}
+
+// discoveryRefresher periodically refreshes the provider metadata.
+// Failures are logged and the previously discovered metadata kept.
+func (rt *runtime) discoveryRefresher(period time.Duration) {
+	// Mark closure in work group
+	defer rt.downstreamWaitGroup.Done()
+
+	for {
+		wait, cancel := context.WithTimeout(rt.ctx, period)
+
+		<-wait.Done()
+		cancel()
+
+		if rt.ctx.Err() != nil {
+			return
+		}
+
+		if err := rt.discover(); err != nil {
+			rt.logError("refresh discovery: %s", err)
+		}
+	}
+}
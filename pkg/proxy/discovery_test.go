@@ -0,0 +1,94 @@
+/*
+Copyright © 2018-2021 Neil Hemming
+*/
+
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func newDiscoveryServer(t *testing.T, tokenEndpoint string) *httptest.Server {
+	t.Helper()
+
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != discoveryPath {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(providerMetadata{
+			Issuer:        srv.URL,
+			TokenEndpoint: tokenEndpoint,
+		})
+	}))
+
+	return srv
+}
+
+func TestDiscoveryURL(t *testing.T) {
+	if u := discoveryURL("https://p.com/tenant/"); u != "https://p.com/tenant/.well-known/openid-configuration" {
+		t.Error("Unexpected discovery url", u)
+	}
+}
+
+func TestDiscoverSucceeds(t *testing.T) {
+	srv := newDiscoveryServer(t, "https://p.com/oauth2/token")
+	defer srv.Close()
+
+	settings := DefaultSettings().WithIssuer(srv.URL)
+	rt := newRuntime(context.Background(), settings)
+	defer rt.close()
+
+	if err := rt.discover(); err != nil {
+		t.Fatal("discover", err)
+	}
+
+	if u := rt.tokenURL(tokenRequest{path: "/token"}); u != "https://p.com/oauth2/token" {
+		t.Error("Unexpected token url", u)
+	}
+}
+
+func TestDiscoverNoTokenEndpointFails(t *testing.T) {
+	srv := newDiscoveryServer(t, "")
+	defer srv.Close()
+
+	settings := DefaultSettings().WithIssuer(srv.URL)
+	rt := newRuntime(context.Background(), settings)
+	defer rt.close()
+
+	if err := rt.discover(); err == nil {
+		t.Error("Missing token_endpoint not caught")
+	}
+
+	if rt.providerMetadata() != nil {
+		t.Error("Metadata set after failure")
+	}
+}
+
+func TestTokenURLWithoutDiscovery(t *testing.T) {
+	settings := DefaultSettings().WithEndpoint("https://p.com/tenant")
+	rt := newRuntime(context.Background(), settings)
+	defer rt.close()
+
+	if u := rt.tokenURL(tokenRequest{path: "/v1/token"}); u != "https://p.com/tenant/v1/token" {
+		t.Error("Unexpected token url", u)
+	}
+}
+
+func TestRunFailsWhenDiscoveryFails(t *testing.T) {
+	srv := httptest.NewServer(http.NotFoundHandler())
+	defer srv.Close()
+
+	settings := DefaultSettings().WithIssuer(srv.URL).WithHTTPPort(0)
+
+	if err := Run(context.Background(), settings); err == nil {
+		t.Error("Run succeeded with failed discovery")
+	}
+}
@@ -0,0 +1,105 @@
+/*
+Copyright © 2018-2021 Neil Hemming
+*/
+
+package proxy
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// jwksPath is the well known path of a JSON web key set.
+	jwksPath = "/.well-known/jwks.json"
+)
+
+// documentSuffixes are the inbound path suffixes of the provider documents the proxy caches.
+var documentSuffixes = []string{
+	discoveryPath,
+	jwksPath,
+	"/jwks",
+	"/keys",
+	"/certs",
+}
+
+// isDocumentPath reports if the path is for a cacheable provider document.
+func isDocumentPath(path string) bool {
+	for _, suffix := range documentSuffixes {
+		if strings.HasSuffix(path, suffix) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// documentURL returns the downstream url of a provider document.
+// When discovery is in use the discovered documents are used, otherwise the path is appended to the endpoint.
+func (rt *runtime) documentURL(tr tokenRequest) string {
+	md := rt.providerMetadata()
+	if md == nil {
+		return rt.config().endpoint + tr.path
+	}
+
+	if strings.HasSuffix(tr.path, discoveryPath) {
+		return discoveryURL(rt.issuer)
+	}
+
+	if md.JWKSURI != "" {
+		return md.JWKSURI
+	}
+
+	return rt.config().endpoint + tr.path
+}
+
+// documentExpiry calculates the expiry of a document from its Cache-Control header.
+// The lifetime is bounded by floor and ceiling, if no max-age is provided ttl is used.
+func documentExpiry(header http.Header, now time.Time, ttl, floor, ceiling time.Duration) time.Time {
+	lifetime := ttl
+
+	if maxAge, ok := cacheControlMaxAge(header.Get("Cache-Control")); ok {
+		lifetime = maxAge
+	}
+
+	if lifetime < floor {
+		lifetime = floor
+	}
+	if ceiling > 0 && lifetime > ceiling {
+		lifetime = ceiling
+	}
+
+	return now.Add(lifetime)
+}
+
+// cacheControlMaxAge extracts the max age from a Cache-Control header.
+// no-store and no-cache are treated as a zero max age, s-maxage takes priority over max-age.
+func cacheControlMaxAge(cacheControl string) (time.Duration, bool) {
+	var maxAge, sMaxAge time.Duration
+	hasMaxAge, hasSMaxAge := false, false
+
+	for _, directive := range strings.Split(cacheControl, ",") {
+		directive = strings.ToLower(strings.TrimSpace(directive))
+
+		switch {
+		case directive == "no-store" || directive == "no-cache":
+			return 0, true
+		case strings.HasPrefix(directive, "s-maxage="):
+			if v, err := strconv.ParseInt(strings.TrimPrefix(directive, "s-maxage="), 10, 64); err == nil && v >= 0 {
+				sMaxAge, hasSMaxAge = time.Duration(v)*time.Second, true
+			}
+		case strings.HasPrefix(directive, "max-age="):
+			if v, err := strconv.ParseInt(strings.TrimPrefix(directive, "max-age="), 10, 64); err == nil && v >= 0 {
+				maxAge, hasMaxAge = time.Duration(v)*time.Second, true
+			}
+		}
+	}
+
+	if hasSMaxAge {
+		return sMaxAge, true
+	}
+
+	return maxAge, hasMaxAge
+}
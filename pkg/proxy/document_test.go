@@ -0,0 +1,85 @@
+/*
+Copyright © 2018-2021 Neil Hemming
+*/
+
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestIsDocumentPath(t *testing.T) {
+	for _, p := range []string{"/.well-known/openid-configuration", "/t/.well-known/jwks.json", "/oauth2/v1/keys", "/protocol/openid-connect/certs"} {
+		if !isDocumentPath(p) {
+			t.Error("Not a document path", p)
+		}
+	}
+
+	if isDocumentPath("/oauth2/token") {
+		t.Error("Token path is a document path")
+	}
+}
+
+func TestCacheControlMaxAge(t *testing.T) {
+	tests := []struct {
+		header string
+		maxAge time.Duration
+		ok     bool
+	}{
+		{"", 0, false},
+		{"public, max-age=300", 300 * time.Second, true},
+		{"max-age=300, s-maxage=60", 60 * time.Second, true},
+		{"no-store", 0, true},
+		{"max-age=bad", 0, false},
+	}
+
+	for _, test := range tests {
+		maxAge, ok := cacheControlMaxAge(test.header)
+		if maxAge != test.maxAge || ok != test.ok {
+			t.Errorf("%s expected %d %v, got %d %v", test.header, test.maxAge, test.ok, maxAge, ok)
+		}
+	}
+}
+
+func TestDocumentExpiryBounded(t *testing.T) {
+	now := time.Date(2020, 0o1, 0o1, 0o1, 0o0, 0o0, 0o0, time.UTC)
+	header := http.Header{}
+
+	header.Set("Cache-Control", "max-age=5")
+	if e := documentExpiry(header, now, time.Hour, time.Minute, 2*time.Hour); !e.Equal(now.Add(time.Minute)) {
+		t.Error("Floor not applied", e)
+	}
+
+	header.Set("Cache-Control", "max-age=86400")
+	if e := documentExpiry(header, now, time.Hour, time.Minute, 2*time.Hour); !e.Equal(now.Add(2 * time.Hour)) {
+		t.Error("Ceiling not applied", e)
+	}
+
+	header.Del("Cache-Control")
+	if e := documentExpiry(header, now, time.Hour, time.Minute, 2*time.Hour); !e.Equal(now.Add(time.Hour)) {
+		t.Error("TTL not applied", e)
+	}
+}
+
+func TestParseRequestMatchDocument(t *testing.T) {
+	settings := DefaultSettings().WithEndpoint("test")
+	rt := newRuntime(context.Background(), settings)
+	defer rt.close()
+
+	req, _ := http.NewRequest("GET", "http:/t/.well-known/jwks.json", nil)
+
+	w := httptest.NewRecorder()
+	tr, match := rt.parseRequest(w, req)
+
+	if !match {
+		t.Error("Expected a match")
+	}
+
+	if tr != (tokenRequest{kind: documentKind, path: "/t/.well-known/jwks.json"}) {
+		t.Error("Unexpected request returned", tr)
+	}
+}
@@ -0,0 +1,393 @@
+/*
+Copyright © 2018-2021 Neil Hemming
+*/
+
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+
+	multierror "github.com/hashicorp/go-multierror"
+)
+
+const (
+	// EventTokenRefreshed is emitted when a token is obtained from the provider.
+	EventTokenRefreshed = "token.refreshed"
+
+	// EventRefreshFailed is emitted when the provider fails to issue a token.
+	EventRefreshFailed = "token.refresh_failed"
+
+	// EventCredentialFailing is emitted when credentials that previously obtained a token start failing.
+	EventCredentialFailing = "credential.failing"
+
+	// EventCircuitOpened is emitted when the circuit breaker stops requests to the provider.
+	EventCircuitOpened = "circuit.opened"
+
+	// eventQueueSize is the number of events buffered for delivery, further events are dropped.
+	eventQueueSize = 256
+
+	// eventDeliveryTimeout limits each delivery attempt.
+	eventDeliveryTimeout = 10 * time.Second
+)
+
+type (
+	// EventSettings configures delivery of proxy events to webhooks and a local command.
+	EventSettings struct {
+		// Webhooks are the urls each event is POSTed to as JSON
+		Webhooks []string
+
+		// Headers are added to each webhook request
+		Headers map[string]string
+
+		// Command is a local command, and its arguments, run for each event with the event JSON on stdin
+		Command []string
+
+		// Retries is the number of times a failed delivery is retried
+		Retries int
+
+		// RetryDelay is the delay before the first retry, doubling for each further retry
+		RetryDelay time.Duration
+
+		// DedupeWindow suppresses repeats of an event for the same credentials within the window
+		DedupeWindow time.Duration
+	}
+
+	// Event is a notification of a change in the proxy's interaction with the provider.
+	Event struct {
+		Type     string `json:"type"`
+		Time     string `json:"time"`
+		Identity string `json:"identity,omitempty"`
+		ClientID string `json:"client_id,omitempty"`
+		Provider string `json:"provider,omitempty"`
+		Status   int    `json:"status,omitempty"`
+		Error    string `json:"error,omitempty"`
+	}
+
+	// eventBus delivers events to the configured sinks in the background.
+	eventBus struct {
+		settings EventSettings
+		client   *http.Client
+		events   chan Event
+		done     chan struct{}
+		wg       sync.WaitGroup
+		logger   func(error)
+
+		mu   sync.Mutex
+		seen map[string]time.Time
+	}
+
+	// credentialHealth tracks whether credentials last succeeded in obtaining a token.
+	// Credentials are identified by a hash of the client ID and identity, see credentialKey.
+	credentialHealth struct {
+		mu   sync.Mutex
+		good map[string]bool
+	}
+)
+
+func (es EventSettings) validateSettings() error {
+	var result error
+
+	for _, hook := range es.Webhooks {
+		if u, err := url.Parse(hook); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			result = multierror.Append(result, fmt.Errorf("event webhook %s is not a valid url", hook))
+		}
+	}
+
+	if es.Retries < 0 || es.RetryDelay < 0 || es.DedupeWindow < 0 {
+		result = multierror.Append(result, errors.New("event retries, retry delay and dedupe window cannot be negative"))
+	}
+
+	return result
+}
+
+// newEventBus starts event delivery, nil if no sinks are configured.
+func (es EventSettings) newEventBus(client *http.Client, logger func(error)) *eventBus {
+	if len(es.Webhooks) == 0 && len(es.Command) == 0 {
+		return nil
+	}
+
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	bus := &eventBus{
+		settings: es,
+		client:   client,
+		events:   make(chan Event, eventQueueSize),
+		done:     make(chan struct{}),
+		logger:   logger,
+		seen:     make(map[string]time.Time),
+	}
+
+	bus.wg.Add(1)
+	go bus.deliverer()
+
+	return bus
+}
+
+// close stops delivery once the queued events have been delivered.
+func (bus *eventBus) close() {
+	if bus == nil {
+		return
+	}
+
+	close(bus.done)
+	bus.wg.Wait()
+}
+
+// emit queues an event for delivery, unless it repeats an event delivered within the dedupe window.
+func (bus *eventBus) emit(event Event, now time.Time) {
+	if bus == nil {
+		return
+	}
+
+	event.Time = now.UTC().Format(time.RFC3339Nano)
+
+	if bus.duplicate(event, now) {
+		return
+	}
+
+	select {
+	case bus.events <- event:
+	default:
+		if bus.logger != nil {
+			bus.logger(fmt.Errorf("event queue full, %s event dropped", event.Type))
+		}
+	}
+}
+
+// duplicate reports if an identical event was emitted within the dedupe window, recording it if not.
+func (bus *eventBus) duplicate(event Event, now time.Time) bool {
+	if bus.settings.DedupeWindow == 0 {
+		return false
+	}
+
+	key := fmt.Sprintf("%s|%s|%s|%s|%d", event.Type, event.Identity, event.ClientID, event.Provider, event.Status)
+
+	bus.mu.Lock()
+	defer bus.mu.Unlock()
+
+	if last, ok := bus.seen[key]; ok && now.Sub(last) < bus.settings.DedupeWindow {
+		return true
+	}
+
+	// Forget expired keys so the map does not grow without bound
+	for k, last := range bus.seen {
+		if now.Sub(last) >= bus.settings.DedupeWindow {
+			delete(bus.seen, k)
+		}
+	}
+
+	bus.seen[key] = now
+	return false
+}
+
+// deliverer delivers queued events until the bus is closed.
+func (bus *eventBus) deliverer() {
+	defer bus.wg.Done()
+
+	for {
+		select {
+		case event := <-bus.events:
+			bus.deliver(event)
+		case <-bus.done:
+			for {
+				select {
+				case event := <-bus.events:
+					bus.deliver(event)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// deliver sends the event to every sink, retrying failures.
+func (bus *eventBus) deliver(event Event) {
+	body, err := json.Marshal(event)
+	if err != nil {
+		bus.logError(err)
+		return
+	}
+
+	for _, hook := range bus.settings.Webhooks {
+		hook := hook
+		bus.logError(bus.retry(func() error { return bus.post(hook, body) }))
+	}
+
+	if len(bus.settings.Command) > 0 {
+		bus.logError(bus.retry(func() error { return bus.run(event.Type, body) }))
+	}
+}
+
+// retry calls fn until it succeeds or the retries are exhausted, doubling the delay between attempts.
+// Retrying stops early if the bus is closed.
+func (bus *eventBus) retry(fn func() error) error {
+	delay := bus.settings.RetryDelay
+
+	err := fn()
+	for attempt := 0; err != nil && attempt < bus.settings.Retries; attempt++ {
+		select {
+		case <-time.After(delay):
+		case <-bus.done:
+			return err
+		}
+
+		delay *= 2
+		err = fn()
+	}
+
+	return err
+}
+
+// post sends the event to a webhook.
+func (bus *eventBus) post(hook string, body []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), eventDeliveryTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, "POST", hook, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range bus.settings.Headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := bus.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("event webhook: %w", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("event webhook %s returned status %d", hook, resp.StatusCode)
+	}
+
+	return nil
+}
+
+// run runs the local command with the event JSON on stdin and its type in OAP_EVENT_TYPE.
+func (bus *eventBus) run(eventType string, body []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), eventDeliveryTimeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, bus.settings.Command[0], bus.settings.Command[1:]...)
+	cmd.Stdin = bytes.NewReader(body)
+	cmd.Env = append(os.Environ(), "OAP_EVENT_TYPE="+eventType)
+
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("event command: %w: %s", err, bytes.TrimSpace(out))
+	}
+
+	return nil
+}
+
+func (bus *eventBus) logError(err error) {
+	if err != nil && bus.logger != nil {
+		bus.logger(err)
+	}
+}
+
+// credentialKey identifies the credentials of a token request by a hash of the client ID and identity,
+// so secrets are not held and requests with mistyped passwords share their identity's health.
+// Verified assertions use their identity as cache keys hold it in place of the assertion.
+func credentialKey(tr tokenRequest) string {
+	identity := tr.assertionID
+	if identity == "" {
+		identity = auditIdentity(tr)
+	}
+
+	sum := sha256.Sum256([]byte(tr.path + "\n" + tr.clientID + "\n" + tr.grantType + "\n" + identity))
+	return hex.EncodeToString(sum[:])
+}
+
+// update records the outcome for the credentials, returning true if they were previously good and now fail.
+func (ch *credentialHealth) update(key string, good bool) bool {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+
+	if ch.good == nil {
+		ch.good = make(map[string]bool)
+	}
+
+	wasGood := ch.good[key]
+	ch.good[key] = good
+
+	return wasGood && !good
+}
+
+// forget removes failing credentials once their cache entry is cleaned up.
+// Good credentials are kept so a later failure is reported, these are bounded by the working credentials.
+func (ch *credentialHealth) forget(key string) {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+
+	if good, ok := ch.good[key]; ok && !good {
+		delete(ch.good, key)
+	}
+}
+
+// notify emits the events for a downstream request's outcome and feeds the circuit breaker.
+// A status of zero indicates the provider could not be reached.
+func (rt *runtime) notify(tr tokenRequest, provider *url.URL, status int, body []byte, failure error) {
+	now := time.Now().UTC()
+
+	event := Event{
+		ClientID: tr.clientID,
+		Provider: provider.Scheme + "://" + provider.Host + provider.Path,
+		Status:   status,
+	}
+
+	if failure != nil {
+		event.Error = failure.Error()
+	}
+
+	providerFailed := failure != nil || status >= http.StatusInternalServerError
+	if rt.circuit.record(providerFailed, now) {
+		opened := event
+		opened.Type = EventCircuitOpened
+		rt.log(LevelWarn, "circuit opened, provider requests suspended", Fields{"provider": event.Provider})
+		rt.events.emit(opened, now)
+	}
+
+	// Credential events only apply to token requests, device flow polling is not a failure
+	if tr.kind != tokenKind || (tr.grantType == grantTypeDeviceCode && isPendingResponse(body)) {
+		return
+	}
+
+	if identity := auditIdentity(tr); identity != "" {
+		event.Identity = hashUsername(identity)
+	}
+
+	good := failure == nil && status == http.StatusOK
+	if good {
+		event.Type = EventTokenRefreshed
+	} else {
+		event.Type = EventRefreshFailed
+	}
+
+	transitioned := rt.health.update(credentialKey(tr), good)
+
+	rt.events.emit(event, now)
+
+	if transitioned {
+		event.Type = EventCredentialFailing
+		rt.log(LevelWarn, "credentials started failing", Fields{"client_id": tr.clientID, "status": status})
+		rt.events.emit(event, now)
+	}
+}
@@ -0,0 +1,191 @@
+/*
+Copyright © 2018-2021 Neil Hemming
+*/
+
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type webhookStub struct {
+	mu       sync.Mutex
+	failures int
+	calls    int
+	events   []Event
+}
+
+func (h *webhookStub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.calls++
+	if h.calls <= h.failures {
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+
+	var event Event
+	_ = json.NewDecoder(r.Body).Decode(&event)
+	h.events = append(h.events, event)
+}
+
+func (h *webhookStub) types() []string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	var types []string
+	for _, e := range h.events {
+		types = append(types, e.Type)
+	}
+	return types
+}
+
+func TestEventSettingsValidate(t *testing.T) {
+	if err := (EventSettings{Webhooks: []string{"ftp://x"}, Retries: -1}).validateSettings(); err == nil {
+		t.Error("Bad event settings not caught")
+	}
+
+	if (EventSettings{}).newEventBus(nil, nil) != nil {
+		t.Error("Bus created without sinks")
+	}
+}
+
+func TestEventBusRetriesWebhook(t *testing.T) {
+	hook := &webhookStub{failures: 2}
+	srv := httptest.NewServer(hook)
+	defer srv.Close()
+
+	bus := EventSettings{Webhooks: []string{srv.URL}, Retries: 2, RetryDelay: time.Millisecond}.newEventBus(nil, func(err error) {
+		t.Error("Unexpected delivery failure", err)
+	})
+
+	bus.emit(Event{Type: EventRefreshFailed, ClientID: "c1"}, time.Now())
+
+	// Retries stop when the bus is closed, so wait for delivery
+	for i := 0; i < 100 && len(hook.types()) == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	bus.close()
+
+	if types := hook.types(); len(types) != 1 || types[0] != EventRefreshFailed {
+		t.Error("Event not delivered after retries", types, hook.calls)
+	}
+}
+
+func TestEventBusDedupes(t *testing.T) {
+	hook := &webhookStub{}
+	srv := httptest.NewServer(hook)
+	defer srv.Close()
+
+	bus := EventSettings{Webhooks: []string{srv.URL}, DedupeWindow: time.Minute}.newEventBus(nil, nil)
+
+	now := time.Now()
+	bus.emit(Event{Type: EventRefreshFailed, ClientID: "c1", Status: 400}, now)
+	bus.emit(Event{Type: EventRefreshFailed, ClientID: "c1", Status: 400}, now.Add(time.Second))
+	bus.emit(Event{Type: EventRefreshFailed, ClientID: "c2", Status: 400}, now.Add(time.Second))
+	bus.emit(Event{Type: EventRefreshFailed, ClientID: "c1", Status: 400}, now.Add(2*time.Minute))
+	bus.close()
+
+	if types := hook.types(); len(types) != 3 {
+		t.Error("Expected 3 events got", len(types))
+	}
+}
+
+func TestNotifyCredentialTransition(t *testing.T) {
+	hook := &webhookStub{}
+	srv := httptest.NewServer(hook)
+	defer srv.Close()
+
+	settings := DefaultSettings().WithEndpoint("http://test")
+	settings.CircuitBreaker = CircuitBreakerSettings{Threshold: 2, Cooldown: time.Minute}
+	rt := newRuntime(context.Background(), settings)
+	defer rt.close()
+
+	rt.events = EventSettings{Webhooks: []string{srv.URL}}.newEventBus(nil, nil)
+
+	status := http.StatusOK
+	rt.requester = func(ctx context.Context, req *http.Request) (*http.Response, error) {
+		if status == 0 {
+			return nil, errors.New("connection refused")
+		}
+		return &http.Response{
+			StatusCode: status,
+			Header:     http.Header{},
+			Body:       ioutil.NopCloser(strings.NewReader(`{"access_token":"a1","error":"invalid_grant"}`)),
+		}, nil
+	}
+
+	tr := tokenRequest{kind: tokenKind, path: "/token", clientID: "c1", clientSecret: "s1", username: "u1", password: "p1"}
+
+	rt.getDownstreamToken(tr, "", spanContext{})
+	status = http.StatusBadRequest
+	rt.getDownstreamToken(tr, "", spanContext{})
+	status = 0
+	rt.getDownstreamToken(tr, "", spanContext{})
+	rt.getDownstreamToken(tr, "", spanContext{})
+
+	// Circuit is now open, the provider is not called
+	if res := rt.getDownstreamToken(tr, "", spanContext{}); res.status != 0 {
+		t.Error("Circuit did not stop request")
+	}
+
+	rt.events.close()
+
+	expected := []string{
+		EventTokenRefreshed,
+		EventRefreshFailed, EventCredentialFailing,
+		EventRefreshFailed,
+		EventCircuitOpened, EventRefreshFailed,
+	}
+
+	types := hook.types()
+	if strings.Join(types, ",") != strings.Join(expected, ",") {
+		t.Error("Unexpected events", types)
+	}
+
+	if len(hook.events) > 0 && hook.events[0].Identity != hashUsername("u1") {
+		t.Error("Identity not hashed", hook.events[0].Identity)
+	}
+}
+
+func TestCredentialHealthKeyedByIdentity(t *testing.T) {
+	tr := tokenRequest{kind: tokenKind, path: "/token", clientID: "c1", clientSecret: "s1", username: "u1", password: "p1"}
+	typo := tr
+	typo.password = "p2"
+
+	if key := credentialKey(tr); key != credentialKey(typo) || strings.Contains(key, "p1") {
+		t.Error("Credential key depends on the password", key)
+	}
+
+	settings := DefaultSettings().WithEndpoint("http://test")
+	rt := newRuntime(context.Background(), settings)
+	defer rt.close()
+
+	other := tr
+	other.username = "u2"
+
+	rt.health.update(credentialKey(tr), true)
+	rt.health.update(credentialKey(other), false)
+	rt.update(tr, http.Header{}, []byte(`{"access_token":"a1"}`), http.StatusOK)
+	rt.update(other, http.Header{}, []byte(`{"error":"invalid_grant"}`), http.StatusBadRequest)
+
+	rt.clean(time.Now().UTC().Add(settings.CacheTTL + time.Second))
+
+	if _, ok := rt.health.good[credentialKey(other)]; ok {
+		t.Error("Failing credentials not forgotten")
+	}
+
+	if !rt.health.good[credentialKey(tr)] {
+		t.Error("Good credentials forgotten")
+	}
+}
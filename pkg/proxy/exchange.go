@@ -0,0 +1,66 @@
+/*
+Copyright © 2018-2021 Neil Hemming
+*/
+
+package proxy
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+type (
+	// tokenExchange contains the parameters of a token exchange grant (RFC 8693).
+	// Multi valued audience and resource parameters are stored space separated.
+	tokenExchange struct {
+		subjectToken       string
+		subjectTokenType   string
+		actorToken         string
+		actorTokenType     string
+		audience           string
+		resource           string
+		requestedTokenType string
+	}
+)
+
+// parseTokenExchange extracts the token exchange parameters from the request form.
+func parseTokenExchange(r *http.Request) tokenExchange {
+	return tokenExchange{
+		subjectToken:       r.PostFormValue("subject_token"),
+		subjectTokenType:   r.PostFormValue("subject_token_type"),
+		actorToken:         r.PostFormValue("actor_token"),
+		actorTokenType:     r.PostFormValue("actor_token_type"),
+		audience:           strings.Join(r.PostForm["audience"], " "),
+		resource:           strings.Join(r.PostForm["resource"], " "),
+		requestedTokenType: r.PostFormValue("requested_token_type"),
+	}
+}
+
+// values returns the downstream form values of the token exchange.
+func (te tokenExchange) values() url.Values {
+	v := url.Values{
+		"grant_type":         {grantTypeTokenExchange},
+		"subject_token":      {te.subjectToken},
+		"subject_token_type": {te.subjectTokenType},
+	}
+
+	if te.actorToken != "" {
+		v.Set("actor_token", te.actorToken)
+		v.Set("actor_token_type", te.actorTokenType)
+	}
+
+	if te.audience != "" {
+		v["audience"] = strings.Split(te.audience, " ")
+	}
+
+	if te.resource != "" {
+		v["resource"] = strings.Split(te.resource, " ")
+	}
+
+	if te.requestedTokenType != "" {
+		v.Set("requested_token_type", te.requestedTokenType)
+	}
+
+	return v
+}
@@ -0,0 +1,33 @@
+/*
+Copyright © 2018-2021 Neil Hemming
+*/
+
+package proxy
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestTokenExchangeValuesRoundtrip(t *testing.T) {
+	te := tokenExchange{
+		subjectToken:       "st",
+		subjectTokenType:   "stt",
+		actorToken:         "at",
+		actorTokenType:     "att",
+		audience:           "a1 a2",
+		resource:           "https://r",
+		requestedTokenType: "rtt",
+	}
+
+	req, _ := http.NewRequest("POST", "http:/token", strings.NewReader(te.values().Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if err := req.ParseForm(); err != nil {
+		t.Fatal(err)
+	}
+
+	if parsed := parseTokenExchange(req); parsed != te {
+		t.Error("Roundtrip mismatch", parsed)
+	}
+}
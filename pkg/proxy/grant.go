@@ -0,0 +1,99 @@
+/*
+Copyright © 2018-2021 Neil Hemming
+*/
+
+package proxy
+
+import (
+	"net/http"
+	"net/url"
+)
+
+const (
+	// grantTypePassword is the resource owner password credentials grant.
+	grantTypePassword = "password"
+
+	// grantTypeDeviceCode is the device authorization grant (RFC 8628).
+	grantTypeDeviceCode = "urn:ietf:params:oauth:grant-type:device_code"
+
+	// grantTypeJWTBearer is the JWT bearer assertion grant (RFC 7523).
+	grantTypeJWTBearer = "urn:ietf:params:oauth:grant-type:jwt-bearer"
+
+	// grantTypeTokenExchange is the token exchange grant (RFC 8693).
+	grantTypeTokenExchange = "urn:ietf:params:oauth:grant-type:token-exchange"
+)
+
+// parseGrant extracts the grant specific details of a token request.
+// The password grant is recorded with a blank grant type.
+func (rt *runtime) parseGrant(w http.ResponseWriter, r *http.Request, tr tokenRequest) (tokenRequest, bool) {
+	tr.scopes = r.PostFormValue("scope")
+
+	switch grantType := r.PostFormValue("grant_type"); grantType {
+	case grantTypePassword:
+		tr.username = r.PostFormValue("username")
+		tr.password = r.PostFormValue("password")
+
+	case grantTypeDeviceCode:
+		tr.grantType = grantType
+		tr.deviceCode = r.PostFormValue("device_code")
+
+		if tr.deviceCode == "" {
+			rt.logError("device grant without device code")
+			replyInvalid(w)
+			return tr, false
+		}
+
+	case grantTypeJWTBearer:
+		tr.grantType = grantType
+		tr.assertion = r.PostFormValue("assertion")
+
+		if tr.assertion == "" {
+			rt.logError("jwt bearer grant without assertion")
+			replyInvalid(w)
+			return tr, false
+		}
+
+	case grantTypeTokenExchange:
+		tr.grantType = grantType
+		tr.exchange = parseTokenExchange(r)
+
+		if tr.exchange.subjectToken == "" || tr.exchange.subjectTokenType == "" {
+			rt.logError("token exchange grant without subject token")
+			replyInvalid(w)
+			return tr, false
+		}
+
+	default:
+		rt.logError("invlaid grant type: %s", grantType)
+		replyInvalid(w)
+		return tr, false
+	}
+
+	return tr, true
+}
+
+// grantValues returns the grant specific form values of a downstream token request.
+func (tr *tokenRequest) grantValues() url.Values {
+	switch tr.grantType {
+	case grantTypeDeviceCode:
+		return url.Values{
+			"grant_type":  {grantTypeDeviceCode},
+			"device_code": {tr.deviceCode},
+		}
+
+	case grantTypeJWTBearer:
+		return url.Values{
+			"grant_type": {grantTypeJWTBearer},
+			"assertion":  {tr.assertion},
+		}
+
+	case grantTypeTokenExchange:
+		return tr.exchange.values()
+	}
+
+	return url.Values{
+		"grant_type": {grantTypePassword},
+		"username":   {tr.username},
+		"password":   {tr.password},
+	}
+}
@@ -0,0 +1,710 @@
+/*
+Copyright © 2018-2021 Neil Hemming
+*/
+
+package proxy_test
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nehemming/oauthproxy/pkg/proxy"
+	"github.com/nehemming/oauthproxy/pkg/proxy/proxytest"
+	"golang.org/x/oauth2"
+)
+
+// newRequest creates a request to the proxy, the form is sent url encoded in the body.
+func newRequest(t *testing.T, p *proxytest.Proxy, method, path string, form url.Values) *http.Request {
+	t.Helper()
+
+	req, err := http.NewRequest(method, p.URL+path, strings.NewReader(form.Encode()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if form != nil {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+
+	return req
+}
+
+// send sends the request, returning the response and its body.
+func send(t *testing.T, req *http.Request) (*http.Response, string) {
+	t.Helper()
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return resp, string(body)
+}
+
+// cacheEntries returns the entries cached by the proxy.
+func cacheEntries(p *proxytest.Proxy) map[proxy.CacheKey]proxy.CacheEntry {
+	entries := make(map[proxy.CacheKey]proxy.CacheEntry)
+	p.Cache().Range(func(k proxy.CacheKey, e proxy.CacheEntry) bool {
+		entries[k] = e
+		return true
+	})
+
+	return entries
+}
+
+// replyJSON writes a provider reply with the status and JSON body.
+func replyJSON(w http.ResponseWriter, statusCode int, body string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	_, _ = w.Write([]byte(body))
+}
+
+// unsignedJWT returns a JWT with the claims and a placeholder signature.
+func unsignedJWT(claims string) string {
+	enc := base64.RawURLEncoding
+	return enc.EncodeToString([]byte("{\"alg\":\"RS256\"}")) + "." + enc.EncodeToString([]byte(claims)) + ".sig"
+}
+
+// capture holds a value seen by the provider, which runs on another goroutine.
+type capture struct {
+	lock  sync.Mutex
+	value string
+}
+
+func (c *capture) set(value string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.value = value
+}
+
+func (c *capture) get() string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.value
+}
+
+// recordingLogger records the fields of each message logged.
+type recordingLogger struct {
+	lock   sync.Mutex
+	fields []proxy.Fields
+}
+
+func (l *recordingLogger) Log(level proxy.Level, msg string, fields proxy.Fields) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.fields = append(l.fields, fields)
+}
+
+func (l *recordingLogger) logged(key, value string) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	for _, f := range l.fields {
+		if f[key] == value {
+			return true
+		}
+	}
+
+	return false
+}
+
+func TestHandlerForExpiredGetsNewToken(t *testing.T) {
+	p := proxytest.NewProxy(t)
+	form := proxytest.PasswordGrant("123", "u1", "p1")
+	form.Set("scope", "alpha bravo")
+
+	expiry := time.Now().UTC().Add(3 * time.Minute)
+	p.Provider.Handle(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(&oauth2.Token{AccessToken: "test", Expiry: expiry})
+	}))
+
+	p.Seed(form, "{\"access_token\":\"stale\"}", time.Minute)
+	p.Expire(form)
+
+	status, body := p.RequestToken(form)
+	if status != http.StatusOK {
+		t.Error("Non success status", status)
+	}
+
+	if !strings.HasPrefix(body, "{\"access_token\":\"test\",\"expiry\":\"") {
+		t.Error("body:", body)
+	}
+
+	p.AssertDownstreamCalls(1)
+}
+
+func TestHandlerClientGoneStillCaches(t *testing.T) {
+	p := proxytest.NewProxy(t)
+	form := proxytest.PasswordGrant("123", "u1", "p1")
+
+	called := make(chan struct{})
+	release := make(chan struct{})
+	var once sync.Once
+
+	p.Provider.Handle(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		once.Do(func() { close(called) })
+		<-release
+		replyJSON(w, http.StatusOK, "{\"access_token\":\"test\"}")
+	}))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	done := make(chan error, 1)
+	go func() {
+		resp, err := http.DefaultClient.Do(newRequest(t, p, "POST", proxytest.TokenPath, form).WithContext(ctx))
+		if err == nil {
+			resp.Body.Close()
+		}
+		done <- err
+	}()
+
+	// Client goes away while the downstream request is in flight
+	<-called
+	cancel()
+	err := <-done
+	close(release)
+
+	if err == nil {
+		t.Error("Reply sent to departed client")
+	}
+
+	for i := 0; i < 100; i++ {
+		if len(cacheEntries(p)) == 1 {
+			if _, body := p.RequestToken(form); body != "{\"access_token\":\"test\"}" {
+				t.Error("Unexpected cached reply", body)
+			}
+			p.AssertDownstreamCalls(1)
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	t.Error("token not cached after client left")
+}
+
+func TestHandlerInjectsClientSecret(t *testing.T) {
+	p := proxytest.NewProxy(t, func(s proxy.Settings) proxy.Settings {
+		s.Clients = map[string]proxy.ClientCredentials{
+			"MyApp": {ClientID: "real-id", ClientSecret: "real-secret"},
+		}
+		return s
+	})
+
+	p.Provider.Handle(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if u, pw, ok := r.BasicAuth(); !ok || u != "real-id" || pw != "real-secret" {
+			t.Error("Secret not injected", u, pw)
+		}
+		replyJSON(w, http.StatusOK, "{\"access_token\":\"a1\"}")
+	}))
+
+	for _, clientID := range []string{"myapp", "real-id"} {
+		form := url.Values{"client_id": {clientID}, "grant_type": {"password"}, "username": {"u1"}, "password": {"p1"}}
+		if status, body := p.RequestToken(form); status != http.StatusOK {
+			t.Error("Unexpected status", status, body)
+		}
+	}
+
+	if n := len(cacheEntries(p)); n != 1 {
+		t.Error("Alias and client ID not sharing cache entry", n)
+	}
+
+	p.AssertDownstreamCalls(1)
+}
+
+func TestHandlerDevicePollCachesOnlyFinalToken(t *testing.T) {
+	p := proxytest.NewProxy(t)
+
+	replies := []string{
+		"{\"error\":\"authorization_pending\"}",
+		"{\"error\":\"slow_down\"}",
+		"{\"access_token\":\"a1\",\"expires_in\":300}",
+	}
+
+	p.Provider.Handle(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil || r.PostFormValue("device_code") != "dc1" {
+			t.Error("Device code not forwarded", err)
+		}
+
+		// The provider counts the request before handling it
+		n := p.Provider.Calls() - 1
+		if n < 2 {
+			replyJSON(w, http.StatusBadRequest, replies[n])
+		} else {
+			replyJSON(w, http.StatusOK, replies[len(replies)-1])
+		}
+	}))
+
+	form := url.Values{
+		"client_id":   {"cli"},
+		"grant_type":  {"urn:ietf:params:oauth:grant-type:device_code"},
+		"device_code": {"dc1"},
+	}
+
+	for i := 0; i < 4; i++ {
+		expected := replies[len(replies)-1]
+		if i < len(replies) {
+			expected = replies[i]
+		}
+
+		if _, body := p.RequestToken(form); body != expected {
+			t.Error("Unexpected reply", i, body)
+		}
+	}
+
+	p.AssertDownstreamCalls(3)
+}
+
+func TestHandlerDeviceCodeNotCached(t *testing.T) {
+	p := proxytest.NewProxy(t)
+
+	p.Provider.Handle(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/oauth2/device/code" {
+			t.Error("Unexpected path", r.URL.Path)
+		}
+		if err := r.ParseForm(); err != nil || r.PostFormValue("scope") != "openid" || r.PostFormValue("audience") != "api" {
+			t.Error("Form not forwarded", err, r.PostForm)
+		}
+		replyJSON(w, http.StatusOK, "{\"device_code\":\"dc1\",\"user_code\":\"ABCD\"}")
+	}))
+
+	form := url.Values{"client_id": {"cli"}, "scope": {"openid"}, "audience": {"api"}}
+	for i := 0; i < 2; i++ {
+		if resp, body := send(t, newRequest(t, p, "POST", "/oauth2/device/code", form)); resp.StatusCode != http.StatusOK {
+			t.Error("Unexpected status", resp.StatusCode, body)
+		}
+	}
+
+	if n := len(cacheEntries(p)); n != 0 {
+		t.Error("Device code response cached", n)
+	}
+
+	p.AssertDownstreamCalls(2)
+}
+
+func TestHandlerCachesDocument(t *testing.T) {
+	p := proxytest.NewProxy(t)
+
+	p.Provider.Handle(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" || r.URL.Path != "/keys" {
+			t.Error("Unexpected downstream request", r.Method, r.URL)
+		}
+		w.Header().Set("Cache-Control", "max-age=600")
+		replyJSON(w, http.StatusOK, "{\"keys\":[]}")
+	}))
+
+	for i := 0; i < 2; i++ {
+		if resp, body := send(t, newRequest(t, p, "GET", "/keys", nil)); resp.StatusCode != http.StatusOK || body != "{\"keys\":[]}" {
+			t.Error("Unexpected reply", resp.StatusCode, body)
+		}
+	}
+
+	p.AssertDownstreamCalls(1)
+
+	for _, e := range cacheEntries(p) {
+		if d := time.Until(e.Expiry); d < 9*time.Minute || d > 10*time.Minute {
+			t.Error("Max age not honoured", d)
+		}
+	}
+}
+
+func TestHandlerTokenExchangeCachedPerAudience(t *testing.T) {
+	p := proxytest.NewProxy(t)
+
+	p.Provider.Handle(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/oauth2/revoke" {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+
+		if err := r.ParseForm(); err != nil || r.PostFormValue("subject_token") == "" || r.PostFormValue("audience") == "" {
+			t.Error("Exchange not forwarded", err, r.PostForm)
+		}
+		replyJSON(w, http.StatusOK, fmt.Sprintf("{\"access_token\":\"x-%s\",\"expires_in\":3600}", r.PostFormValue("audience")))
+	}))
+
+	// Subject token expires before the exchanged token
+	subject := unsignedJWT(fmt.Sprintf("{\"iss\":\"p\",\"sub\":\"u1\",\"exp\":%d}", time.Now().Add(time.Minute).Unix()))
+
+	for _, audience := range []string{"api1", "api2", "api1"} {
+		form := url.Values{
+			"grant_type":         {"urn:ietf:params:oauth:grant-type:token-exchange"},
+			"client_id":          {"svc"},
+			"client_secret":      {"svc-secret"},
+			"subject_token":      {subject},
+			"subject_token_type": {"urn:ietf:params:oauth:token-type:access_token"},
+			"audience":           {audience},
+			"scope":              {"read"},
+		}
+
+		if _, body := p.RequestToken(form); body != "{\"access_token\":\"x-"+audience+"\",\"expires_in\":3600}" {
+			t.Error("Unexpected reply", body)
+		}
+	}
+
+	p.AssertDownstreamCalls(2)
+
+	for _, e := range cacheEntries(p) {
+		if time.Until(e.Expiry) > time.Minute {
+			t.Error("Expiry not bounded by subject token", e.Expiry)
+		}
+	}
+
+	// Revoking the subject token evicts the tokens exchanged for it
+	if resp, body := send(t, newRequest(t, p, "POST", "/oauth2/revoke", url.Values{"token": {subject}})); resp.StatusCode != http.StatusOK {
+		t.Error("Revoke failed", resp.StatusCode, body)
+	}
+
+	if n := len(cacheEntries(p)); n != 0 {
+		t.Error("Exchanged tokens not evicted with subject", n)
+	}
+}
+
+func TestHandlerIdentityToken(t *testing.T) {
+	p := proxytest.NewProxy(t, func(s proxy.Settings) proxy.Settings {
+		s.Identities = map[string]proxy.Identity{
+			"Admin-User": {Username: "admin", Password: "pw", ClientID: "123", ClientSecret: "456", Scopes: []string{"alpha", "bravo"}},
+		}
+		return s
+	})
+
+	p.Provider.Handle(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil || r.URL.Path != "/token" ||
+			r.PostFormValue("username") != "admin" || r.PostFormValue("password") != "pw" {
+			t.Error("Unexpected downstream request", r.URL, r.PostForm, err)
+		}
+		replyJSON(w, http.StatusOK, "{\"access_token\":\"a1\"}")
+	}))
+
+	if resp, body := send(t, newRequest(t, p, "GET", "/identities/admin-user/token", nil)); resp.StatusCode != http.StatusOK || body != "{\"access_token\":\"a1\"}" {
+		t.Error("Unexpected reply", resp.StatusCode, body)
+	}
+
+	// An equivalent inbound request shares the cache entry
+	req := newRequest(t, p, "POST", "/token", url.Values{
+		"grant_type": {"password"},
+		"username":   {"admin"},
+		"password":   {"pw"},
+		"scope":      {"alpha bravo"},
+	})
+	req.SetBasicAuth("123", "456")
+
+	if resp, body := send(t, req); resp.StatusCode != http.StatusOK {
+		t.Error("Unexpected status", resp.StatusCode, body)
+	}
+
+	p.AssertDownstreamCalls(1)
+}
+
+// introspect posts an introspection request for the token authenticated as the resource server.
+func introspect(t *testing.T, p *proxytest.Proxy, token string) (active bool, exp int64) {
+	t.Helper()
+
+	req := newRequest(t, p, "POST", "/oauth2/introspect", url.Values{"token": {token}})
+	req.SetBasicAuth("rs", "rs-secret")
+
+	_, body := send(t, req)
+
+	var result struct {
+		Active bool  `json:"active"`
+		Exp    int64 `json:"exp"`
+	}
+	if err := json.Unmarshal([]byte(body), &result); err != nil {
+		t.Fatal("decode", err, body)
+	}
+
+	return result.Active, result.Exp
+}
+
+func TestHandlerIntrospectUnknownTokenInactive(t *testing.T) {
+	p := proxytest.NewProxy(t)
+
+	if active, _ := introspect(t, p, "unknown"); active {
+		t.Error("Unknown token active")
+	}
+
+	p.AssertDownstreamCalls(0)
+}
+
+func TestHandlerIntrospectFallbackCached(t *testing.T) {
+	p := proxytest.NewProxy(t, func(s proxy.Settings) proxy.Settings {
+		s.IntrospectionFallback = true
+		return s
+	})
+
+	exp := time.Now().Add(time.Minute).Unix()
+
+	p.Provider.Handle(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/oauth2/introspect" {
+			t.Error("Unexpected path", r.URL.Path)
+		}
+		if u, _, _ := r.BasicAuth(); u != "rs" {
+			t.Error("Client auth not forwarded")
+		}
+		replyJSON(w, http.StatusOK, fmt.Sprintf("{\"active\":true,\"exp\":%d}", exp))
+	}))
+
+	for i := 0; i < 2; i++ {
+		if active, _ := introspect(t, p, "other"); !active {
+			t.Error("Fallback not active")
+		}
+	}
+
+	p.AssertDownstreamCalls(1)
+
+	for _, e := range cacheEntries(p) {
+		if e.Expiry.Unix() != exp {
+			t.Error("Expiry not bounded by exp", e.Expiry)
+		}
+	}
+}
+
+func TestHandlerRequestIDPropagatedDownstream(t *testing.T) {
+	logger := &recordingLogger{}
+	p := proxytest.NewProxy(t, func(s proxy.Settings) proxy.Settings {
+		return s.WithLogger(logger)
+	})
+
+	var downstreamID capture
+	p.Provider.Handle(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		downstreamID.set(r.Header.Get("X-Request-ID"))
+		replyJSON(w, http.StatusOK, "{\"keys\":[]}")
+	}))
+
+	req := newRequest(t, p, "GET", "/keys", nil)
+	req.Header.Set("X-Request-ID", "abc-123")
+	resp, _ := send(t, req)
+
+	if id := downstreamID.get(); id != "abc-123" {
+		t.Error("Request ID not passed downstream", id)
+	}
+
+	if id := resp.Header.Get("X-Request-ID"); id != "abc-123" {
+		t.Error("Request ID not echoed", id)
+	}
+
+	if !logger.logged("request_id", "abc-123") {
+		t.Error("Request ID not logged")
+	}
+
+	resp, _ = send(t, newRequest(t, p, "GET", "/keys", nil))
+	if id := resp.Header.Get("X-Request-ID"); len(id) != 32 {
+		t.Error("Request ID not generated", id)
+	}
+}
+
+func TestHandlerTraceparentPassedThroughWithoutTracer(t *testing.T) {
+	p := proxytest.NewProxy(t)
+
+	var downstreamParent capture
+	p.Provider.Handle(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		downstreamParent.set(r.Header.Get("traceparent"))
+		replyJSON(w, http.StatusOK, "{\"keys\":[]}")
+	}))
+
+	inbound := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	req := newRequest(t, p, "GET", "/keys", nil)
+	req.Header.Set("traceparent", inbound)
+	send(t, req)
+
+	if parent := downstreamParent.get(); parent != inbound {
+		t.Error("Traceparent not passed through", parent)
+	}
+}
+
+func TestHandlerReloadKeepsInjectedClientEntries(t *testing.T) {
+	var settings proxy.Settings
+	p := proxytest.NewProxy(t, func(s proxy.Settings) proxy.Settings {
+		s.Clients = map[string]proxy.ClientCredentials{"app": {ClientID: "c1", ClientSecret: "s1"}}
+		s.Identities = map[string]proxy.Identity{"admin": {ClientID: "app", Username: "u2", Password: "p2", TokenPath: "/token"}}
+		settings = s
+		return s
+	})
+
+	request := func() {
+		form := url.Values{"grant_type": {"password"}, "client_id": {"app"}, "username": {"u1"}, "password": {"p1"}}
+		if resp, body := send(t, newRequest(t, p, "POST", "/token", form)); resp.StatusCode != http.StatusOK {
+			t.Error("Unexpected status", resp.StatusCode, body)
+		}
+
+		if resp, body := send(t, newRequest(t, p, "GET", "/identities/admin/token", nil)); resp.StatusCode != http.StatusOK {
+			t.Error("Unexpected identity status", resp.StatusCode, body)
+		}
+	}
+
+	request()
+
+	// Rotating the client secret replaces the registered client but keeps its entries
+	next := settings
+	next.Clients = map[string]proxy.ClientCredentials{"app": {ClientID: "c1", ClientSecret: "s2"}}
+	if err := p.Reload(next); err != nil {
+		t.Fatal(err)
+	}
+
+	request()
+
+	p.AssertDownstreamCalls(2)
+
+	if n := len(cacheEntries(p)); n != 2 {
+		t.Error("Injected client entries not kept across reload", n)
+	}
+}
+
+func TestHandlerRevokeForwardsAndEvicts(t *testing.T) {
+	p := proxytest.NewProxy(t)
+	form := proxytest.PasswordGrant("123", "u1", "p1")
+	p.Seed(form, "{\"access_token\":\"a1\"}", time.Minute)
+
+	p.Provider.Handle(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/oauth2/revoke" {
+			t.Error("Unexpected path", r.URL.Path)
+		}
+		if err := r.ParseForm(); err != nil || r.PostFormValue("token") != "a1" {
+			t.Error("Token not forwarded", err)
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	for i := 0; i < 2; i++ {
+		req := newRequest(t, p, "POST", "/oauth2/revoke", url.Values{"token": {"a1"}, "token_type_hint": {"access_token"}})
+		req.SetBasicAuth("123", "456")
+
+		if resp, body := send(t, req); resp.StatusCode != http.StatusOK {
+			t.Error("Unexpected status", resp.StatusCode, body)
+		}
+	}
+
+	// Revocations are never cached
+	p.AssertDownstreamCalls(2)
+
+	if n := len(cacheEntries(p)); n != 0 {
+		t.Error("Token not evicted", n)
+	}
+}
+
+func TestHandlerRevokeRejectedKeepsEntries(t *testing.T) {
+	p := proxytest.NewProxy(t)
+	form := proxytest.PasswordGrant("123", "u1", "p1")
+	p.Seed(form, "{\"access_token\":\"a1\"}", time.Minute)
+
+	p.Provider.Reply(http.StatusUnauthorized, "{\"error\":\"invalid_client\"}")
+
+	if resp, body := send(t, newRequest(t, p, "POST", "/oauth2/revoke", url.Values{"token": {"a1"}})); resp.StatusCode != http.StatusUnauthorized {
+		t.Error("Unexpected status", resp.StatusCode, body)
+	}
+
+	// The seeded token is still answered from the cache
+	if _, body := p.RequestToken(form); body != "{\"access_token\":\"a1\"}" {
+		t.Error("Rejected revocation evicted the token", body)
+	}
+
+	p.AssertDownstreamCalls(1)
+}
+
+func TestHandlerCachesUserinfo(t *testing.T) {
+	p := proxytest.NewProxy(t)
+
+	// Issue a token that expires before the cache TTL
+	p.Seed(proxytest.PasswordGrant("123", "u1", "p1"), "{\"access_token\":\"a1\",\"expires_in\":120}", time.Hour)
+
+	p.Provider.Handle(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/oauth2/userinfo" || r.Header.Get("Authorization") != "Bearer a1" {
+			t.Error("Unexpected downstream request", r.URL, r.Header)
+		}
+		replyJSON(w, http.StatusOK, "{\"sub\":\"u1\"}")
+	}))
+
+	for i := 0; i < 2; i++ {
+		req := newRequest(t, p, "GET", "/oauth2/userinfo", nil)
+		req.Header.Set("Authorization", "Bearer a1")
+
+		if resp, body := send(t, req); resp.StatusCode != http.StatusOK || body != "{\"sub\":\"u1\"}" {
+			t.Error("Unexpected reply", resp.StatusCode, body)
+		}
+	}
+
+	p.AssertDownstreamCalls(1)
+
+	for k, e := range cacheEntries(p) {
+		if d := time.Until(e.Expiry); k.Path() == "/oauth2/userinfo" && d > 2*time.Minute {
+			t.Error("Expiry not bounded by token", d)
+		}
+	}
+}
+
+func TestHandlerAccessLogRecordsOutcomes(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	p := proxytest.NewProxy(t, func(s proxy.Settings) proxy.Settings {
+		s.AccessLog = proxy.AccessLogSettings{Output: path, Format: proxy.AccessLogJSON, HashUsernames: true}
+		return s
+	})
+
+	form := url.Values{"grant_type": {"password"}, "username": {"u1"}, "password": {"secret-pw"}}
+	for i := 0; i < 2; i++ {
+		req := newRequest(t, p, "POST", "/token", form)
+		req.SetBasicAuth("c1", "client-secret")
+		send(t, req)
+	}
+
+	// Closing the proxy flushes the log
+	p.Close()
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if strings.Contains(string(b), "secret") {
+		t.Error("Secrets logged", string(b))
+	}
+
+	lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+	if len(lines) != 2 {
+		t.Fatal("Expected 2 lines got", len(lines))
+	}
+
+	type line struct {
+		Method           string `json:"method"`
+		Path             string `json:"path"`
+		Status           int    `json:"status"`
+		ClientID         string `json:"client_id"`
+		Username         string `json:"username"`
+		Cache            string `json:"cache"`
+		DownstreamStatus int    `json:"downstream_status"`
+	}
+
+	var miss, hit line
+	_ = json.Unmarshal([]byte(lines[0]), &miss)
+	_ = json.Unmarshal([]byte(lines[1]), &hit)
+
+	if miss.Cache != "miss" || miss.DownstreamStatus != http.StatusOK || miss.Status != http.StatusOK {
+		t.Error("Unexpected miss line", lines[0])
+	}
+
+	if hit.Cache != "hit" || hit.DownstreamStatus != 0 {
+		t.Error("Unexpected hit line", lines[1])
+	}
+
+	if miss.ClientID != "c1" || miss.Username == "" || miss.Username == "u1" || miss.Method != "POST" || miss.Path != "/token" {
+		t.Error("Unexpected request fields", lines[0])
+	}
+}
@@ -0,0 +1,110 @@
+/*
+Copyright © 2018-2021 Neil Hemming
+*/
+
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	multierror "github.com/hashicorp/go-multierror"
+)
+
+const (
+	// identitiesPrefix is the path prefix of named identity token requests.
+	identitiesPrefix = "/identities/"
+
+	// defaultIdentityTokenPath is the downstream path used for identities without a token path.
+	defaultIdentityTokenPath = "/token"
+)
+
+type (
+	// Identity is a named set of credentials held by the proxy.
+	// Tokens for the identity are obtained with GET /identities/{name}/token, so callers never handle the password.
+	Identity struct {
+		// Username the resource owner's user name
+		Username string
+
+		// Password the resource owner's password
+		Password string
+
+		// ClientID is the client ID, or the alias of a client held by the proxy
+		ClientID string
+
+		// ClientSecret is the client secret, blank if the client is held by the proxy
+		ClientSecret string
+
+		// Scopes are the requested scopes
+		Scopes []string
+
+		// TokenPath is appended to the endpoint to form the token url, ignored when discovery is in use
+		TokenPath string
+	}
+
+	// identityRegistry holds the named identities, keyed by lower case name.
+	identityRegistry map[string]Identity
+)
+
+// newIdentityRegistry creates the registry of named identities.
+func newIdentityRegistry(identities map[string]Identity) (identityRegistry, error) {
+	var result error
+
+	registry := make(identityRegistry)
+
+	for name, identity := range identities {
+		if identity.Username == "" {
+			result = multierror.Append(result, fmt.Errorf("identity %s: %w", name, errors.New("username cannot be blank")))
+			continue
+		}
+
+		if identity.TokenPath == "" {
+			identity.TokenPath = defaultIdentityTokenPath
+		}
+
+		registry[strings.ToLower(name)] = identity
+	}
+
+	return registry, result
+}
+
+// identityName extracts the identity name from a /identities/{name}/token path.
+func identityName(path string) (string, bool) {
+	if !strings.HasPrefix(path, identitiesPrefix) || !strings.HasSuffix(path, "/token") {
+		return "", false
+	}
+
+	name := strings.TrimSuffix(strings.TrimPrefix(path, identitiesPrefix), "/token")
+	if name == "" || strings.Contains(name, "/") {
+		return "", false
+	}
+
+	return name, true
+}
+
+// parseIdentityRequest builds the password grant token request for a named identity.
+// The request is keyed exactly as an equivalent inbound token request so the two share cache entries.
+func (rt *runtime) parseIdentityRequest(w http.ResponseWriter, name string) (tokenRequest, bool) {
+	identity, ok := rt.config().identities[strings.ToLower(name)]
+	if !ok {
+		rt.logError("unknown identity %s", name)
+		replyNotFound(w)
+		return tokenRequest{}, false
+	}
+
+	tr := tokenRequest{
+		path:         identity.TokenPath,
+		clientID:     identity.ClientID,
+		clientSecret: identity.ClientSecret,
+		username:     identity.Username,
+		password:     identity.Password,
+		scopes:       strings.Join(identity.Scopes, " "),
+		authMode:     authInHeader,
+	}
+
+	rt.injectClient(&tr)
+
+	return tr, true
+}
@@ -0,0 +1,47 @@
+/*
+Copyright © 2018-2021 Neil Hemming
+*/
+
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestIdentityName(t *testing.T) {
+	if name, ok := identityName("/identities/admin-user/token"); !ok || name != "admin-user" {
+		t.Error("Name not extracted", name, ok)
+	}
+
+	for _, p := range []string{"/identities//token", "/identities/a/b/token", "/identities/a", "/token"} {
+		if name, ok := identityName(p); ok {
+			t.Error("Unexpected name", p, name)
+		}
+	}
+}
+
+func TestHandlerFuncUnknownIdentityNotFound(t *testing.T) {
+	settings := DefaultSettings().WithEndpoint("https://p.com")
+	rt := newRuntime(context.Background(), settings)
+	defer rt.close()
+
+	req, _ := http.NewRequest("GET", "http:/identities/nobody/token", nil)
+	w := httptest.NewRecorder()
+	rt.handleRequest(w, req)
+
+	if w.Code != http.StatusNotFound {
+		t.Error("Unexpected status", w.Code)
+	}
+}
+
+func TestValidateSettingsBadIdentityFails(t *testing.T) {
+	settings := DefaultSettings().WithEndpoint("test")
+	settings.Identities = map[string]Identity{"x": {Password: "pw"}}
+
+	if err := settings.validateSettings(); err == nil {
+		t.Error("Identity without username not caught")
+	}
+}
@@ -0,0 +1,161 @@
+/*
+Copyright © 2018-2021 Neil Hemming
+*/
+
+package proxy
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/nehemming/cirocket/pkg/loggee"
+)
+
+type (
+	// introspection is a token introspection response (RFC 7662).
+	introspection struct {
+		Active    bool   `json:"active"`
+		Scope     string `json:"scope,omitempty"`
+		ClientID  string `json:"client_id,omitempty"`
+		Username  string `json:"username,omitempty"`
+		TokenType string `json:"token_type,omitempty"`
+		Exp       int64  `json:"exp,omitempty"`
+	}
+)
+
+// isIntrospectPath reports if the path is for token introspection.
+func isIntrospectPath(path string) bool {
+	return strings.HasSuffix(path, "/introspect")
+}
+
+// findIssued searches the unexpired cache entries for a valid token issued by the proxy.
+// The token may be either the access or refresh token, the info returned describes the token matched.
+// Refresh tokens are reported without a type or expiry as these are only known for the access token.
+func (rt *runtime) findIssued(token string, now time.Time) (tokenRequest, tokenInfo, bool) {
+	var (
+		found tokenRequest
+		info  tokenInfo
+		ok    bool
+	)
+
+	rt.cache.Range(func(k CacheKey, e CacheEntry) bool {
+		if k.tr.kind != tokenKind || e.StatusCode != http.StatusOK || e.Expiry.Before(now) {
+			return true
+		}
+
+		if e.info.accessToken != token && e.info.refreshToken != token {
+			return true
+		}
+
+		if e.info.accessToken == token && !e.info.expiry.IsZero() && e.info.expiry.Before(now) {
+			return true
+		}
+
+		found, info, ok = k.tr, e.info, true
+		if e.info.accessToken != token {
+			info.tokenType, info.expiry = "", time.Time{}
+		}
+		return false
+	})
+
+	return found, info, ok
+}
+
+// introspectionAuthorized reports if the caller may introspect tokens issued to key's client.
+// Callers authenticated by the introspect route may introspect any token, otherwise the caller
+// must present the credentials the token was requested with.
+func (rt *runtime) introspectionAuthorized(tr, key tokenRequest) bool {
+	if rt.routeAuthenticated(RouteIntrospect) {
+		return true
+	}
+
+	if key.clientAlias != "" {
+		return tr.clientAlias == key.clientAlias
+	}
+
+	return tr.clientAlias == "" && tr.authMode != authWithAssertion && key.authMode != authWithAssertion &&
+		key.clientSecret != "" && tr.clientID == key.clientID &&
+		subtle.ConstantTimeCompare([]byte(tr.clientSecret), []byte(key.clientSecret)) == 1
+}
+
+// introspectLocally answers an introspection request from the cache.
+// Returns false if the request needs to be passed to the provider.
+func (rt *runtime) introspectLocally(w http.ResponseWriter, tr tokenRequest) bool {
+	now := time.Now().UTC()
+
+	// RFC 7662 requires the caller to authenticate
+	if tr.clientID == "" && tr.client == nil && !rt.routeAuthenticated(RouteIntrospect) {
+		rt.logError("%s request without client authentication", tr.path)
+		replyUnauthorized(w)
+		return true
+	}
+
+	key, info, ok := rt.findIssued(tr.token, now)
+	if ok && !rt.introspectionAuthorized(tr, key) {
+		ok = false
+	}
+
+	if !ok {
+		if rt.config().introspectionFallback {
+			return false
+		}
+
+		replyIntrospection(w, introspection{})
+		return true
+	}
+
+	result := introspection{
+		Active:    true,
+		Scope:     info.scope,
+		ClientID:  key.clientID,
+		Username:  key.username,
+		TokenType: info.tokenType,
+	}
+
+	if result.Scope == "" {
+		result.Scope = key.scopes
+	}
+
+	if !info.expiry.IsZero() {
+		result.Exp = info.expiry.Unix()
+	}
+
+	replyIntrospection(w, result)
+	return true
+}
+
+// introspectionURL returns the downstream introspection endpoint.
+func (rt *runtime) introspectionURL(tr tokenRequest) string {
+	if md := rt.providerMetadata(); md != nil && md.IntrospectionEndpoint != "" {
+		return md.IntrospectionEndpoint
+	}
+
+	return rt.config().endpoint + tr.path
+}
+
+// introspectionExpiry limits the cache expiry of an introspection response to the expiry of the token.
+func introspectionExpiry(body []byte, expiry time.Time) time.Time {
+	var result introspection
+
+	if err := json.Unmarshal(body, &result); err != nil || !result.Active || result.Exp == 0 {
+		return expiry
+	}
+
+	if exp := time.Unix(result.Exp, 0).UTC(); exp.Before(expiry) {
+		return exp
+	}
+
+	return expiry
+}
+
+func replyIntrospection(w http.ResponseWriter, result introspection) {
+	w.Header().Set("Cache-Control", "no-store")
+
+	err := replyWithJSON(w, http.StatusOK, result)
+	if err != nil {
+		loggee.Warn(err.Error())
+	}
+}
@@ -0,0 +1,145 @@
+/*
+Copyright © 2018-2021 Neil Hemming
+*/
+
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newIntrospectRequest(token string) *http.Request {
+	req, _ := http.NewRequest("POST", "http:/oauth2/introspect", strings.NewReader("token="+token))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth("rs", "rs-secret")
+	return req
+}
+
+func decodeIntrospection(t *testing.T, w *httptest.ResponseRecorder) introspection {
+	t.Helper()
+
+	var result introspection
+	if err := json.NewDecoder(w.Body).Decode(&result); err != nil {
+		t.Fatal("decode", err)
+	}
+	return result
+}
+
+func TestParseTokenResponseExpiresIn(t *testing.T) {
+	now := time.Date(2020, 0o1, 0o1, 0o1, 0o0, 0o0, 0o0, time.UTC)
+
+	info, ok := parseTokenResponse([]byte("{\"access_token\":\"a\",\"refresh_token\":\"r\",\"expires_in\":300,\"scope\":\"s\"}"), now)
+	if !ok {
+		t.Fatal("not parsed")
+	}
+
+	if info.accessToken != "a" || info.refreshToken != "r" || info.scope != "s" || !info.expiry.Equal(now.Add(5*time.Minute)) {
+		t.Error("Unexpected info", info)
+	}
+
+	if _, ok := parseTokenResponse([]byte("{\"error\":\"invalid_grant\"}"), now); ok {
+		t.Error("Error response parsed")
+	}
+}
+
+func TestIntrospectIssuedToken(t *testing.T) {
+	settings := DefaultSettings().WithEndpoint("test")
+	rt := newRuntime(context.Background(), settings)
+	defer rt.close()
+
+	key := tokenRequest{
+		path:         "/oauth2/token",
+		clientID:     "rs",
+		clientSecret: "rs-secret",
+		username:     "u1",
+		scopes:       "alpha bravo",
+	}
+	rt.update(key, http.Header{}, []byte("{\"access_token\":\"tok\",\"refresh_token\":\"ref\",\"token_type\":\"bearer\",\"expires_in\":300}"), http.StatusOK)
+
+	w := httptest.NewRecorder()
+	rt.handleRequest(w, newIntrospectRequest("tok"))
+
+	result := decodeIntrospection(t, w)
+	if !result.Active || result.ClientID != "rs" || result.Username != "u1" || result.Scope != "alpha bravo" ||
+		result.Exp == 0 || result.TokenType != "bearer" {
+		t.Error("Unexpected introspection", result)
+	}
+
+	w = httptest.NewRecorder()
+	rt.handleRequest(w, newIntrospectRequest("ref"))
+
+	result = decodeIntrospection(t, w)
+	if !result.Active || result.Exp != 0 || result.TokenType != "" {
+		t.Error("Unexpected refresh token introspection", result)
+	}
+}
+
+func TestIntrospectExpiredEntryInactive(t *testing.T) {
+	settings := DefaultSettings().WithEndpoint("test")
+	rt := newRuntime(context.Background(), settings)
+	defer rt.close()
+
+	key := tokenRequest{path: "/oauth2/token", clientID: "rs", clientSecret: "rs-secret", username: "u1"}
+	rt.update(key, http.Header{}, []byte("{\"access_token\":\"tok\",\"refresh_token\":\"ref\"}"), http.StatusOK)
+
+	e, _ := rt.cache.Get(CacheKey{tr: key})
+	e.Expiry = time.Now().UTC().Add(-time.Second)
+	rt.cache.Set(CacheKey{tr: key}, e)
+
+	for _, token := range []string{"tok", "ref"} {
+		w := httptest.NewRecorder()
+		rt.handleRequest(w, newIntrospectRequest(token))
+
+		if result := decodeIntrospection(t, w); result.Active {
+			t.Error("Expired entry active", token, result)
+		}
+	}
+}
+
+func TestIntrospectRequiresCallerAuthentication(t *testing.T) {
+	settings := DefaultSettings().WithEndpoint("test")
+	rt := newRuntime(context.Background(), settings)
+	defer rt.close()
+
+	key := tokenRequest{path: "/oauth2/token", clientID: "123", clientSecret: "456", username: "u1"}
+	rt.update(key, http.Header{}, []byte("{\"access_token\":\"tok\",\"expires_in\":300}"), http.StatusOK)
+
+	// No credentials
+	req, _ := http.NewRequest("POST", "http:/oauth2/introspect", strings.NewReader("token=tok"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	w := httptest.NewRecorder()
+	rt.handleRequest(w, req)
+	if w.Code != http.StatusUnauthorized {
+		t.Error("Unauthenticated caller not rejected", w.Code)
+	}
+
+	// Credentials of another client
+	w = httptest.NewRecorder()
+	rt.handleRequest(w, newIntrospectRequest("tok"))
+	if result := decodeIntrospection(t, w); result.Active {
+		t.Error("Other client's token reported", result)
+	}
+
+	// Callers authenticated by the route may introspect any token
+	settings.CallerAuth.APIKeys = []string{"key"}
+	settings.CallerAuth.Routes = map[string][]string{RouteIntrospect: {AuthAPIKey}}
+	if err := rt.reload(settings); err != nil {
+		t.Fatal(err)
+	}
+
+	req = newIntrospectRequest("tok")
+	req.Header.Set(apiKeyHeader, "key")
+
+	w = httptest.NewRecorder()
+	rt.handleRequest(w, req)
+	if result := decodeIntrospection(t, w); !result.Active || result.ClientID != "123" {
+		t.Error("Route authenticated caller refused", result)
+	}
+}
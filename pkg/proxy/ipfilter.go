@@ -0,0 +1,174 @@
+/*
+Copyright © 2018-2021 Neil Hemming
+*/
+
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+
+	multierror "github.com/hashicorp/go-multierror"
+)
+
+type (
+	// IPFilterSettings restricts which source addresses may use the proxy.
+	// Entries are CIDR ranges or single IP addresses.
+	IPFilterSettings struct {
+		// Allow lists the source ranges permitted to use the proxy, when empty all sources not denied are allowed
+		Allow []string
+
+		// Deny lists the source ranges rejected, deny takes priority over allow
+		Deny []string
+
+		// TrustedProxies lists the ranges of proxies whose X-Forwarded-For header is used to find the source address
+		TrustedProxies []string
+	}
+
+	// ipFilter is the parsed form of the ip filter settings.
+	ipFilter struct {
+		allow          []*net.IPNet
+		deny           []*net.IPNet
+		trustedProxies []*net.IPNet
+	}
+)
+
+func (ips IPFilterSettings) validateSettings() error {
+	_, err := newIPFilter(ips)
+	return err
+}
+
+// newIPFilter parses the filter settings.
+func newIPFilter(ips IPFilterSettings) (*ipFilter, error) {
+	var result error
+
+	parse := func(name string, list []string) []*net.IPNet {
+		nets, err := parseNets(list)
+		if err != nil {
+			result = multierror.Append(result, fmt.Errorf("%s: %w", name, err))
+		}
+		return nets
+	}
+
+	filter := &ipFilter{
+		allow:          parse("allow", ips.Allow),
+		deny:           parse("deny", ips.Deny),
+		trustedProxies: parse("trusted proxies", ips.TrustedProxies),
+	}
+
+	return filter, result
+}
+
+// parseNets parses a list of CIDR ranges, single addresses are treated as a range of one.
+func parseNets(list []string) ([]*net.IPNet, error) {
+	var result error
+	var nets []*net.IPNet
+
+	for _, s := range list {
+		s = strings.TrimSpace(s)
+
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				result = multierror.Append(result, fmt.Errorf("invalid address %s", s))
+				continue
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			result = multierror.Append(result, err)
+			continue
+		}
+		nets = append(nets, n)
+	}
+
+	return nets, result
+}
+
+// containsIP reports if the ip is in any of the ranges.
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// sourceIP returns the address of the caller.  When the connection is from a trusted proxy
+// the X-Forwarded-For header is walked from the nearest hop back to the first untrusted address.
+func (f *ipFilter) sourceIP(r *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil || !containsIP(f.trustedProxies, ip) {
+		return ip
+	}
+
+	var hops []string
+	for _, header := range r.Header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(header, ",")...)
+	}
+
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := net.ParseIP(strings.TrimSpace(hops[i]))
+		if hop == nil {
+			// A malformed entry cannot be trusted, use the last good address
+			return ip
+		}
+
+		ip = hop
+		if !containsIP(f.trustedProxies, ip) {
+			return ip
+		}
+	}
+
+	return ip
+}
+
+// permitted reports if the source address may use the proxy.
+func (f *ipFilter) permitted(ip net.IP) bool {
+	if ip == nil {
+		return len(f.allow) == 0 && len(f.deny) == 0
+	}
+
+	if containsIP(f.deny, ip) {
+		return false
+	}
+
+	return len(f.allow) == 0 || containsIP(f.allow, ip)
+}
+
+// rejectedCount returns the number of requests rejected by the ip filter.
+func (rt *runtime) rejectedCount() uint64 {
+	return atomic.LoadUint64(&rt.rejected)
+}
+
+// filterSource checks the caller's source address is permitted, replying Forbidden if not.
+func (rt *runtime) filterSource(w http.ResponseWriter, r *http.Request) bool {
+	filter := rt.config().ipFilter
+
+	ip := filter.sourceIP(r)
+	if filter.permitted(ip) {
+		return true
+	}
+
+	count := atomic.AddUint64(&rt.rejected, 1)
+	rt.logError("source %s rejected for %s, %d rejected", ip, r.URL.Path, count)
+	replyForbidden(w)
+	return false
+}
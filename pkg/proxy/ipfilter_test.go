@@ -0,0 +1,93 @@
+/*
+Copyright © 2018-2021 Neil Hemming
+*/
+
+package proxy
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestNewIPFilterValidates(t *testing.T) {
+	_, err := newIPFilter(IPFilterSettings{
+		Allow:          []string{"10.0.0.0/8", "192.168.1.1", "::1"},
+		Deny:           []string{"10.0.0.0/33"},
+		TrustedProxies: []string{"proxy"},
+	})
+
+	if err == nil {
+		t.Error("Bad ranges not caught")
+	}
+}
+
+func TestIPFilterPermitted(t *testing.T) {
+	f, err := newIPFilter(IPFilterSettings{
+		Allow: []string{"10.0.0.0/8", "192.168.1.1"},
+		Deny:  []string{"10.1.0.0/16"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[string]bool{
+		"10.2.3.4":    true,
+		"192.168.1.1": true,
+		"192.168.1.2": false,
+		"10.1.2.3":    false,
+		"::1":         false,
+	}
+
+	for ip, expected := range tests {
+		if f.permitted(net.ParseIP(ip)) != expected {
+			t.Errorf("%s expected %v", ip, expected)
+		}
+	}
+}
+
+func TestIPFilterSourceIP(t *testing.T) {
+	f, _ := newIPFilter(IPFilterSettings{TrustedProxies: []string{"127.0.0.1", "10.0.0.0/8"}})
+
+	req := httptest.NewRequest("POST", "/token", nil)
+	req.RemoteAddr = "192.168.1.5:1234"
+	req.Header.Set("X-Forwarded-For", "1.2.3.4")
+
+	if ip := f.sourceIP(req); ip.String() != "192.168.1.5" {
+		t.Error("Untrusted forwarded for used", ip)
+	}
+
+	req.RemoteAddr = "127.0.0.1:1234"
+	req.Header.Set("X-Forwarded-For", "6.6.6.6, 1.2.3.4, 10.0.0.2")
+
+	if ip := f.sourceIP(req); ip.String() != "1.2.3.4" {
+		t.Error("Expected first untrusted hop", ip)
+	}
+
+	req.Header.Set("X-Forwarded-For", "junk, 10.0.0.2")
+
+	if ip := f.sourceIP(req); ip.String() != "10.0.0.2" {
+		t.Error("Expected last good hop", ip)
+	}
+}
+
+func TestHandlerFuncRejectsDeniedSource(t *testing.T) {
+	settings := DefaultSettings().WithEndpoint("test")
+	settings.IPFilter.Deny = []string{"192.0.2.0/24"}
+	rt := newRuntime(context.Background(), settings)
+	defer rt.close()
+
+	req := httptest.NewRequest("GET", "/.well-known/jwks.json", nil)
+	w := httptest.NewRecorder()
+	rt.handleRequest(w, req)
+
+	if w.Code != http.StatusForbidden {
+		t.Error("Denied source not rejected", w.Code)
+	}
+
+	if rt.rejectedCount() != 1 {
+		t.Error("Rejected count expected 1 got", rt.rejectedCount())
+	}
+}
@@ -0,0 +1,153 @@
+/*
+Copyright © 2018-2021 Neil Hemming
+*/
+
+package proxy
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+const (
+	// LevelDebug is for detailed diagnostic messages.
+	LevelDebug Level = iota
+
+	// LevelInfo is for normal operational messages.
+	LevelInfo
+
+	// LevelWarn is for unexpected but recoverable conditions.
+	LevelWarn
+
+	// LevelError is for failures.
+	LevelError
+
+	// requestIDHeader carries the correlation ID of a request.
+	requestIDHeader = "X-Request-ID"
+
+	// maxRequestIDLength limits the size of an inbound correlation ID.
+	maxRequestIDLength = 128
+)
+
+type (
+	// Level is the severity of a log message.
+	Level int
+
+	// Fields are the key value pairs attached to a log message.
+	Fields map[string]interface{}
+
+	// Logger receives structured log messages from the service.
+	Logger interface {
+		Log(level Level, msg string, fields Fields)
+	}
+
+	// requestIDKey is the context key of the request's correlation ID.
+	requestIDKey struct{}
+)
+
+// String returns the name of the level.
+func (level Level) String() string {
+	switch level {
+	case LevelDebug:
+		return "debug"
+	case LevelInfo:
+		return "info"
+	case LevelWarn:
+		return "warn"
+	case LevelError:
+		return "error"
+	}
+
+	return fmt.Sprintf("level(%d)", int(level))
+}
+
+// ParseLevel returns the level with the passed name.
+func ParseLevel(name string) (Level, error) {
+	switch strings.ToLower(name) {
+	case "debug":
+		return LevelDebug, nil
+	case "info", "":
+		return LevelInfo, nil
+	case "warn", "warning":
+		return LevelWarn, nil
+	case "error":
+		return LevelError, nil
+	}
+
+	return LevelInfo, fmt.Errorf("unknown log level %s", name)
+}
+
+// Log adapts a LoggerFunc to the Logger interface.  Warnings and errors are flagged as errors
+// and any fields are appended to the message as sorted key=value pairs.
+func (fn LoggerFunc) Log(level Level, msg string, fields Fields) {
+	if len(fields) > 0 {
+		keys := make([]string, 0, len(fields))
+		for k := range fields {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		var sb strings.Builder
+		sb.WriteString(msg)
+		for _, k := range keys {
+			fmt.Fprintf(&sb, " %s=%v", k, fields[k])
+		}
+		msg = sb.String()
+	}
+
+	// The message is the format, so escape any verbs it contains
+	fn(level >= LevelWarn, strings.ReplaceAll(msg, "%", "%%"))
+}
+
+// withRequestID attaches the inbound X-Request-ID, or a newly generated ID, to the request context
+// and echoes it in the response.
+func withRequestID(w http.ResponseWriter, r *http.Request) *http.Request {
+	id := r.Header.Get(requestIDHeader)
+	if id == "" || len(id) > maxRequestIDLength {
+		id = newRequestID()
+	}
+
+	w.Header().Set(requestIDHeader, id)
+
+	return r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id))
+}
+
+// requestID returns the correlation ID held in the context, blank if none.
+func requestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// newRequestID generates a random correlation ID.
+func newRequestID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return ""
+	}
+
+	return hex.EncodeToString(b)
+}
+
+// log sends a structured message to the logger.
+func (rt *runtime) log(level Level, msg string, fields Fields) {
+	if logger := rt.config().logger; logger != nil {
+		logger.Log(level, msg, fields)
+	}
+}
+
+// logRequest logs a message for a request, adding its correlation ID to the fields.
+func (rt *runtime) logRequest(level Level, requestID string, msg string, fields Fields) {
+	if requestID != "" {
+		if fields == nil {
+			fields = make(Fields)
+		}
+		fields["request_id"] = requestID
+	}
+
+	rt.log(level, msg, fields)
+}
@@ -0,0 +1,50 @@
+/*
+Copyright © 2018-2021 Neil Hemming
+*/
+
+package proxy
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+type recordingLogger struct {
+	levels   []Level
+	messages []string
+	fields   []Fields
+}
+
+func (l *recordingLogger) Log(level Level, msg string, fields Fields) {
+	l.levels = append(l.levels, level)
+	l.messages = append(l.messages, msg)
+	l.fields = append(l.fields, fields)
+}
+
+func TestParseLevel(t *testing.T) {
+	for _, level := range []Level{LevelDebug, LevelInfo, LevelWarn, LevelError} {
+		if parsed, err := ParseLevel(strings.ToUpper(level.String())); err != nil || parsed != level {
+			t.Error("Level round trip failed", level, err)
+		}
+	}
+
+	if _, err := ParseLevel("loud"); err == nil {
+		t.Error("Unknown level not caught")
+	}
+}
+
+func TestLoggerFuncAppendsFields(t *testing.T) {
+	var isErr bool
+	var msg string
+
+	fn := LoggerFunc(func(e bool, format string, args ...interface{}) {
+		isErr, msg = e, fmt.Sprintf(format, args...)
+	})
+
+	fn.Log(LevelWarn, "100% done", Fields{"b": 2, "a": "x"})
+
+	if !isErr || msg != "100% done a=x b=2" {
+		t.Error("Unexpected", isErr, msg)
+	}
+}
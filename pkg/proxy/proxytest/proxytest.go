@@ -0,0 +1,265 @@
+/*
+Copyright © 2018-2021 Neil Hemming
+*/
+
+// Package proxytest provides an in process oauthproxy and mock provider for use in Go tests.
+package proxytest
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nehemming/oauthproxy/pkg/proxy"
+)
+
+// TokenPath is the path token requests are sent to.
+const TokenPath = "/oauth2/token"
+
+type (
+	// Provider is a mock OAuth2 provider.  By default token requests are answered with
+	// a new bearer token each time, valid for an hour.
+	Provider struct {
+		*httptest.Server
+
+		lock    sync.Mutex
+		calls   map[string]int
+		issued  int
+		handler http.Handler
+	}
+
+	// Proxy is an in process oauthproxy forwarding to a mock provider.
+	Proxy struct {
+		*proxy.Server
+
+		// URL is the base URL of the proxy, of the form http://ipaddr:port with no trailing slash
+		URL string
+
+		// Provider is the mock provider the proxy forwards to
+		Provider *Provider
+
+		t testing.TB
+	}
+)
+
+// NewProvider starts a mock provider listening on a random port.  Close it when finished.
+func NewProvider() *Provider {
+	p := &Provider{calls: make(map[string]int)}
+	p.Server = httptest.NewServer(http.HandlerFunc(p.serveHTTP))
+
+	return p
+}
+
+// serveHTTP counts the request and answers it.
+func (p *Provider) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	p.lock.Lock()
+	p.calls[r.URL.Path]++
+	p.issued++
+	issued, handler := p.issued, p.handler
+	p.lock.Unlock()
+
+	if handler != nil {
+		handler.ServeHTTP(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprintf(w, "{\"access_token\":\"token-%d\",\"token_type\":\"bearer\",\"expires_in\":3600}", issued)
+}
+
+// Handle replaces the default token replies with h.  Requests are still counted.
+func (p *Provider) Handle(h http.Handler) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.handler = h
+}
+
+// Reply answers every request with the status and body.
+func (p *Provider) Reply(statusCode int, body string) {
+	p.Handle(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(statusCode)
+		_, _ = w.Write([]byte(body))
+	}))
+}
+
+// Calls returns the number of requests the provider has received.
+func (p *Provider) Calls() int {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	n := 0
+	for _, c := range p.calls {
+		n += c
+	}
+
+	return n
+}
+
+// CallsTo returns the number of requests the provider has received for path.
+func (p *Provider) CallsTo(path string) int {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	return p.calls[path]
+}
+
+// Reset clears the request counts.
+func (p *Provider) Reset() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.calls = make(map[string]int)
+}
+
+// NewProxy starts a mock provider and a proxy forwarding to it, both listening on random ports
+// of the loopback interface.  configure functions may change the proxy's settings before it is
+// created.  Both are closed when the test finishes.
+func NewProxy(t testing.TB, configure ...func(proxy.Settings) proxy.Settings) *Proxy {
+	t.Helper()
+
+	provider := NewProvider()
+
+	settings := proxy.DefaultSettings().WithEndpoint(provider.URL)
+	settings.HTTPListenAddr = "127.0.0.1:0"
+	settings.ShutdownGracePeriod = time.Second
+
+	// Tests use short lived tokens and periods, so no lower bounds are enforced
+	settings.Limits = proxy.Limits{}
+
+	for _, fn := range configure {
+		settings = fn(settings)
+	}
+
+	server, err := proxy.NewServer(context.Background(), settings)
+	if err != nil {
+		provider.Close()
+		t.Fatal(err)
+	}
+
+	if err := server.Start(); err != nil {
+		_ = server.Close()
+		provider.Close()
+		t.Fatal(err)
+	}
+
+	p := &Proxy{
+		Server:   server,
+		URL:      "http://" + server.Addr(),
+		Provider: provider,
+		t:        t,
+	}
+	t.Cleanup(p.Close)
+
+	return p
+}
+
+// Close stops the proxy and its provider.
+func (p *Proxy) Close() {
+	_ = p.Server.Close()
+	p.Provider.Close()
+}
+
+// TokenURL returns the proxy's token endpoint.
+func (p *Proxy) TokenURL() string {
+	return p.URL + TokenPath
+}
+
+// PasswordGrant returns the form of a password grant token request.
+func PasswordGrant(clientID, username, password string) url.Values {
+	return url.Values{
+		"grant_type": {"password"},
+		"client_id":  {clientID},
+		"username":   {username},
+		"password":   {password},
+	}
+}
+
+// RequestToken posts the token request form to the proxy, returning the reply status and body.
+func (p *Proxy) RequestToken(form url.Values) (int, string) {
+	p.t.Helper()
+
+	resp, err := http.PostForm(p.TokenURL(), form)
+	if err != nil {
+		p.t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		p.t.Fatal(err)
+	}
+
+	return resp.StatusCode, string(body)
+}
+
+// AssertDownstreamCalls fails the test unless the provider has received n requests.
+func (p *Proxy) AssertDownstreamCalls(n int) {
+	p.t.Helper()
+
+	if calls := p.Provider.Calls(); calls != n {
+		p.t.Errorf("expected %d downstream calls, got %d", n, calls)
+	}
+}
+
+// Seed caches body as the successful reply to the token request form, valid for ttl.
+// The seeded token is recognised by the proxy's introspection and revocation endpoints.
+func (p *Proxy) Seed(form url.Values, body string, ttl time.Duration) {
+	p.t.Helper()
+
+	p.SeedToken(p.cacheKey(form), []byte(body), ttl)
+}
+
+// Expire expires the cached reply to the token request form, so the next request is sent downstream.
+func (p *Proxy) Expire(form url.Values) {
+	p.t.Helper()
+
+	key := p.cacheKey(form)
+	if e, ok := p.Cache().Get(key); ok {
+		p.Cache().Set(key, expired(e))
+	}
+}
+
+// ExpireAll expires every cached reply.
+func (p *Proxy) ExpireAll() {
+	cache := p.Cache()
+
+	entries := make(map[proxy.CacheKey]proxy.CacheEntry)
+	cache.Range(func(k proxy.CacheKey, e proxy.CacheEntry) bool {
+		entries[k] = e
+		return true
+	})
+
+	for k, e := range entries {
+		cache.Set(k, expired(e))
+	}
+}
+
+// cacheKey returns the cache key of the token request form.
+func (p *Proxy) cacheKey(form url.Values) proxy.CacheKey {
+	p.t.Helper()
+
+	r := httptest.NewRequest(http.MethodPost, TokenPath, strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	key, err := p.CacheKey(r)
+	if err != nil {
+		p.t.Fatal(err)
+	}
+
+	return key
+}
+
+// expired returns the entry with an expiry in the past.
+func expired(e proxy.CacheEntry) proxy.CacheEntry {
+	e.Expiry = time.Now().UTC().Add(-time.Second)
+	return e
+}
@@ -0,0 +1,122 @@
+/*
+Copyright © 2018-2021 Neil Hemming
+*/
+
+package proxytest
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nehemming/oauthproxy/pkg/proxy"
+)
+
+func TestProxyCachesProviderToken(t *testing.T) {
+	p := NewProxy(t)
+	form := PasswordGrant("client", "u1", "p1")
+
+	for i := 0; i < 3; i++ {
+		status, body := p.RequestToken(form)
+		if status != http.StatusOK || !strings.Contains(body, "\"token-1\"") {
+			t.Error("Unexpected reply", status, body)
+		}
+	}
+
+	p.AssertDownstreamCalls(1)
+
+	if calls := p.Provider.CallsTo(TokenPath); calls != 1 {
+		t.Error("Unexpected token path calls", calls)
+	}
+
+	if stats := p.Stats(); stats.CacheHits != 2 || stats.DownstreamRequests != 1 {
+		t.Error("Unexpected stats", stats)
+	}
+}
+
+func TestProxySeedAvoidsProvider(t *testing.T) {
+	p := NewProxy(t)
+	form := PasswordGrant("client", "u1", "p1")
+
+	p.Seed(form, "{\"access_token\":\"seeded\"}", time.Minute)
+
+	if status, body := p.RequestToken(form); status != http.StatusOK || !strings.Contains(body, "seeded") {
+		t.Error("Seeded token not returned", status, body)
+	}
+
+	p.AssertDownstreamCalls(0)
+}
+
+func TestProxyExpireRefetches(t *testing.T) {
+	p := NewProxy(t)
+	form := PasswordGrant("client", "u1", "p1")
+	other := PasswordGrant("client", "u2", "p2")
+
+	p.RequestToken(form)
+	p.RequestToken(other)
+	p.Expire(form)
+
+	if _, body := p.RequestToken(form); !strings.Contains(body, "\"token-3\"") {
+		t.Error("Expired token not refetched", body)
+	}
+
+	if _, body := p.RequestToken(other); !strings.Contains(body, "\"token-2\"") {
+		t.Error("Other token expired", body)
+	}
+
+	p.ExpireAll()
+	p.RequestToken(other)
+
+	p.AssertDownstreamCalls(4)
+}
+
+func TestProxyReplyAndConfigure(t *testing.T) {
+	p := NewProxy(t, func(s proxy.Settings) proxy.Settings {
+		s.PoolSize = 1
+		return s
+	})
+	p.Provider.Reply(http.StatusUnauthorized, "{\"error\":\"invalid_grant\"}")
+
+	if status, body := p.RequestToken(PasswordGrant("client", "u1", "bad")); status != http.StatusUnauthorized || !strings.Contains(body, "invalid_grant") {
+		t.Error("Provider reply not passed through", status, body)
+	}
+
+	p.Provider.Reset()
+	p.AssertDownstreamCalls(0)
+}
+
+func TestProxySeedIntrospectAndRevoke(t *testing.T) {
+	p := NewProxy(t)
+	form := PasswordGrant("client", "u1", "p1")
+	form.Set("client_secret", "secret")
+
+	p.Seed(form, "{\"access_token\":\"seeded\",\"expires_in\":60}", time.Minute)
+
+	post := func(path string, values url.Values) (int, string) {
+		resp, err := http.PostForm(p.URL+path, values)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+
+		body, _ := ioutil.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+
+	auth := url.Values{"token": {"seeded"}, "client_id": {"client"}, "client_secret": {"secret"}}
+
+	if status, body := post("/oauth2/introspect", auth); status != http.StatusOK || !strings.Contains(body, "\"active\":true") {
+		t.Error("Seeded token not introspected", status, body)
+	}
+
+	if status, body := post("/oauth2/revoke", auth); status != http.StatusOK {
+		t.Error("Seeded token not revoked", status, body)
+	}
+
+	if _, ok := p.Cache().Get(p.cacheKey(form)); ok {
+		t.Error("Seeded token not evicted")
+	}
+}
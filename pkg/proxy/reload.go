@@ -0,0 +1,172 @@
+/*
+Copyright © 2018-2021 Neil Hemming
+*/
+
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"time"
+
+	multierror "github.com/hashicorp/go-multierror"
+)
+
+type (
+	// liveConfig is the part of the runtime's configuration that can be reloaded while running.
+	// A liveConfig is never modified once published, a reload publishes a replacement.
+	liveConfig struct {
+		endpoint              string
+		requestTimeout        time.Duration
+		houseKeeperPeriod     time.Duration
+		ttl                   time.Duration
+		documentTTLMin        time.Duration
+		documentTTLMax        time.Duration
+		introspectionFallback bool
+		clients               clientRegistry
+		identities            identityRegistry
+		callerAuth            CallerAuthSettings
+		ipFilter              *ipFilter
+		logger                Logger
+	}
+)
+
+// newLiveConfig builds the reloadable configuration from the settings.
+// Errors building the registries are returned along with the partially built configuration.
+func newLiveConfig(settings Settings) (*liveConfig, error) {
+	var result error
+
+	live := &liveConfig{
+		endpoint:              settings.Endpoint,
+		requestTimeout:        settings.RequestTimeout,
+		houseKeeperPeriod:     settings.CacheTTL,
+		ttl:                   settings.CacheTTL,
+		documentTTLMin:        settings.DocumentTTLMin,
+		documentTTLMax:        settings.DocumentTTLMax,
+		introspectionFallback: settings.IntrospectionFallback,
+		callerAuth:            settings.CallerAuth,
+		logger:                settings.Logger,
+	}
+
+	// Register the clients whose credentials are injected, invalid clients are reported by validateSettings
+	clients, err := newClientRegistry(settings.Clients)
+	if err != nil {
+		result = multierror.Append(result, fmt.Errorf("client registry: %w", err))
+	}
+	live.clients = clients
+
+	identities, err := newIdentityRegistry(settings.Identities)
+	if err != nil {
+		result = multierror.Append(result, fmt.Errorf("identity registry: %w", err))
+	}
+	live.identities = identities
+
+	ipFilter, err := newIPFilter(settings.IPFilter)
+	if err != nil {
+		result = multierror.Append(result, fmt.Errorf("ip filter: %w", err))
+	}
+	live.ipFilter = ipFilter
+
+	return live, result
+}
+
+// config returns the current live configuration.
+func (rt *runtime) config() *liveConfig {
+	return rt.live.Load().(*liveConfig)
+}
+
+// reload validates the new settings and applies them to the running service.
+// Invalid settings are rejected leaving the service unchanged.  Settings that cannot be changed
+// while running are reported on every reload and keep their current value until restart.  The cache is kept.
+// Reloads are serialised and the new configuration is only published once every step has succeeded.
+func (rt *runtime) reload(settings Settings) error {
+	rt.reloadLock.Lock()
+	defer rt.reloadLock.Unlock()
+
+	if err := settings.validateSettings(); err != nil {
+		return err
+	}
+
+	live, err := newLiveConfig(settings)
+	if err != nil {
+		return err
+	}
+
+	if err := rt.resizePool(settings.PoolSize); err != nil {
+		return err
+	}
+
+	for _, name := range restartRequired(rt.settings, settings) {
+		rt.log(LevelWarn, "config change requires a restart", Fields{"setting": name})
+	}
+
+	rt.live.Store(live)
+	rt.settings = keepRunning(rt.settings, settings)
+	rt.log(LevelInfo, "config reloaded", nil)
+
+	return nil
+}
+
+// restartRequired lists the settings that changed but are only applied at startup.
+func restartRequired(current, next Settings) []string {
+	var changed []string
+
+	check := func(name string, a, b interface{}) {
+		if !reflect.DeepEqual(a, b) {
+			changed = append(changed, name)
+		}
+	}
+
+	check("HTTPListenAddr", current.HTTPListenAddr, next.HTTPListenAddr)
+	check("ShutdownGracePeriod", current.ShutdownGracePeriod, next.ShutdownGracePeriod)
+	check("Issuer", current.Issuer, next.Issuer)
+	check("DiscoveryRefresh", current.DiscoveryRefresh, next.DiscoveryRefresh)
+	check("Transport", current.Transport, next.Transport)
+	check("ListenerTLS", current.ListenerTLS, next.ListenerTLS)
+	check("AccessLog", current.AccessLog, next.AccessLog)
+	check("AuditLog", current.AuditLog, next.AuditLog)
+	check("Tracing", current.Tracing, next.Tracing)
+	check("Events", current.Events, next.Events)
+	check("CircuitBreaker", current.CircuitBreaker, next.CircuitBreaker)
+
+	return changed
+}
+
+// keepRunning returns next with the settings only applied at startup replaced by their current
+// values, so a change not yet applied is still reported by later reloads.
+func keepRunning(current, next Settings) Settings {
+	next.HTTPListenAddr = current.HTTPListenAddr
+	next.ShutdownGracePeriod = current.ShutdownGracePeriod
+	next.Issuer = current.Issuer
+	next.DiscoveryRefresh = current.DiscoveryRefresh
+	next.Transport = current.Transport
+	next.ListenerTLS = current.ListenerTLS
+	next.AccessLog = current.AccessLog
+	next.AuditLog = current.AuditLog
+	next.Tracing = current.Tracing
+	next.Events = current.Events
+	next.CircuitBreaker = current.CircuitBreaker
+
+	return next
+}
+
+// resizePool starts or stops downstream workers to match the pool size.
+// It is called when the runtime is created and then only by reload, holding the reload lock.
+// Workers are stopped by queueing a stop request, so a busy worker finishes its current request first.
+func (rt *runtime) resizePool(size int) error {
+	for ; rt.poolSize < size; rt.poolSize++ {
+		rt.downstreamWaitGroup.Add(1)
+		go rt.downstreamService()
+	}
+
+	for ; rt.poolSize > size; rt.poolSize-- {
+		select {
+		case rt.downstream <- downstreamRequest{stop: true}:
+		case <-rt.done():
+			return errors.New("service stopped while resizing the pool")
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,152 @@
+/*
+Copyright © 2018-2021 Neil Hemming
+*/
+
+package proxy
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestReloadAppliesSettingsAndKeepsCache(t *testing.T) {
+	settings := DefaultSettings().WithEndpoint("http://test")
+	rt := newRuntime(context.Background(), settings)
+	defer rt.close()
+
+	calls := 0
+	rt.requester = func(ctx context.Context, req *http.Request) (*http.Response, error) {
+		calls++
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Header:     http.Header{},
+			Body:       ioutil.NopCloser(strings.NewReader(`{"keys":[]}`)),
+		}, nil
+	}
+
+	rt.handleRequest(httptest.NewRecorder(), httptest.NewRequest("GET", "/keys", nil))
+
+	next := settings
+	next.CacheTTL = time.Hour
+	next.Endpoint = "http://other"
+	next.PoolSize = 4
+	next.IPFilter.Deny = []string{"10.0.0.0/8"}
+
+	if err := rt.reload(next); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := rt.config()
+	if cfg.ttl != time.Hour || cfg.endpoint != "http://other" || rt.poolSize != 4 || len(cfg.ipFilter.deny) != 1 {
+		t.Error("Settings not applied", cfg.ttl, cfg.endpoint, rt.poolSize)
+	}
+
+	rt.handleRequest(httptest.NewRecorder(), httptest.NewRequest("GET", "/keys", nil))
+	if calls != 1 {
+		t.Error("Cache not kept across reload", calls)
+	}
+
+	// Shrink the pool and check requests are still serviced
+	next.PoolSize = 1
+	if err := rt.reload(next); err != nil || rt.poolSize != 1 {
+		t.Fatal("Pool not shrunk", err, rt.poolSize)
+	}
+
+	w := httptest.NewRecorder()
+	rt.handleRequest(w, httptest.NewRequest("GET", "/jwks", nil))
+	if w.Code != http.StatusOK || calls != 2 {
+		t.Error("Request not serviced after shrinking pool", w.Code, calls)
+	}
+}
+
+func TestReloadRejectsInvalidSettings(t *testing.T) {
+	settings := DefaultSettings().WithEndpoint("http://test")
+	rt := newRuntime(context.Background(), settings)
+	defer rt.close()
+
+	next := settings
+	next.CacheTTL = time.Second
+	next.Endpoint = "http://other"
+
+	if err := rt.reload(next); err == nil {
+		t.Error("Invalid settings not rejected")
+	}
+
+	if cfg := rt.config(); cfg.ttl != settings.CacheTTL || cfg.endpoint != "http://test" {
+		t.Error("Rejected settings applied")
+	}
+}
+
+func TestRestartRequired(t *testing.T) {
+	current := DefaultSettings().WithEndpoint("http://test")
+	next := current.WithHTTPPort(9000)
+	next.CacheTTL = time.Hour
+	next.Tracing.Endpoint = "http://collector"
+
+	changed := restartRequired(current, next)
+	if strings.Join(changed, ",") != "HTTPListenAddr,Tracing" {
+		t.Error("Unexpected", changed)
+	}
+}
+
+func TestReloadKeepsRestartSettingsRunning(t *testing.T) {
+	settings := DefaultSettings().WithEndpoint("http://test")
+	rt := newRuntime(context.Background(), settings)
+	defer rt.close()
+
+	next := settings.WithHTTPPort(9000)
+	next.CacheTTL = time.Hour
+	next.Tracing.Endpoint = "http://collector"
+
+	for i := 0; i < 2; i++ {
+		if err := rt.reload(next); err != nil {
+			t.Fatal(err)
+		}
+
+		if changed := restartRequired(rt.settings, next); strings.Join(changed, ",") != "HTTPListenAddr,Tracing" {
+			t.Error("Pending restart settings not reported", i, changed)
+		}
+	}
+
+	if rt.settings.CacheTTL != time.Hour || rt.settings.HTTPListenAddr != settings.HTTPListenAddr {
+		t.Error("Unexpected running settings", rt.settings.CacheTTL, rt.settings.HTTPListenAddr)
+	}
+
+	if changed := restartRequired(rt.settings, settings); len(changed) != 0 {
+		t.Error("Reverted restart settings reported", changed)
+	}
+}
+
+func TestReloadConcurrent(t *testing.T) {
+	settings := DefaultSettings().WithEndpoint("http://test")
+	rt := newRuntime(context.Background(), settings)
+	defer rt.close()
+
+	var wg sync.WaitGroup
+	for i := 1; i <= 4; i++ {
+		wg.Add(1)
+		go func(size int) {
+			defer wg.Done()
+
+			next := settings
+			next.PoolSize = size
+			if err := rt.reload(next); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	rt.reloadLock.Lock()
+	defer rt.reloadLock.Unlock()
+
+	if rt.poolSize != rt.settings.PoolSize {
+		t.Error("Pool size does not match the published settings", rt.poolSize, rt.settings.PoolSize)
+	}
+}
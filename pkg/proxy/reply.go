@@ -25,6 +25,20 @@ func replyNotFound(w http.ResponseWriter) {
 	}
 }
 
+func replyUnauthorized(w http.ResponseWriter) {
+	err := replyWithError(w, http.StatusUnauthorized, "unauthorized")
+	if err != nil {
+		loggee.Warn(err.Error())
+	}
+}
+
+func replyForbidden(w http.ResponseWriter) {
+	err := replyWithError(w, http.StatusForbidden, "forbidden")
+	if err != nil {
+		loggee.Warn(err.Error())
+	}
+}
+
 func replyInvalid(w http.ResponseWriter) {
 	err := replyWithError(w, http.StatusBadRequest, "bad request")
 	if err != nil {
@@ -33,13 +47,17 @@ func replyInvalid(w http.ResponseWriter) {
 }
 
 func replyWithError(w http.ResponseWriter, statusCode int, msg string) error {
-	w.Header().Set("Content-Type", "application/json;charset=UTF-8")
-
 	data := make(map[string]interface{})
 	data["error"] = msg
 	data["error_description"] = msg
 	data["error_code"] = statusCode
 
+	return replyWithJSON(w, statusCode, data)
+}
+
+func replyWithJSON(w http.ResponseWriter, statusCode int, data interface{}) error {
+	w.Header().Set("Content-Type", "application/json;charset=UTF-8")
+
 	w.WriteHeader(statusCode)
 	return json.NewEncoder(w).Encode(data)
 }
@@ -0,0 +1,111 @@
+/*
+Copyright © 2018-2021 Neil Hemming
+*/
+
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// isRevokePath reports if the path is for token revocation.
+func isRevokePath(path string) bool {
+	return strings.HasSuffix(path, "/revoke")
+}
+
+type (
+	// revokedTokens are the tokens recently revoked through the proxy, with the time each is remembered until.
+	// Responses holding a revoked token are not cached, so a request in flight when the token was revoked
+	// cannot cache it again.
+	revokedTokens struct {
+		lock   sync.Mutex
+		tokens map[string]time.Time
+	}
+)
+
+// revoke forwards the revocation to the provider.  Cached entries holding the token are only
+// evicted once the provider has accepted the revocation, when the token is marked as revoked.
+// If the provider has no revocation endpoint the request is rejected, as the token cannot be revoked.
+func (rt *runtime) revoke(ctx context.Context, tr tokenRequest, w http.ResponseWriter) {
+	if rt.revocationURL(tr) == "" {
+		rt.logInfo("revoke for %s refused, the provider has no revocation endpoint", tr.path)
+		replyNotFound(w)
+		return
+	}
+
+	rt.requestFromDownstream(ctx, tr, w)
+}
+
+// markRevoked records the token as revoked and evicts any entries cached holding it since the
+// revocation was requested.  The token is remembered for the cache TTL.
+func (rt *runtime) markRevoked(token string) {
+	rt.revoked.lock.Lock()
+	if rt.revoked.tokens == nil {
+		rt.revoked.tokens = make(map[string]time.Time)
+	}
+	rt.revoked.tokens[token] = time.Now().UTC().Add(rt.config().ttl)
+	rt.revoked.lock.Unlock()
+
+	if n := rt.evict(token); n > 0 {
+		rt.logInfo("revoke evicted %d cache entries", n)
+	}
+}
+
+// holdsRevoked reports if the request or its token response hold a revoked token.
+func (rt *runtime) holdsRevoked(tr tokenRequest, info tokenInfo) bool {
+	rt.revoked.lock.Lock()
+	defer rt.revoked.lock.Unlock()
+
+	for _, token := range []string{tr.token, tr.exchange.subjectToken, info.accessToken, info.refreshToken} {
+		if _, ok := rt.revoked.tokens[token]; ok && token != "" {
+			return true
+		}
+	}
+
+	return false
+}
+
+// forgetRevoked removes the revoked tokens remembered until before now.
+func (rt *runtime) forgetRevoked(now time.Time) {
+	rt.revoked.lock.Lock()
+	defer rt.revoked.lock.Unlock()
+
+	for token, until := range rt.revoked.tokens {
+		if until.Before(now) {
+			delete(rt.revoked.tokens, token)
+		}
+	}
+}
+
+// evict removes every cache entry holding the token, returning the number removed.
+// Tokens obtained by exchanging the token are also removed.
+func (rt *runtime) evict(token string) int {
+	var evicted []CacheKey
+	rt.cache.Range(func(k CacheKey, e CacheEntry) bool {
+		if k.tr.token == token || k.tr.exchange.subjectToken == token ||
+			e.info.accessToken == token || e.info.refreshToken == token {
+			evicted = append(evicted, k)
+		}
+		return true
+	})
+
+	for _, k := range evicted {
+		rt.cache.Delete(k)
+	}
+
+	return len(evicted)
+}
+
+// revocationURL returns the downstream revocation endpoint.
+// Blank is returned if discovery is in use and the provider does not support revocation.
+func (rt *runtime) revocationURL(tr tokenRequest) string {
+	if md := rt.providerMetadata(); md != nil {
+		return md.RevocationEndpoint
+	}
+
+	return rt.config().endpoint + tr.path
+}
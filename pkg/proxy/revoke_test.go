@@ -0,0 +1,101 @@
+/*
+Copyright © 2018-2021 Neil Hemming
+*/
+
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEvictRemovesAccessAndRefreshTokens(t *testing.T) {
+	settings := DefaultSettings().WithEndpoint("test")
+	rt := newRuntime(context.Background(), settings)
+	defer rt.close()
+
+	k1 := tokenRequest{path: "/token", username: "u1"}
+	k2 := tokenRequest{path: "/token", username: "u2"}
+	k3 := tokenRequest{path: "/token", username: "u3"}
+	rt.update(k1, http.Header{}, []byte("{\"access_token\":\"a1\",\"refresh_token\":\"r1\"}"), http.StatusOK)
+	rt.update(k2, http.Header{}, []byte("{\"access_token\":\"a2\",\"refresh_token\":\"r1\"}"), http.StatusOK)
+	rt.update(k3, http.Header{}, []byte("{\"access_token\":\"a3\"}"), http.StatusOK)
+
+	if n := rt.evict("r1"); n != 2 {
+		t.Error("Expected 2 evictions, got", n)
+	}
+
+	if _, ok := rt.cache.Get(CacheKey{tr: k3}); !ok || cacheLen(rt.cache) != 1 {
+		t.Error("Unexpected cache after eviction", rt.cache)
+	}
+}
+
+func TestRevokedTokenNotCachedByRequestInFlight(t *testing.T) {
+	settings := DefaultSettings().WithEndpoint("https://p.com")
+	rt := newRuntime(context.Background(), settings)
+	defer rt.close()
+
+	key := tokenRequest{path: "/oauth2/token", username: "u1"}
+
+	rt.requester = func(ctx context.Context, req *http.Request) (*http.Response, error) {
+		// A token request completing while the provider is revoking its token
+		rt.update(key, http.Header{}, []byte("{\"access_token\":\"a1\"}"), http.StatusOK)
+
+		w := httptest.NewRecorder()
+		w.WriteHeader(http.StatusOK)
+		return w.Result(), nil
+	}
+
+	req, _ := http.NewRequest("POST", "http:/oauth2/revoke", strings.NewReader("token=a1"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	w := httptest.NewRecorder()
+	rt.handleRequest(w, req)
+
+	if w.Code != http.StatusOK || cacheLen(rt.cache) != 0 {
+		t.Error("Revoked token cached by request in flight", w.Code, cacheLen(rt.cache))
+	}
+
+	// Responses completing after the revocation are not cached
+	rt.update(key, http.Header{}, []byte("{\"access_token\":\"a1\"}"), http.StatusOK)
+	if cacheLen(rt.cache) != 0 {
+		t.Error("Revoked token cached after revocation")
+	}
+
+	rt.update(key, http.Header{}, []byte("{\"access_token\":\"a2\"}"), http.StatusOK)
+	if cacheLen(rt.cache) != 1 {
+		t.Error("New token not cached")
+	}
+
+	rt.forgetRevoked(time.Now().UTC().Add(settings.CacheTTL + time.Second))
+	if rt.holdsRevoked(tokenRequest{}, tokenInfo{accessToken: "a1"}) {
+		t.Error("Revoked token not forgotten")
+	}
+}
+
+func TestHandlerFuncRevokeWithoutEndpointFails(t *testing.T) {
+	settings := DefaultSettings().WithEndpoint("https://p.com")
+	rt := newRuntime(context.Background(), settings)
+	defer rt.close()
+
+	rt.metaLock.Lock()
+	rt.metadata = &providerMetadata{TokenEndpoint: "https://p.com/oauth2/token"}
+	rt.metaLock.Unlock()
+
+	key := tokenRequest{path: "/oauth2/token", username: "u1"}
+	rt.update(key, http.Header{}, []byte("{\"access_token\":\"a1\"}"), http.StatusOK)
+
+	req, _ := http.NewRequest("POST", "http:/oauth2/revoke", strings.NewReader("token=a1"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	w := httptest.NewRecorder()
+	rt.handleRequest(w, req)
+
+	if w.Code != http.StatusNotFound || cacheLen(rt.cache) != 1 {
+		t.Error("Revocation without endpoint succeeded", w.Code, cacheLen(rt.cache))
+	}
+}
@@ -0,0 +1,334 @@
+/*
+Copyright © 2018-2021 Neil Hemming
+*/
+
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type (
+	// Server is an oauthproxy service that can be embedded in another program.
+	// Create one with NewServer, then either Start it listening or mount its Handler.
+	Server struct {
+		settings  Settings
+		rt        *runtime
+		serve     serveFunc
+		closers   []func()
+		lock      sync.Mutex
+		srv       *http.Server
+		listener  net.Listener
+		closeOnce sync.Once
+		closeErr  error
+	}
+
+	// serveFunc serves requests from the listener, with TLS when configured.
+	serveFunc func(srv *http.Server, l net.Listener) error
+
+	// Stats are counts of the work done by a Server.
+	Stats struct {
+		// Requests is the number of requests handled
+		Requests uint64
+
+		// CacheHits is the number of requests answered from the cache
+		CacheHits uint64
+
+		// Coalesced is the number of requests answered by a downstream request made for an earlier caller
+		Coalesced uint64
+
+		// DownstreamRequests is the number of requests sent to the downstream provider
+		DownstreamRequests uint64
+
+		// DownstreamErrors is the number of downstream requests that failed without a response
+		DownstreamErrors uint64
+
+		// Rejected is the number of requests refused by source address filtering
+		Rejected uint64
+
+		// CacheEntries is the number of entries currently cached
+		CacheEntries int
+	}
+
+	// discardWriter records the status of replies that are not sent.
+	discardWriter struct {
+		header http.Header
+		status int
+	}
+
+	// counters hold the runtime's statistics, updated atomically.
+	counters struct {
+		requests           uint64
+		cacheHits          uint64
+		coalesced          uint64
+		downstreamRequests uint64
+		downstreamErrors   uint64
+	}
+)
+
+// NewServer creates a server from the settings.  The settings are validated, the downstream
+// endpoints discovered if an issuer is set and the downstream request workers started.
+// The server runs until ctx is cancelled or Close is called, Close must always be called
+// to release its resources.
+func NewServer(ctx context.Context, settings Settings) (*Server, error) {
+	// Validate settings
+	if err := settings.validateSettings(); err != nil {
+		return nil, err
+	}
+
+	// Create the outbound client used for downstream requests
+	client, err := settings.Transport.newClient()
+	if err != nil {
+		return nil, err
+	}
+
+	// HTTPS listener config, nil for plain HTTP
+	tlsConfig, err := settings.ListenerTLS.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Server{settings: settings}
+
+	accessLog, err := settings.AccessLog.newAccessLogger()
+	if err != nil {
+		return nil, err
+	}
+	s.closers = append(s.closers, func() { _ = accessLog.close() })
+
+	auditLog, err := settings.AuditLog.newAuditLogger()
+	if err != nil {
+		s.release()
+		return nil, err
+	}
+	s.closers = append(s.closers, func() { _ = auditLog.close() })
+
+	// Create a runtime instance, this does most of the work
+	rt := newRuntime(ctx, settings)
+	s.rt = rt
+	s.closers = append(s.closers, rt.close)
+
+	rt.client = client
+	rt.accessLog = accessLog
+	rt.auditLog = auditLog
+
+	rt.tracer = settings.Tracing.newTracer(func(err error) {
+		rt.log(LevelWarn, "trace export failed", Fields{"error": err.Error()})
+	})
+	s.closers = append(s.closers, rt.tracer.close)
+
+	rt.events = settings.Events.newEventBus(client, func(err error) {
+		rt.log(LevelWarn, "event delivery failed", Fields{"error": err.Error()})
+	})
+	s.closers = append(s.closers, rt.events.close)
+
+	// Discover the downstream endpoints before accepting requests
+	if settings.Issuer != "" {
+		if err := rt.discover(); err != nil {
+			s.release()
+			return nil, fmt.Errorf("openid discovery for %s failed: %w", settings.Issuer, err)
+		}
+
+		rt.downstreamWaitGroup.Add(1)
+		go rt.discoveryRefresher(settings.DiscoveryRefresh)
+	}
+
+	s.serve = func(srv *http.Server, l net.Listener) error {
+		if tlsConfig == nil {
+			return srv.Serve(l)
+		}
+
+		srv.TLSConfig = tlsConfig
+		return srv.ServeTLS(l, settings.ListenerTLS.CertFile, settings.ListenerTLS.KeyFile)
+	}
+
+	return s, nil
+}
+
+// Start listens on the settings' listen address and serves requests in the background.
+// A port of 0 listens on a random port, reported by Addr.
+func (s *Server) Start() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.srv != nil {
+		return errors.New("server already started")
+	}
+
+	if s.rt.ctx.Err() != nil {
+		return errors.New("server closed")
+	}
+
+	l, err := net.Listen("tcp", s.settings.HTTPListenAddr)
+	if err != nil {
+		return err
+	}
+
+	s.listener = l
+	s.srv = &http.Server{Handler: s.Handler()}
+
+	downstream := s.settings.Endpoint
+	if s.settings.Issuer != "" {
+		downstream = s.settings.Issuer
+	}
+
+	scheme := "http"
+	if s.settings.ListenerTLS.CertFile != "" {
+		scheme = "https"
+	}
+	s.rt.logInfo("%s listening on %s for downstream %s", scheme, l.Addr(), downstream)
+
+	go func(srv *http.Server) {
+		if err := s.serve(srv, l); err != nil && err != http.ErrServerClosed {
+			s.rt.criticalError(err)
+		}
+	}(s.srv)
+
+	return nil
+}
+
+// Addr returns the address the server is listening on, blank until started.
+func (s *Server) Addr() string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.listener == nil {
+		return ""
+	}
+
+	return s.listener.Addr().String()
+}
+
+// Handler returns the handler serving proxy requests, for mounting in another server's mux.
+func (s *Server) Handler() http.Handler {
+	return http.HandlerFunc(s.rt.handleRequest)
+}
+
+// Stats returns the counts of the work done by the server.
+func (s *Server) Stats() Stats {
+	c := s.rt.stats
+
+	return Stats{
+		Requests:           atomic.LoadUint64(&c.requests),
+		CacheHits:          atomic.LoadUint64(&c.cacheHits),
+		Coalesced:          atomic.LoadUint64(&c.coalesced),
+		DownstreamRequests: atomic.LoadUint64(&c.downstreamRequests),
+		DownstreamErrors:   atomic.LoadUint64(&c.downstreamErrors),
+		Rejected:           s.rt.rejectedCount(),
+		CacheEntries:       cacheLen(s.rt.cache),
+	}
+}
+
+// Cache returns the cache holding the server's downstream responses.
+func (s *Server) Cache() Cache {
+	return s.rt.cache
+}
+
+// CacheKey returns the key the response to the request is cached under.
+// An error is returned if the request is not one the proxy caches.
+func (s *Server) CacheKey(r *http.Request) (CacheKey, error) {
+	w := &discardWriter{header: http.Header{}}
+
+	tr, ok := s.rt.parseRequest(w, r)
+	if !ok {
+		return CacheKey{}, fmt.Errorf("%s %s not a proxy request, status %d", r.Method, r.URL.Path, w.status)
+	}
+
+	if !tr.isCacheable() {
+		return CacheKey{}, fmt.Errorf("%s %s is not cached", r.Method, r.URL.Path)
+	}
+
+	return CacheKey{tr: tr.cacheKey()}, nil
+}
+
+// SeedToken caches body, a successful token response, as the reply to the request cached under key,
+// valid for ttl.  The token is recorded as if the provider had issued it, so it is recognised by
+// introspection and evicted when revoked.
+func (s *Server) SeedToken(key CacheKey, body []byte, ttl time.Duration) {
+	now := time.Now().UTC()
+	info, _ := parseTokenResponse(body, now)
+
+	s.rt.cache.Set(key, CacheEntry{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": {"application/json"}},
+		Body:       body,
+		Expiry:     now.Add(ttl),
+		info:       info,
+	})
+}
+
+// Reload applies new settings to the running server.  Settings needing a restart are logged and ignored.
+func (s *Server) Reload(settings Settings) error {
+	return s.rt.reload(settings)
+}
+
+// Done is closed when the server stops, either as its context was cancelled,
+// it failed or it was closed.
+func (s *Server) Done() <-chan struct{} {
+	return s.rt.done()
+}
+
+// Err returns the error that stopped the server, if any.  It may be called at any time,
+// but only reports the final outcome once Done is closed.
+func (s *Server) Err() error {
+	return s.rt.failure()
+}
+
+// Close stops the server, allowing requests in progress the settings' shutdown grace
+// period to complete, and releases its resources.
+func (s *Server) Close() error {
+	s.closeOnce.Do(func() {
+		// Mark that we are stopping
+		s.rt.logInfo("shutting down ...")
+		s.rt.setStopping()
+
+		s.lock.Lock()
+		srv := s.srv
+		s.lock.Unlock()
+
+		if srv != nil {
+			ctxShutDown, cancel := context.WithTimeout(context.Background(), s.settings.ShutdownGracePeriod)
+			s.closeErr = srv.Shutdown(ctxShutDown)
+			cancel()
+		}
+
+		s.release()
+	})
+
+	return s.closeErr
+}
+
+// release closes the server's resources in the reverse order they were opened.
+func (s *Server) release() {
+	for i := len(s.closers) - 1; i >= 0; i-- {
+		s.closers[i]()
+	}
+	s.closers = nil
+}
+
+// count atomically increments a counter.
+func count(counter *uint64) {
+	atomic.AddUint64(counter, 1)
+}
+
+// Header implements http.ResponseWriter.
+func (dw *discardWriter) Header() http.Header {
+	return dw.header
+}
+
+// Write implements http.ResponseWriter.
+func (dw *discardWriter) Write(b []byte) (int, error) {
+	return len(b), nil
+}
+
+// WriteHeader implements http.ResponseWriter.
+func (dw *discardWriter) WriteHeader(statusCode int) {
+	dw.status = statusCode
+}
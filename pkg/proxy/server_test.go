@@ -0,0 +1,216 @@
+/*
+Copyright © 2018-2021 Neil Hemming
+*/
+
+package proxy
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func tokenRequester(calls *int) Requester {
+	return func(ctx context.Context, req *http.Request) (*http.Response, error) {
+		*calls++
+
+		w := httptest.NewRecorder()
+		w.WriteHeader(http.StatusOK)
+		_, err := w.WriteString("{\"access_token\":\"test\",\"expires_in\":3600}")
+		return w.Result(), err
+	}
+}
+
+func postToken(t *testing.T, tokenURL string) string {
+	t.Helper()
+
+	resp, err := http.PostForm(tokenURL, url.Values{
+		"grant_type": {"password"},
+		"client_id":  {"123"},
+		"username":   {"u1"},
+		"password":   {"p1"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	body, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatal("Unexpected status", resp.StatusCode, string(body))
+	}
+
+	return string(body)
+}
+
+func TestNewServerInvalidSettingsFails(t *testing.T) {
+	if _, err := NewServer(context.Background(), DefaultSettings()); err == nil {
+		t.Error("Invalid settings not caught")
+	}
+}
+
+func TestServerStartServesAndCounts(t *testing.T) {
+	calls := 0
+	settings := DefaultSettings().
+		WithEndpoint("https://p.com").
+		WithHTTPPort(0).
+		WithRequester(tokenRequester(&calls))
+	settings.HTTPListenAddr = "127.0.0.1:0"
+
+	s, err := NewServer(context.Background(), settings)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if s.Addr() != "" {
+		t.Error("Addr before Start", s.Addr())
+	}
+
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Start(); err == nil {
+		t.Error("Second Start not caught")
+	}
+
+	tokenURL := "http://" + s.Addr() + "/oauth2/token"
+	for i := 0; i < 2; i++ {
+		if body := postToken(t, tokenURL); !strings.Contains(body, "test") {
+			t.Error("Unexpected reply", body)
+		}
+	}
+
+	stats := s.Stats()
+	if calls != 1 || stats.Requests != 2 || stats.DownstreamRequests != 1 || stats.CacheHits != 1 || stats.CacheEntries != 1 {
+		t.Error("Unexpected stats", calls, stats)
+	}
+
+	if err := s.Close(); err != nil {
+		t.Error("Close failed", err)
+	}
+
+	select {
+	case <-s.Done():
+	default:
+		t.Error("Done not closed")
+	}
+
+	if err := s.Close(); err != nil {
+		t.Error("Second Close failed", err)
+	}
+}
+
+func TestServerHandlerMountsWithCache(t *testing.T) {
+	calls := 0
+	cache := NewMemoryCache()
+	settings := DefaultSettings().
+		WithEndpoint("https://p.com").
+		WithRequester(tokenRequester(&calls)).
+		WithCache(cache)
+
+	s, err := NewServer(context.Background(), settings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	mux := http.NewServeMux()
+	mux.Handle("/auth/", http.StripPrefix("/auth", s.Handler()))
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	postToken(t, ts.URL+"/auth/oauth2/token")
+
+	if s.Cache() != cache || cacheLen(cache) != 1 {
+		t.Error("Cache not used", cacheLen(cache))
+	}
+
+	cache.Range(func(k CacheKey, e CacheEntry) bool {
+		if k.Path() != "/oauth2/token" || k.ClientID() != "123" || k.Username() != "u1" {
+			t.Error("Unexpected key", k.Path(), k.ClientID(), k.Username())
+		}
+		return true
+	})
+}
+
+func TestServerCacheKey(t *testing.T) {
+	s, err := NewServer(context.Background(), DefaultSettings().WithEndpoint("https://p.com"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	form := url.Values{"grant_type": {"password"}, "client_id": {"123"}, "username": {"u1"}, "password": {"p1"}}
+	req := httptest.NewRequest("POST", "/oauth2/token", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	key, err := s.CacheKey(req)
+	if err != nil || key.ClientID() != "123" || key.Username() != "u1" || key.Path() != "/oauth2/token" {
+		t.Error("Unexpected key", key, err)
+	}
+
+	req = httptest.NewRequest("GET", "/oauth2/token", nil)
+	if _, err := s.CacheKey(req); err == nil {
+		t.Error("Non proxy request not caught")
+	}
+}
+
+func TestServerCloseWithRequestsInFlight(t *testing.T) {
+	settings := DefaultSettings().
+		WithEndpoint("https://p.com").
+		WithRequester(func(ctx context.Context, req *http.Request) (*http.Response, error) {
+			time.Sleep(time.Millisecond)
+
+			w := httptest.NewRecorder()
+			w.WriteHeader(http.StatusOK)
+			_, err := w.WriteString("{\"access_token\":\"test\",\"expires_in\":3600}")
+			return w.Result(), err
+		})
+
+	s, err := NewServer(context.Background(), settings)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ts := httptest.NewServer(s.Handler())
+	defer ts.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			resp, err := http.PostForm(ts.URL+"/oauth2/token", url.Values{
+				"grant_type": {"password"},
+				"client_id":  {"123"},
+				"username":   {"u" + strconv.Itoa(i)},
+				"password":   {"p1"},
+			})
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			resp.Body.Close()
+
+			if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusServiceUnavailable {
+				t.Error("Unexpected status", resp.StatusCode)
+			}
+		}(i)
+	}
+
+	time.Sleep(5 * time.Millisecond)
+	if err := s.Close(); err != nil {
+		t.Error("Close failed", err)
+	}
+
+	wg.Wait()
+}
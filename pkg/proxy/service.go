@@ -0,0 +1,754 @@
+/*
+Copyright © 2018-2021 Neil Hemming
+*/
+
+// Package proxy provides the oauthproxy service, run by the oauthproxy command or embedded
+// in other Go programs using NewServer.
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/context/ctxhttp"
+)
+
+type (
+	// replyFunc writes a reply to the upstream client.
+	replyFunc func(http.ResponseWriter)
+
+	// downstreamResult is the outcome of a downstream request.
+	downstreamResult struct {
+		reply   replyFunc
+		outcome string
+		status  int
+	}
+
+	// resultChan delivers the outcome of a downstream request back to the waiting handler.
+	resultChan chan downstreamResult
+
+	// downstreamRequest is an active request to the downstream system for a token.
+	downstreamRequest struct {
+		tr        tokenRequest
+		requestID string
+		trace     spanContext
+		result    resultChan
+		stop      bool
+	}
+
+	// runtime contains all the service running state.
+	runtime struct {
+		ctx                 context.Context
+		settings            Settings
+		live                atomic.Value
+		reloadLock          sync.Mutex
+		issuer              string
+		metadata            *providerMetadata
+		metaLock            sync.RWMutex
+		err                 error
+		errLock             sync.Mutex
+		cancel              context.CancelFunc
+		cache               Cache
+		rejected            uint64
+		stats               *counters
+		poolSize            int
+		accessLog           *accessLogger
+		auditLog            *auditLogger
+		tracer              *tracer
+		events              *eventBus
+		circuit             *circuitBreaker
+		health              credentialHealth
+		revoked             revokedTokens
+		downstream          chan downstreamRequest
+		downstreamWaitGroup sync.WaitGroup
+		isStopping          int32
+		requester           Requester
+		client              *http.Client
+	}
+)
+
+// Run will setup and run the server until the passed context is cancelled.
+// If the server cannot be run, or fails to shut gracefully an error will be returned.
+func Run(ctx context.Context, settings Settings) error {
+	return RunWithReload(ctx, settings, nil)
+}
+
+// RunWithReload runs the server as Run, applying settings received from reload to the running service.
+// Invalid settings are logged and rejected without disrupting the service.
+func RunWithReload(ctx context.Context, settings Settings, reload <-chan Settings) error {
+	s, err := NewServer(ctx, settings)
+	if err != nil {
+		return err
+	}
+
+	if err := s.Start(); err != nil {
+		_ = s.Close()
+		return err
+	}
+
+	// Wait for exit signal, applying any reloaded settings
+	for running := true; running; {
+		select {
+		case <-s.Done():
+			running = false
+		case next := <-reload:
+			if err := s.Reload(next); err != nil {
+				s.rt.logError("config reload rejected: %s", err)
+			}
+		}
+	}
+
+	err = s.Close()
+
+	// Check for fatal runtime error
+	if rtErr := s.Err(); rtErr != nil {
+		return rtErr
+	}
+
+	return err
+}
+
+// newRuntime creates the internal runtime object used to handle the service.
+func newRuntime(ctx context.Context, settings Settings) *runtime {
+	runningCtx, cancel := context.WithCancel(ctx)
+
+	rt := &runtime{
+		cancel:     cancel,
+		ctx:        runningCtx,
+		settings:   settings,
+		cache:      settings.Cache,
+		downstream: make(chan downstreamRequest),
+		issuer:     settings.Issuer,
+		circuit:    settings.CircuitBreaker.newCircuitBreaker(),
+		stats:      &counters{},
+	}
+
+	// Reloadable configuration, invalid clients, identities and ranges are reported by validateSettings
+	live, err := newLiveConfig(settings)
+	rt.live.Store(live)
+	if err != nil {
+		rt.logError("%s", err)
+	}
+
+	if rt.cache == nil {
+		rt.cache = NewMemoryCache()
+	}
+
+	// Default requester uses the runtime's client, http.DefaultClient if not set
+	rt.requester = settings.Requester
+	if rt.requester == nil {
+		rt.requester = func(ctx context.Context, req *http.Request) (*http.Response, error) {
+			return ctxhttp.Do(ctx, rt.client, req)
+		}
+	}
+
+	// Add the house keeping to the service waitgroup
+	// Ensures all services provided by runtime are completed before Run exits
+	rt.downstreamWaitGroup.Add(1)
+	go rt.housekeeper()
+
+	// Start backend, will exit once shutdown complete
+	_ = rt.resizePool(settings.PoolSize)
+
+	return rt
+}
+
+// parseRequest checks the request is for a token or provider document and extract the details.
+func (rt *runtime) parseRequest(w http.ResponseWriter, r *http.Request) (tokenRequest, bool) {
+	// Create a token request
+	tr := tokenRequest{
+		path: r.URL.Path,
+	}
+
+	// Provider documents are keyed by path alone
+	if r.Method == "GET" && isDocumentPath(tr.path) {
+		tr.kind = documentKind
+		return tr, true
+	}
+
+	// Userinfo is keyed by the bearer token
+	if r.Method == "GET" && isUserinfoPath(tr.path) {
+		return rt.parseUserinfoRequest(w, r, tr)
+	}
+
+	// Named identities use credentials held by the proxy
+	if name, ok := identityName(tr.path); ok && r.Method == "GET" {
+		return rt.parseIdentityRequest(w, name)
+	}
+
+	// Basic routing, otherwise only interested in token, introspection and revocation requests
+	kind, ok := postKind(tr.path)
+	if r.Method != "POST" || !ok {
+		replyNotFound(w)
+		return tr, false
+	}
+
+	// Parse credentials form
+	if err := r.ParseForm(); err != nil {
+		rt.logError("parse request error %s", err)
+		replyInvalid(w)
+		return tr, false
+	}
+
+	parseClientAuth(r, &tr)
+	rt.injectClient(&tr)
+
+	switch kind {
+	case introspectKind, revokeKind:
+		tr, ok = rt.parseTokenParamRequest(w, r, tr, kind)
+	case deviceCodeKind:
+		tr, ok = parseDeviceCodeRequest(r, tr)
+	default:
+		tr, ok = rt.parseGrant(w, r, tr)
+	}
+
+	if ok {
+		rt.identifyAssertions(&tr)
+	}
+
+	return tr, ok
+}
+
+// postKind returns the kind of request a POST to path is.
+func postKind(path string) (requestKind, bool) {
+	switch {
+	case strings.HasSuffix(path, "/token"):
+		return tokenKind, true
+	case isIntrospectPath(path):
+		return introspectKind, true
+	case isRevokePath(path):
+		return revokeKind, true
+	case isDeviceCodePath(path):
+		return deviceCodeKind, true
+	}
+
+	return tokenKind, false
+}
+
+// parseTokenParamRequest extracts the details of an introspection or revocation request.
+func (rt *runtime) parseTokenParamRequest(w http.ResponseWriter, r *http.Request, tr tokenRequest, kind requestKind) (tokenRequest, bool) {
+	tr.kind = kind
+	tr.token = r.PostFormValue("token")
+	tr.tokenTypeHint = r.PostFormValue("token_type_hint")
+
+	if tr.token == "" {
+		rt.logError("%s request without token", tr.path)
+		replyInvalid(w)
+		return tr, false
+	}
+
+	return tr, true
+}
+
+// parseClientAuth extracts the client credentials from a client assertion, the request header or form body.
+func parseClientAuth(r *http.Request, tr *tokenRequest) {
+	// Test for a client assertion
+	if r.PostFormValue("client_assertion_type") == clientAssertionTypeJWT {
+		tr.authMode = authWithAssertion
+		tr.clientID = r.PostFormValue("client_id")
+		tr.clientAssertion = r.PostFormValue("client_assertion")
+		return
+	}
+
+	// Test for auth in header
+	if u, p, ok := r.BasicAuth(); ok {
+		tr.authMode = authInHeader
+		tr.clientID = u
+		tr.clientSecret = p
+	} else {
+		tr.authMode = authInBody
+		tr.clientID = r.PostFormValue("client_id")
+		tr.clientSecret = r.PostFormValue("client_secret")
+	}
+}
+
+// close terminates the service. It can only be called once
+// use rt.cancel to initiate shutdown.
+func (rt *runtime) close() {
+	// Cancel the context, will close house keeping and the downstream workers.
+	// The downstream channel is never closed, as handlers may still be sending to it.
+	rt.setStopping()
+	rt.cancel()
+
+	// Wait for all downstreamService have closed
+	rt.downstreamWaitGroup.Wait()
+
+	rt.logInfo("shutdown complete")
+}
+
+// setStopping marks the service as stopping, new downstream requests are refused.
+func (rt *runtime) setStopping() {
+	atomic.StoreInt32(&rt.isStopping, 1)
+}
+
+// stopping reports if the service is stopping.
+func (rt *runtime) stopping() bool {
+	return atomic.LoadInt32(&rt.isStopping) != 0
+}
+
+// criticalError captures a any errors that can terminate the service
+// Using this method avoids the need for log.Fatal type calls to exit
+// the process.  Allows Run contract to be respected.
+func (rt *runtime) criticalError(err error) {
+	rt.errLock.Lock()
+	rt.err = err
+	rt.errLock.Unlock()
+
+	rt.cancel()
+}
+
+// failure returns the error captured by criticalError, if any.
+func (rt *runtime) failure() error {
+	rt.errLock.Lock()
+	defer rt.errLock.Unlock()
+
+	return rt.err
+}
+
+// logInfo logs a info message for the service.
+func (rt *runtime) logInfo(format string, args ...interface{}) {
+	rt.log(LevelInfo, fmt.Sprintf(format, args...), nil)
+}
+
+// logError logs a error message for the service.
+func (rt *runtime) logError(format string, args ...interface{}) {
+	rt.log(LevelError, fmt.Sprintf(format, args...), nil)
+}
+
+// done captures the running contexts exit channel.
+func (rt *runtime) done() <-chan struct{} {
+	return rt.ctx.Done()
+}
+
+// handleRequest handles the incoming http token request.
+func (rt *runtime) handleRequest(w http.ResponseWriter, r *http.Request) {
+	count(&rt.stats.requests)
+
+	// Correlate log messages and downstream requests with the caller
+	r = withRequestID(w, r)
+
+	// Capture the reply status for the access log and trace
+	aw := &accessWriter{ResponseWriter: w}
+	w = aw
+
+	// Record the request in the access log once replied to
+	if rt.accessLog != nil {
+		var rec *accessRecord
+		r, rec = withAccessRecord(r, time.Now())
+		defer func() { rt.accessLog.write(rec, aw, time.Now()) }()
+	}
+
+	// Trace the request, continuing the caller's trace if it sent a traceparent
+	r = withInboundTrace(r)
+	ctx, sp := rt.tracer.startSpan(r.Context(), "oauthproxy "+routeName(r), spanKindServer)
+	r = r.WithContext(ctx)
+	sp.setAttr("http.method", r.Method)
+	sp.setAttr("http.target", r.URL.Path)
+	sp.setAttr("request_id", requestID(ctx))
+	defer func() {
+		sp.setAttr("http.status_code", aw.status)
+		if aw.status >= http.StatusInternalServerError {
+			sp.setError(fmt.Errorf("status %d", aw.status))
+		}
+		sp.finish()
+	}()
+
+	// Reject sources not permitted to use the proxy
+	if !rt.filterSource(w, r) {
+		return
+	}
+
+	// Authenticate the caller before looking at the request
+	if !rt.authorizeCaller(w, r) {
+		return
+	}
+
+	// Check the request isa a valid token request
+	tr, matched := rt.parseRequest(w, r)
+	if !matched {
+		// parse handles client responses
+		return
+	}
+
+	if rec := accessRecordFrom(r.Context()); rec != nil {
+		rec.clientID, rec.username = tr.clientID, tr.username
+	}
+
+	// Introspection of tokens issued by the proxy is answered locally
+	if tr.kind == introspectKind && rt.introspectLocally(w, tr) {
+		count(&rt.stats.cacheHits)
+		setOutcome(r.Context(), outcomeHit)
+		return
+	}
+
+	// Revocation always goes to the provider, after evicting the token
+	if tr.kind == revokeKind {
+		rt.revoke(r.Context(), tr, w)
+		return
+	}
+
+	// Check to see if the token request is already in the cache
+	_, lookupSpan := rt.tracer.startSpan(r.Context(), "cache lookup", spanKindInternal)
+	entry := rt.lookup(tr)
+	lookupSpan.setAttr("cache.found", entry.Body != nil)
+	lookupSpan.finish()
+
+	// If thee entry is not valid request a token from the down stream service.
+	if entry.Body == nil || entry.Expiry.Before(time.Now().UTC()) {
+		// Not found or expied, request new token
+		if entry.Body != nil {
+			setOutcome(r.Context(), outcomeStale)
+		}
+		rt.requestFromDownstream(r.Context(), tr, w)
+		return
+	}
+
+	// Found here, reply without bothering downstream service
+	count(&rt.stats.cacheHits)
+	setOutcome(r.Context(), outcomeHit)
+	rt.reply(w, entry)
+}
+
+// housekeeper runs the house keeping service.
+func (rt *runtime) housekeeper() {
+	// Mark closure in work group
+	defer rt.downstreamWaitGroup.Done()
+
+	for {
+		// Set up a context to time out after the house keeping period
+		wait, cancel := context.WithTimeout(rt.ctx, rt.config().houseKeeperPeriod)
+
+		// Wait for timeout or the process to exit
+		<-wait.Done()
+		cancel()
+
+		// Time to exit?
+		if rt.ctx.Err() != nil {
+			return
+		}
+
+		// Do some house keeping
+		rt.clean(time.Now().UTC())
+	}
+}
+
+// downstreamService executes the main down stream request processing.
+func (rt *runtime) downstreamService() {
+	// Mark closure in work group
+	defer rt.downstreamWaitGroup.Done()
+
+	// Consume the channel queue, until the service stops or the worker is asked to stop as the pool has shrunk
+	for {
+		select {
+		case dReq := <-rt.downstream:
+			if dReq.stop {
+				return
+			}
+			rt.processDownstreamRequest(dReq)
+		case <-rt.done():
+			return
+		}
+	}
+}
+
+// processDownstreamRequest handles an individual down sstream request.
+// The outcome is always sent to the result channel, which is buffered so
+// the worker never blocks on a caller that has gone away.
+func (rt *runtime) processDownstreamRequest(dReq downstreamRequest) {
+	dReq.result <- rt.resolveDownstreamRequest(dReq.tr, dReq.requestID, dReq.trace)
+}
+
+// resolveDownstreamRequest returns the reply for a down stream request.
+func (rt *runtime) resolveDownstreamRequest(tr tokenRequest, requestID string, trace spanContext) downstreamResult {
+	// Check if we have started stopping
+	if rt.stopping() {
+		// Not available to service
+		return downstreamResult{reply: replyServiceUnavailable}
+	}
+
+	// Double check if token exists
+	if tr.isCacheable() {
+		entry := rt.lookup(tr)
+		if entry.Body != nil && entry.Expiry.After(time.Now().UTC()) {
+			// Already have, fetched by a request queued ahead of this one
+			count(&rt.stats.coalesced)
+			return downstreamResult{reply: rt.replyWithEntry(entry), outcome: outcomeCoalesced}
+		}
+	}
+
+	// Process the down stream request
+	return rt.getDownstreamToken(tr, requestID, trace)
+}
+
+// requestFromDownstream is called when a client request needs to get a new token.
+// If the client goes away while waiting the request is abandoned by the handler, however
+// any request already queued is still completed and its result cached.
+func (rt *runtime) requestFromDownstream(ctx context.Context, tr tokenRequest, w http.ResponseWriter) {
+	if rt.stopping() {
+		replyServiceUnavailable(w)
+		return
+	}
+
+	id := requestID(ctx)
+	rt.logRequest(LevelDebug, id, "passing on downstream request", Fields{"path": tr.path})
+
+	// Send the request to the downs stream queue
+	// The result channel is buffered so the worker can always deliver its reply.
+	result := make(resultChan, 1)
+
+	trace, _ := spanContextFrom(ctx)
+	_, waitSpan := rt.tracer.startSpan(ctx, "queue wait", spanKindInternal)
+	defer waitSpan.finish()
+
+	select {
+	case rt.downstream <- downstreamRequest{tr: tr, requestID: id, trace: trace, result: result}:
+	case <-ctx.Done():
+		rt.logRequest(LevelInfo, id, "client left before request was queued", Fields{"path": tr.path})
+		return
+	case <-rt.done():
+		replyServiceUnavailable(w)
+		return
+	}
+
+	// Wait for the result or the client to go away
+	select {
+	case res := <-result:
+		waitSpan.finish()
+		if rec := accessRecordFrom(ctx); rec != nil {
+			rec.downstreamStatus = res.status
+			if res.outcome != "" {
+				rec.outcome = res.outcome
+			} else if rec.outcome == "" {
+				rec.outcome = outcomeMiss
+			}
+		}
+		res.reply(w)
+	case <-ctx.Done():
+		rt.logRequest(LevelInfo, id, "client left while waiting", Fields{"path": tr.path})
+	}
+}
+
+// getDownstreamToken handles downstream requests, caching the result.
+// The request is made using the service context so the outcome is cached
+// even if the original caller is no longer waiting.  The caller's correlation ID
+// and trace context are passed downstream.
+func (rt *runtime) getDownstreamToken(tr tokenRequest, requestID string, trace spanContext) downstreamResult {
+	// create a request
+	req, err := tr.prepareRequest(rt.downstreamURL(tr))
+	if err != nil {
+		// Problem creating request
+		rt.logRequest(LevelError, requestID, "prepare request failed", Fields{"path": tr.path, "error": err.Error()})
+		return downstreamResult{reply: replyInvalid}
+	}
+
+	if requestID != "" {
+		req.Header.Set(requestIDHeader, requestID)
+	}
+
+	sp := rt.tracer.start(trace, trace.valid(), "downstream "+req.Method, spanKindClient)
+	defer sp.finish()
+	sp.setAttr("http.method", req.Method)
+	sp.setAttr("http.url", req.URL.Scheme+"://"+req.URL.Host+req.URL.Path)
+
+	// Without a tracer the caller's trace context is passed through unchanged
+	if sp != nil {
+		req.Header.Set(traceparentHeader, sp.sc.traceparent())
+	} else if trace.valid() {
+		req.Header.Set(traceparentHeader, trace.traceparent())
+	}
+
+	// Protect a failing provider from further requests until the circuit cools down
+	if !rt.circuit.allow(time.Now().UTC()) {
+		rt.logRequest(LevelWarn, requestID, "circuit open, downstream request refused", Fields{"url": req.URL.String()})
+		return downstreamResult{reply: replyServiceUnavailable}
+	}
+
+	rt.logRequest(LevelInfo, requestID, "downstream request", Fields{"url": req.URL.String()})
+
+	// Create a context to timeout in case of no response
+	ctxTimeout, cancel := context.WithTimeout(rt.ctx, rt.config().requestTimeout)
+	defer cancel()
+
+	// Round trip request
+	count(&rt.stats.downstreamRequests)
+	resp, err := rt.requester(ctxTimeout, req)
+	if err != nil {
+		count(&rt.stats.downstreamErrors)
+		rt.logRequest(LevelError, requestID, "send request failed", Fields{"url": req.URL.String(), "error": err.Error()})
+		rt.audit(tr, req.URL, 0, nil, err)
+		rt.notify(tr, req.URL, 0, nil, err)
+		sp.setError(err)
+		return downstreamResult{reply: replyInvalid}
+	}
+
+	// Get the body
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	resp.Body.Close()
+	if err != nil {
+		// Bad read, error
+		count(&rt.stats.downstreamErrors)
+		rt.logRequest(LevelError, requestID, "read body failed", Fields{"url": req.URL.String(), "error": err.Error()})
+		rt.audit(tr, req.URL, resp.StatusCode, nil, err)
+		rt.notify(tr, req.URL, resp.StatusCode, nil, err)
+		return downstreamResult{reply: replyInvalid}
+	}
+
+	rt.audit(tr, req.URL, resp.StatusCode, body, nil)
+	rt.notify(tr, req.URL, resp.StatusCode, body, nil)
+	sp.setAttr("http.status_code", resp.StatusCode)
+
+	// Copy headers from downstream
+	header := http.Header{}
+	for key := range resp.Header {
+		header.Set(key, resp.Header.Get(key))
+	}
+
+	e := CacheEntry{
+		StatusCode: resp.StatusCode,
+		Header:     header,
+		Body:       body,
+	}
+
+	// Revoked tokens may have been cached by requests in flight while the provider was revoking them
+	if tr.kind == revokeKind && resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		rt.markRevoked(tr.token)
+	}
+
+	// If reply was a 500+ error or otherwise transient don't cache the result
+	if shouldCache(tr, resp.StatusCode, body) {
+		rt.update(tr, header, body, resp.StatusCode)
+	}
+
+	reply := func(w http.ResponseWriter) {
+		// Pass the downstream reply through unchanged
+		for key := range e.Header {
+			w.Header().Set(key, e.Header.Get(key))
+		}
+
+		w.WriteHeader(e.StatusCode)
+		if _, err := w.Write(e.Body); err != nil {
+			//	Write body error log
+			rt.logRequest(LevelWarn, requestID, "write reply failed", Fields{"error": err.Error()})
+		}
+	}
+
+	return downstreamResult{reply: reply, status: e.StatusCode}
+}
+
+// downstreamURL returns the downstream url for the request.
+func (rt *runtime) downstreamURL(tr tokenRequest) string {
+	switch tr.kind {
+	case documentKind:
+		return rt.documentURL(tr)
+	case introspectKind:
+		return rt.introspectionURL(tr)
+	case revokeKind:
+		return rt.revocationURL(tr)
+	case userinfoKind:
+		return rt.userinfoURL(tr)
+	case deviceCodeKind:
+		return rt.deviceAuthorizationURL(tr)
+	}
+
+	return rt.tokenURL(tr)
+}
+
+// shouldCache reports if a downstream response can be cached.
+func shouldCache(tr tokenRequest, statusCode int, body []byte) bool {
+	if !tr.isCacheable() {
+		return false
+	}
+
+	if statusCode >= http.StatusInternalServerError || statusCode == http.StatusTooManyRequests {
+		return false
+	}
+
+	// Device flow polling responses change as the user completes authorization
+	if tr.grantType == grantTypeDeviceCode && isPendingResponse(body) {
+		return false
+	}
+
+	return true
+}
+
+// replyWithEntry returns a reply func that replies with the passed cache entry.
+func (rt *runtime) replyWithEntry(e CacheEntry) replyFunc {
+	return func(w http.ResponseWriter) {
+		rt.reply(w, e)
+	}
+}
+
+// reply to a upstream request with an existing entry.
+func (rt *runtime) reply(w http.ResponseWriter, entry CacheEntry) {
+	// Send the reply back, set standard headers
+	w.Header().Set("Content-Type", "application/json;charset=UTF-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Pragma", "no-cache")
+
+	// Set headers from downstream
+	for key := range entry.Header {
+		w.Header().Set(key, entry.Header.Get(key))
+	}
+
+	w.WriteHeader(entry.StatusCode)
+	if _, err := w.Write(entry.Body); err != nil {
+		rt.log(LevelWarn, "write reply failed", Fields{"error": err.Error()})
+	}
+}
+
+// update updates entries in the cache.
+func (rt *runtime) update(tr tokenRequest, header http.Header, body []byte, statusCode int) {
+	rt.logInfo("update cache for %s with status %d", tr.path, statusCode)
+
+	now := time.Now().UTC()
+	cfg := rt.config()
+	expiry := now.Add(cfg.ttl)
+
+	var info tokenInfo
+
+	switch {
+	case tr.kind == documentKind:
+		// documents honour the providers caching instructions, within limits
+		expiry = documentExpiry(header, now, cfg.ttl, cfg.documentTTLMin, cfg.documentTTLMax)
+	case tr.kind == introspectKind:
+		// introspection results do not outlive the token
+		expiry = introspectionExpiry(body, expiry)
+	case tr.kind == userinfoKind:
+		// userinfo does not outlive the bearer token
+		expiry = rt.tokenExpiryBound(tr.token, now, expiry)
+	case statusCode == http.StatusOK:
+		// request succeeded, try and get expiry time from the request
+		// If the expiry in the token is shorter than our ttl reduce the time
+		if parsed, ok := parseTokenResponse(body, now); ok {
+			info = parsed
+			if info.expiry.After(now) && info.expiry.Before(expiry) {
+				expiry = info.expiry
+			}
+		}
+
+		// exchanged tokens are not cached beyond the life of the subject token
+		if tr.grantType == grantTypeTokenExchange {
+			expiry = rt.tokenExpiryBound(tr.exchange.subjectToken, now, expiry)
+		}
+	}
+
+	if rt.holdsRevoked(tr, info) {
+		rt.logInfo("response for %s holds a revoked token, not cached", tr.path)
+		return
+	}
+
+	rt.cache.Set(CacheKey{tr: tr.cacheKey()}, CacheEntry{
+		StatusCode: statusCode,
+		Expiry:     expiry,
+		Header:     header,
+		Body:       body,
+		info:       info,
+	})
+}
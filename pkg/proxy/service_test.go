@@ -6,15 +6,12 @@ package proxy
 
 import (
 	"context"
-	"encoding/json"
 	"errors"
 	"net/http"
 	"net/http/httptest"
 	"strings"
 	"testing"
 	"time"
-
-	"golang.org/x/oauth2"
 )
 
 func TestRun(t *testing.T) {
@@ -44,22 +41,22 @@ func TestNewRuntime(t *testing.T) {
 	rt := newRuntime(context.Background(), settings)
 	defer rt.close()
 
-	if rt.isStopping {
+	if rt.stopping() {
 		t.Error("Stopping set")
 	}
 
 	// Validate rt vs settings
-	if rt.ttl != settings.CacheTTL {
-		t.Errorf("Mismatch ttl %d vs CacheTTL %d", rt.ttl, settings.CacheTTL)
+	if rt.config().ttl != settings.CacheTTL {
+		t.Errorf("Mismatch ttl %d vs CacheTTL %d", rt.config().ttl, settings.CacheTTL)
 	}
-	if rt.requestTimeout != settings.RequestTimeout {
-		t.Errorf("Mismatch requestTimeout %d vs RequestTimeout %d", rt.requestTimeout, settings.RequestTimeout)
+	if rt.config().requestTimeout != settings.RequestTimeout {
+		t.Errorf("Mismatch requestTimeout %d vs RequestTimeout %d", rt.config().requestTimeout, settings.RequestTimeout)
 	}
-	if rt.endpoint != settings.Endpoint {
-		t.Errorf("Mismatch endpoint %s vs Endpoint %s", rt.endpoint, settings.Endpoint)
+	if rt.config().endpoint != settings.Endpoint {
+		t.Errorf("Mismatch endpoint %s vs Endpoint %s", rt.config().endpoint, settings.Endpoint)
 	}
-	if rt.houseKeeperPeriod != settings.CacheTTL {
-		t.Errorf("Mismatch houseKeeperPeriod %d vs CacheTTL %d", rt.houseKeeperPeriod, settings.CacheTTL)
+	if rt.config().houseKeeperPeriod != settings.CacheTTL {
+		t.Errorf("Mismatch houseKeeperPeriod %d vs CacheTTL %d", rt.config().houseKeeperPeriod, settings.CacheTTL)
 	}
 }
 
@@ -96,7 +93,7 @@ func TestLoggingInfo(t *testing.T) {
 		called = true
 	}
 
-	settings := DefaultSettings().WithEndpoint("test").WithLogger(fn)
+	settings := DefaultSettings().WithEndpoint("test").WithLogger(LoggerFunc(fn))
 	rt := newRuntime(context.Background(), settings)
 	defer rt.close()
 
@@ -123,7 +120,7 @@ func TestLoggingError(t *testing.T) {
 		called = true
 	}
 
-	settings := DefaultSettings().WithEndpoint("test").WithLogger(fn)
+	settings := DefaultSettings().WithEndpoint("test").WithLogger(LoggerFunc(fn))
 	rt := newRuntime(context.Background(), settings)
 	defer rt.close()
 
@@ -265,27 +262,27 @@ func TestCacheClean(t *testing.T) {
 
 	expired := now.Add(-time.Hour * 24)
 
-	rt.cache[key] = entry{
-		token:      []byte("test"),
-		statusCode: http.StatusOK,
-		expiry:     expired,
-	}
+	rt.cache.Set(CacheKey{tr: key}, CacheEntry{
+		Body:       []byte("test"),
+		StatusCode: http.StatusOK,
+		Expiry:     expired,
+	})
 
 	key2 := key
 	key2.clientID = "888"
-	rt.cache[key2] = entry{
-		token:      []byte("keep"),
-		statusCode: http.StatusOK,
-		expiry:     now,
-	}
+	rt.cache.Set(CacheKey{tr: key2}, CacheEntry{
+		Body:       []byte("keep"),
+		StatusCode: http.StatusOK,
+		Expiry:     now,
+	})
 
 	rt.clean(now)
 
-	if len(rt.cache) != 1 {
+	if cacheLen(rt.cache) != 1 {
 		t.Error("cache not cleared correctly")
 	}
 
-	if _, ok := rt.cache[key2]; !ok {
+	if _, ok := rt.cache.Get(CacheKey{tr: key2}); !ok {
 		t.Error("key2 missing")
 	}
 }
@@ -308,22 +305,22 @@ func TestLookup(t *testing.T) {
 	now := time.Date(2020, 0o1, 0o1, 0o1, 0o0, 0o0, 0o0, time.UTC)
 	expired := now.Add(-time.Hour * 24)
 
-	rt.cache[key] = entry{
-		token:      []byte("test"),
-		statusCode: http.StatusOK,
-		expiry:     expired,
-	}
+	rt.cache.Set(CacheKey{tr: key}, CacheEntry{
+		Body:       []byte("test"),
+		StatusCode: http.StatusOK,
+		Expiry:     expired,
+	})
 
 	entry := rt.lookup(key)
 
-	if string(entry.token) != "test" {
+	if string(entry.Body) != "test" {
 		t.Error("Invalid token", entry)
 	}
 
 	key.authMode = authInBody
 	entry = rt.lookup(key)
 
-	if string(entry.token) != "" {
+	if string(entry.Body) != "" {
 		t.Error("Invalid token found", entry)
 	}
 }
@@ -345,11 +342,11 @@ func TestHandlerFuncForCached(t *testing.T) {
 
 	expiry := time.Now().UTC().Add(time.Hour)
 
-	rt.cache[key] = entry{
-		token:      []byte("test"),
-		statusCode: http.StatusOK,
-		expiry:     expiry,
-	}
+	rt.cache.Set(CacheKey{tr: key}, CacheEntry{
+		Body:       []byte("test"),
+		StatusCode: http.StatusOK,
+		Expiry:     expiry,
+	})
 
 	reader := strings.NewReader("client_id=123&client_secret=456&grant_type=password&password=p1&scope=alpha+bravo&username=u1")
 	req, _ := http.NewRequest("POST", "http:/something/token", reader)
@@ -386,11 +383,11 @@ func TestHandlerFuncForExpiredBadUrlFails(t *testing.T) {
 
 	expiry := time.Now().UTC().Add(-time.Hour)
 
-	rt.cache[key] = entry{
-		token:      []byte("test"),
-		statusCode: http.StatusOK,
-		expiry:     expiry,
-	}
+	rt.cache.Set(CacheKey{tr: key}, CacheEntry{
+		Body:       []byte("test"),
+		StatusCode: http.StatusOK,
+		Expiry:     expiry,
+	})
 
 	reader := strings.NewReader("client_id=123&client_secret=456&grant_type=password&password=p1&scope=alpha+bravo&username=u1")
 	req, _ := http.NewRequest("POST", "http:/something/token", reader)
@@ -411,44 +408,6 @@ func TestHandlerFuncForExpiredBadUrlFails(t *testing.T) {
 	}
 }
 
-func TestHandlerFuncForExpiredGetsNewToken(t *testing.T) {
-	settings := DefaultSettings().WithEndpoint("test")
-	rt := newRuntime(context.Background(), settings)
-	defer rt.close()
-
-	expiry := time.Now().UTC().Add(3 * time.Minute)
-
-	rt.requester = func(ctx context.Context, req *http.Request) (*http.Response, error) {
-		w := httptest.NewRecorder()
-
-		w.WriteHeader(http.StatusOK)
-
-		t := &oauth2.Token{
-			AccessToken: "test",
-			Expiry:      expiry,
-		}
-		err := json.NewEncoder(w).Encode(t)
-		return w.Result(), err
-	}
-
-	reader := strings.NewReader("client_id=123&client_secret=456&grant_type=password&password=p1&scope=alpha+bravo&username=u1")
-	req, _ := http.NewRequest("POST", "http:/something/token", reader)
-	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
-
-	w := httptest.NewRecorder()
-
-	rt.handleRequest(w, req)
-
-	if w.Code != http.StatusOK {
-		t.Error("Non success status", w.Code)
-	}
-
-	body := w.Body.String()
-	if !strings.HasPrefix(body, "{\"access_token\":\"test\",\"expiry\":\"") {
-		t.Error("body:", body)
-	}
-}
-
 func TestHandlerFuncUpdate(t *testing.T) {
 	settings := DefaultSettings().WithEndpoint("test")
 	rt := newRuntime(context.Background(), settings)
@@ -465,12 +424,12 @@ func TestHandlerFuncUpdate(t *testing.T) {
 	}
 	rt.update(key, http.Header{}, []byte("test"), http.StatusOK)
 
-	found, ok := rt.cache[key]
+	found, ok := rt.cache.Get(CacheKey{tr: key})
 	if !ok {
 		t.Error("Not found key")
 	}
 
-	if found.statusCode != http.StatusOK {
+	if found.StatusCode != http.StatusOK {
 		t.Error("Entry not matching")
 	}
 }
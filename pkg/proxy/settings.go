@@ -0,0 +1,316 @@
+/*
+Copyright © 2018-2021 Neil Hemming
+*/
+
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	multierror "github.com/hashicorp/go-multierror"
+)
+
+const (
+	// CacheTTLMinValue is the default smallest time permitted by the service for cached tokens.
+	CacheTTLMinValue = 10 * time.Minute
+
+	// RequestTimeoutMinValue is the default smallest time permitted for request timeouts to down stream systems.
+	RequestTimeoutMinValue = 10 * time.Second
+
+	// ShutdownGracePeriodMinValue is the default smallest period of time the service can be configured to wait for a graceful exit.
+	ShutdownGracePeriodMinValue = 5 * time.Second
+
+	// DiscoveryRefreshMinValue is the default smallest period permitted between openid discovery refreshes.
+	DiscoveryRefreshMinValue = time.Minute
+)
+
+type (
+	// Limits are the lower bounds validation enforces on durations.
+	// The defaults suit long lived provider tokens, tests using short lived tokens can lower them.
+	Limits struct {
+		// CacheTTL is the smallest permitted cache TTL
+		CacheTTL time.Duration
+
+		// RequestTimeout is the smallest permitted downstream request timeout
+		RequestTimeout time.Duration
+
+		// ShutdownGracePeriod is the smallest permitted shutdown grace period
+		ShutdownGracePeriod time.Duration
+
+		// DiscoveryRefresh is the smallest permitted period between openid discovery refreshes
+		DiscoveryRefresh time.Duration
+	}
+
+	// SettingError is a problem with a setting found by validation.
+	SettingError struct {
+		// Setting is the name of the Settings field at fault
+		Setting string
+
+		// Err is the problem
+		Err error
+	}
+
+	// LoggerFunc logging function, flagged true for errors.  LoggerFunc implements Logger.
+	LoggerFunc func(bool, string, ...interface{})
+
+	// Requester sends a request to the downstream provider.
+	Requester func(ctx context.Context, req *http.Request) (*http.Response, error)
+
+	// Settings contains the proxy services settings.
+	Settings struct {
+		// CacheTTL how long a item remains valid in the cache
+		CacheTTL time.Duration
+
+		// RequestTimeout timeout period for a down sstream request
+		RequestTimeout time.Duration
+
+		// ShutdownGracePeriod how long to wait for shutdown
+		ShutdownGracePeriod time.Duration
+
+		// HTTPListenAddr address and port to listen on
+		HTTPListenAddr string
+
+		// Downstream endpoint
+		Endpoint string
+
+		// Issuer is the openid issuer url, when set the downstream endpoints are discovered
+		Issuer string
+
+		// DiscoveryRefresh is how often the openid configuration is refreshed
+		DiscoveryRefresh time.Duration
+
+		// DocumentTTLMin is the shortest time a provider document such as the JWKS is cached
+		DocumentTTLMin time.Duration
+
+		// DocumentTTLMax is the longest time a provider document is cached, zero is unbounded
+		DocumentTTLMax time.Duration
+
+		// IntrospectionFallback passes introspection requests for tokens not issued by the proxy to the provider
+		IntrospectionFallback bool
+
+		// Logger recices bogging messages from the service
+		Logger Logger
+
+		// Requester sends downstream requests, nil uses the transport's HTTP client
+		Requester Requester
+
+		// Cache stores downstream responses, nil uses an in process cache
+		Cache Cache
+
+		// PoolSize is the number of go routines servicing downstream requests
+		PoolSize int
+
+		// Transport configures the outbound HTTP client used for downstream requests
+		Transport TransportSettings
+
+		// Clients are the downstream client credentials held by the proxy, keyed by local alias
+		Clients map[string]ClientCredentials
+
+		// Identities are the named identities tokens can be requested for without credentials
+		Identities map[string]Identity
+
+		// CallerAuth configures authentication of callers to the proxy
+		CallerAuth CallerAuthSettings
+
+		// IPFilter restricts the source addresses permitted to use the proxy
+		IPFilter IPFilterSettings
+
+		// AccessLog configures the log of inbound requests
+		AccessLog AccessLogSettings
+
+		// AuditLog configures the audit trail of downstream token acquisitions
+		AuditLog AuditLogSettings
+
+		// Tracing configures export of trace spans
+		Tracing TracingSettings
+
+		// Events configures notification of refreshes, failures and circuit breaker trips
+		Events EventSettings
+
+		// CircuitBreaker configures suspension of provider requests after repeated failures
+		CircuitBreaker CircuitBreakerSettings
+
+		// Limits are the lower bounds enforced by validation
+		Limits Limits
+
+		// ListenerTLS configures HTTPS for the listener, required for mtls caller authentication
+		ListenerTLS ListenerTLSSettings
+	}
+)
+
+// DefaultSettings returns the default settings for the service.
+func DefaultSettings() Settings {
+	return Settings{
+		CacheTTL:            20 * time.Minute,
+		RequestTimeout:      30 * time.Second,
+		ShutdownGracePeriod: ShutdownGracePeriodMinValue,
+		HTTPListenAddr:      "127.0.0.1:8090",
+		PoolSize:            2,
+		DiscoveryRefresh:    time.Hour,
+		DocumentTTLMin:      time.Minute,
+		DocumentTTLMax:      24 * time.Hour,
+		Transport:           DefaultTransportSettings(),
+		CallerAuth:          CallerAuthSettings{HMACMaxSkew: 5 * time.Minute},
+		Limits:              DefaultLimits(),
+	}
+}
+
+// DefaultLimits returns the default lower bounds.
+func DefaultLimits() Limits {
+	return Limits{
+		CacheTTL:            CacheTTLMinValue,
+		RequestTimeout:      RequestTimeoutMinValue,
+		ShutdownGracePeriod: ShutdownGracePeriodMinValue,
+		DiscoveryRefresh:    DiscoveryRefreshMinValue,
+	}
+}
+
+// WithEndpoint sets the down stream oauth services endpoint, the request path is appended to this setting.
+func (settings Settings) WithEndpoint(endpoint string) Settings {
+	if endpoint != "" {
+		settings.Endpoint = endpoint
+	}
+
+	return settings
+}
+
+// WithIssuer sets the openid issuer used to discover the downstream endpoints.
+func (settings Settings) WithIssuer(issuer string) Settings {
+	if issuer != "" {
+		settings.Issuer = issuer
+	}
+
+	return settings
+}
+
+// WithHTTPPort creates a new settings with the HTTP port set to the passed value.
+func (settings Settings) WithHTTPPort(port uint) Settings {
+	if port != 0 {
+		parts := strings.Split(settings.HTTPListenAddr, ":")
+		if len(parts) == 2 {
+			settings.HTTPListenAddr = fmt.Sprintf("%s:%d", parts[0], port)
+		} else {
+			settings.HTTPListenAddr = fmt.Sprintf("127.0.0.1:%d", port)
+		}
+	}
+
+	return settings
+}
+
+// WithLogger creates anew settings with the passed logger function used for logging.
+func (settings Settings) WithLogger(logger Logger) Settings {
+	if logger != nil {
+		settings.Logger = logger
+	}
+
+	return settings
+}
+
+// WithRequester creates a new settings with the passed requester used to send downstream requests.
+func (settings Settings) WithRequester(requester Requester) Settings {
+	settings.Requester = requester
+
+	return settings
+}
+
+// WithCache creates a new settings with the passed cache used to store downstream responses.
+func (settings Settings) WithCache(cache Cache) Settings {
+	settings.Cache = cache
+
+	return settings
+}
+
+// Validate checks the settings, reporting every problem found.
+// Each problem is a *SettingError identifying the setting at fault.
+func (settings Settings) Validate() error {
+	return settings.validateSettings()
+}
+
+// Error returns the setting and the problem with it.
+func (e *SettingError) Error() string {
+	return e.Setting + ": " + e.Err.Error()
+}
+
+// Unwrap returns the problem with the setting.
+func (e *SettingError) Unwrap() error {
+	return e.Err
+}
+
+func (settings Settings) validateSettings() error {
+	var result error
+
+	invalid := func(setting string, err error) {
+		if err != nil {
+			result = multierror.Append(result, &SettingError{Setting: setting, Err: err})
+		}
+	}
+
+	limits := settings.Limits
+
+	if limits.CacheTTL < 0 || limits.RequestTimeout < 0 || limits.ShutdownGracePeriod < 0 || limits.DiscoveryRefresh < 0 {
+		invalid("Limits", errors.New("lower bounds cannot be negative"))
+	}
+
+	invalid("CacheTTL", atLeast("cache TTL", settings.CacheTTL, limits.CacheTTL))
+	invalid("RequestTimeout", atLeast("request timeout", settings.RequestTimeout, limits.RequestTimeout))
+	invalid("ShutdownGracePeriod", atLeast("service shutdown grace period", settings.ShutdownGracePeriod, limits.ShutdownGracePeriod))
+
+	if settings.HTTPListenAddr == "" {
+		invalid("HTTPListenAddr", errors.New("no listen address provided"))
+	}
+
+	if settings.Endpoint == "" && settings.Issuer == "" {
+		invalid("Endpoint", errors.New("endpoint and issuer cannot both be blank"))
+	}
+
+	if settings.Issuer != "" {
+		invalid("DiscoveryRefresh", atLeast("discovery refresh", settings.DiscoveryRefresh, limits.DiscoveryRefresh))
+	}
+
+	if settings.PoolSize < 1 {
+		invalid("PoolSize", fmt.Errorf("pool size must be bigger than %d", 1))
+	}
+
+	if settings.DocumentTTLMin < 0 {
+		invalid("DocumentTTLMin", errors.New("document TTL minimum cannot be negative"))
+	}
+
+	if settings.DocumentTTLMax > 0 && settings.DocumentTTLMax < settings.DocumentTTLMin {
+		invalid("DocumentTTLMax", errors.New("document TTL maximum must not be less than the minimum"))
+	}
+
+	_, err := newClientRegistry(settings.Clients)
+	invalid("Clients", err)
+
+	_, err = newIdentityRegistry(settings.Identities)
+	invalid("Identities", err)
+
+	invalid("CallerAuth", settings.CallerAuth.validateSettings(settings.ListenerTLS))
+	invalid("IPFilter", settings.IPFilter.validateSettings())
+	invalid("AccessLog", settings.AccessLog.validateSettings())
+	invalid("AuditLog", settings.AuditLog.validateSettings())
+	invalid("Tracing", settings.Tracing.validateSettings())
+	invalid("Events", settings.Events.validateSettings())
+	invalid("CircuitBreaker", settings.CircuitBreaker.validateSettings())
+	invalid("Transport", settings.Transport.validateSettings())
+
+	return result
+}
+
+// atLeast checks a duration is positive and not less than its lower bound.
+func atLeast(name string, d, bound time.Duration) error {
+	if d <= 0 {
+		return fmt.Errorf("%s must be positive", name)
+	}
+
+	if d < bound {
+		return fmt.Errorf("%s must be at least %s", name, bound)
+	}
+
+	return nil
+}
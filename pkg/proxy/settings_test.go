@@ -5,8 +5,11 @@ Copyright © 2018-2021 Neil Hemming
 package proxy
 
 import (
+	"errors"
 	"testing"
 	"time"
+
+	"github.com/hashicorp/go-multierror"
 )
 
 func TestShutdownGracePeriodMinValue(t *testing.T) {
@@ -84,7 +87,7 @@ func TestWWithLogger(t *testing.T) {
 
 	fn := func(bool, string, ...interface{}) {}
 
-	settingsWithLogger := settings.WithLogger(fn)
+	settingsWithLogger := settings.WithLogger(LoggerFunc(fn))
 
 	if settingsWithLogger.Logger == nil {
 		t.Error("Logger is nil")
@@ -169,3 +172,77 @@ func TestValidateSettingsBadHTTPListenAddrFails(t *testing.T) {
 		t.Error("Bad HTTPListenAddr not caught")
 	}
 }
+
+func TestValidateSettingsIssuerOnlySucceeds(t *testing.T) {
+	settings := DefaultSettings().WithIssuer("https://p.com")
+
+	err := settings.validateSettings()
+	if err != nil {
+		t.Error("DefaultSettings WithIssuer has error", err)
+	}
+}
+
+func TestValidateSettingsBadDiscoveryRefreshFails(t *testing.T) {
+	settings := DefaultSettings().WithIssuer("https://p.com")
+
+	settings.DiscoveryRefresh = DiscoveryRefreshMinValue - 1
+
+	err := settings.validateSettings()
+
+	if err == nil {
+		t.Error("Bad DiscoveryRefresh not caught")
+	}
+}
+
+func TestValidateSettingsLoweredLimitsSucceeds(t *testing.T) {
+	settings := DefaultSettings().WithEndpoint("test")
+
+	settings.Limits.CacheTTL = 30 * time.Second
+	settings.Limits.RequestTimeout = time.Second
+	settings.CacheTTL = 30 * time.Second
+	settings.RequestTimeout = time.Second
+
+	err := settings.Validate()
+	if err != nil {
+		t.Error("Lowered limits has error", err)
+	}
+}
+
+func TestValidateSettingsZeroDurationFailsWithoutLimits(t *testing.T) {
+	settings := DefaultSettings().WithEndpoint("test")
+
+	settings.Limits = Limits{}
+	settings.CacheTTL = 0
+
+	err := settings.Validate()
+	if err == nil {
+		t.Error("Zero CacheTTL not caught")
+	}
+}
+
+func TestValidateSettingsReportsEverySetting(t *testing.T) {
+	settings := DefaultSettings()
+
+	settings.CacheTTL = time.Second
+	settings.PoolSize = 0
+
+	var merr *multierror.Error
+	if err := settings.Validate(); !errors.As(err, &merr) {
+		t.Fatal("expected multiple errors", err)
+	}
+
+	found := make(map[string]bool)
+	for _, e := range merr.Errors {
+		var se *SettingError
+		if !errors.As(e, &se) {
+			t.Fatal("not a SettingError", e)
+		}
+		found[se.Setting] = true
+	}
+
+	for _, setting := range []string{"CacheTTL", "PoolSize", "Endpoint"} {
+		if !found[setting] {
+			t.Error("setting not reported", setting, merr)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+/*
+Copyright © 2018-2021 Neil Hemming
+*/
+
+package proxy
+
+import (
+	"encoding/json"
+	"time"
+)
+
+type (
+	// tokenInfo contains the details of an issued token extracted from a token response.
+	tokenInfo struct {
+		accessToken  string
+		refreshToken string
+		tokenType    string
+		scope        string
+		expiry       time.Time
+	}
+
+	// tokenResponse is the JSON form of a token endpoint response.
+	// Expiry is not part of RFC 6749 but is produced by golang.org/x/oauth2 based services.
+	tokenResponse struct {
+		AccessToken  string      `json:"access_token"`
+		RefreshToken string      `json:"refresh_token,omitempty"`
+		TokenType    string      `json:"token_type,omitempty"`
+		Scope        string      `json:"scope,omitempty"`
+		ExpiresIn    json.Number `json:"expires_in,omitempty"`
+		Expiry       time.Time   `json:"expiry,omitempty"`
+	}
+)
+
+// parseTokenResponse extracts the token details from a successful token response body.
+// The expiry is calculated relative to now when the response only provides expires_in.
+func parseTokenResponse(body []byte, now time.Time) (tokenInfo, bool) {
+	var resp tokenResponse
+
+	if err := json.Unmarshal(body, &resp); err != nil || resp.AccessToken == "" {
+		return tokenInfo{}, false
+	}
+
+	info := tokenInfo{
+		accessToken:  resp.AccessToken,
+		refreshToken: resp.RefreshToken,
+		tokenType:    resp.TokenType,
+		scope:        resp.Scope,
+		expiry:       resp.Expiry,
+	}
+
+	if secs, err := resp.ExpiresIn.Int64(); err == nil && secs > 0 {
+		info.expiry = now.Add(time.Duration(secs) * time.Second)
+	}
+
+	return info, true
+}
+
+// tokenExpiryBound limits expiry to that of the token.
+// The expiry is known if the token was issued through the proxy or is a JWT with an exp claim.
+func (rt *runtime) tokenExpiryBound(token string, now, expiry time.Time) time.Time {
+	if _, info, ok := rt.findIssued(token, now); ok && !info.expiry.IsZero() && info.expiry.Before(expiry) {
+		return info.expiry
+	}
+
+	if exp, ok := jwtExpiry(token); ok && exp.Before(expiry) {
+		return exp
+	}
+
+	return expiry
+}
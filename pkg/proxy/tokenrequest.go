@@ -0,0 +1,207 @@
+/*
+Copyright © 2018-2021 Neil Hemming
+*/
+
+package proxy
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const (
+	authInHeader = authType(iota)
+	authInBody
+
+	// authWithAssertion authenticates the client with a client_assertion JWT (private_key_jwt).
+	authWithAssertion
+)
+
+const (
+	// tokenKind is a POST request for a token.
+	tokenKind = requestKind(iota)
+
+	// documentKind is a GET request for a provider document such as the JWKS.
+	documentKind
+
+	// introspectKind is a token introspection request (RFC 7662).
+	introspectKind
+
+	// revokeKind is a token revocation request (RFC 7009), these are never cached.
+	revokeKind
+
+	// userinfoKind is a GET request for the openid userinfo of a bearer token.
+	userinfoKind
+
+	// deviceCodeKind is a device authorization request (RFC 8628), these are never cached.
+	deviceCodeKind
+)
+
+type (
+	authType int
+
+	// requestKind identifies the type of request being proxied.
+	requestKind int
+
+	tokenRequest struct {
+		kind         requestKind
+		grantType    string
+		path         string
+		clientID     string
+		clientSecret string
+		username     string
+		password     string
+		scopes       string
+		authMode     authType
+
+		// token is the token presented for introspection, revocation or userinfo
+		token         string
+		tokenTypeHint string
+
+		// deviceCode is the device code polled for in the device grant
+		deviceCode string
+
+		// params are the encoded form parameters forwarded with a device authorization request
+		params string
+
+		// clientAssertion is the client authentication JWT and assertion the jwt-bearer grant JWT.
+		// Both are single use so once verified are replaced by their identities in the cache key.
+		clientAssertion string
+		assertion       string
+
+		// clientAssertionID and assertionID are the identities of the verified assertions, blank if unverified
+		clientAssertionID string
+		assertionID       string
+
+		// exchange holds the token exchange grant parameters
+		exchange tokenExchange
+
+		// client is set when the proxy supplies the client credentials
+		client *injectedClient
+
+		// clientAlias is the lower case alias of the injected client, cache keys use it in place of client
+		// so entries remain reachable when a reload replaces the registered clients
+		clientAlias string
+	}
+)
+
+// isCacheable reports if responses to the request can be cached.
+func (tr *tokenRequest) isCacheable() bool {
+	return tr.kind != revokeKind && tr.kind != deviceCodeKind
+}
+
+// prepareRequest creates the downstream request sent to requestURL.
+func (tr *tokenRequest) prepareRequest(requestURL string) (*http.Request, error) {
+	switch tr.kind {
+	case documentKind:
+		return tr.prepareDocumentRequest(requestURL)
+	case introspectKind, revokeKind:
+		return tr.prepareTokenParamRequest(requestURL)
+	case userinfoKind:
+		return tr.prepareUserinfoRequest(requestURL)
+	case deviceCodeKind:
+		return tr.prepareDeviceCodeRequest(requestURL)
+	}
+
+	v := tr.grantValues()
+
+	if len(tr.scopes) > 0 {
+		v.Set("scope", tr.scopes)
+	}
+
+	return tr.newFormRequest(requestURL, v)
+}
+
+// cacheKey returns the key the request is cached under.
+// Injected clients are identified by alias.  Verified single use assertions are replaced by their issuer, subject and audience so the response can be reused.
+func (tr tokenRequest) cacheKey() tokenRequest {
+	key := tr
+	key.client = nil
+
+	if tr.clientAssertionID != "" {
+		key.clientAssertion = tr.clientAssertionID
+	}
+
+	if tr.assertionID != "" {
+		key.assertion = tr.assertionID
+	}
+
+	return key
+}
+
+// newFormRequest creates a downstream form POST request including the client authentication.
+func (tr *tokenRequest) newFormRequest(requestURL string, v url.Values) (*http.Request, error) {
+	auth, err := tr.clientAuth(requestURL)
+	if err != nil {
+		return nil, err
+	}
+
+	switch auth.authMode {
+	case authInBody:
+		// Embed auth in body, public clients only identify themselves
+		v.Set("client_id", auth.clientID)
+		if auth.clientSecret != "" {
+			v.Set("client_secret", auth.clientSecret)
+		}
+
+	case authWithAssertion:
+		if auth.clientID != "" {
+			v.Set("client_id", auth.clientID)
+		}
+		v.Set("client_assertion_type", clientAssertionTypeJWT)
+		v.Set("client_assertion", auth.clientAssertion)
+	}
+
+	req, err := http.NewRequest("POST", requestURL, strings.NewReader(v.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	// Embed auth in header
+	if auth.authMode == authInHeader {
+		req.SetBasicAuth(auth.clientID, auth.clientSecret)
+	}
+
+	return req, nil
+}
+
+// clientAuth returns the client authentication used for the downstream request.
+// Credentials held by the proxy take precedence over those presented by the caller.
+func (tr *tokenRequest) clientAuth(requestURL string) (clientAuth, error) {
+	if tr.client != nil {
+		return tr.client.auth(requestURL)
+	}
+
+	return clientAuth{
+		authMode:        tr.authMode,
+		clientID:        tr.clientID,
+		clientSecret:    tr.clientSecret,
+		clientAssertion: tr.clientAssertion,
+	}, nil
+}
+
+// prepareTokenParamRequest creates a downstream token introspection or revocation request.
+func (tr *tokenRequest) prepareTokenParamRequest(requestURL string) (*http.Request, error) {
+	v := url.Values{
+		"token": {tr.token},
+	}
+
+	if tr.tokenTypeHint != "" {
+		v.Set("token_type_hint", tr.tokenTypeHint)
+	}
+
+	return tr.newFormRequest(requestURL, v)
+}
+
+// prepareDocumentRequest creates a downstream GET request for a provider document.
+func (tr *tokenRequest) prepareDocumentRequest(requestURL string) (*http.Request, error) {
+	req, err := http.NewRequest("GET", requestURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	return req, nil
+}
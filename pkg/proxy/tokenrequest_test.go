@@ -65,7 +65,8 @@ func TestPrepareRequestScopesucceeds(t *testing.T) {
 
 func TestPrepareRequestAuthBodySucceeds(t *testing.T) {
 	tr := tokenRequest{
-		authMode: authInBody,
+		authMode:     authInBody,
+		clientSecret: "s1",
 	}
 
 	req, err := tr.prepareRequest("body")
@@ -81,7 +82,7 @@ func TestPrepareRequestAuthBodySucceeds(t *testing.T) {
 		t.Error("Read error", err)
 	}
 
-	expected := "client_id=&client_secret=&grant_type=password&password=&username="
+	expected := "client_id=&client_secret=s1&grant_type=password&password=&username="
 
 	got := string(b)
 	if got != expected {
@@ -0,0 +1,448 @@
+/*
+Copyright © 2018-2021 Neil Hemming
+*/
+
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	multierror "github.com/hashicorp/go-multierror"
+)
+
+const (
+	// traceparentHeader is the W3C trace context header.
+	traceparentHeader = "traceparent"
+
+	// otlpTracesPath is the OTLP/HTTP traces path appended to the tracing endpoint.
+	otlpTracesPath = "/v1/traces"
+
+	// Span kinds as defined by OTLP.
+	spanKindInternal = 1
+	spanKindServer   = 2
+	spanKindClient   = 3
+
+	// OTLP span status codes.
+	statusCodeUnset = 0
+	statusCodeError = 2
+
+	// tracerQueueSize is the number of finished spans buffered for export, further spans are dropped.
+	tracerQueueSize = 2048
+
+	// tracerBatchSize is the largest number of spans exported in a single request.
+	tracerBatchSize = 256
+
+	// tracerExportTimeout limits each export request.
+	tracerExportTimeout = 10 * time.Second
+)
+
+type (
+	// TracingSettings configures export of trace spans to an OpenTelemetry collector using OTLP/HTTP JSON.
+	TracingSettings struct {
+		// Endpoint is the collector's base url, for example http://localhost:4318, blank disables export
+		Endpoint string
+
+		// ServiceName is the service.name resource attribute, defaults to oauthproxy
+		ServiceName string
+
+		// Headers are added to each export request, for example collector authentication
+		Headers map[string]string
+
+		// FlushInterval is the longest time a finished span waits to be exported
+		FlushInterval time.Duration
+	}
+
+	// spanContext identifies a span within a trace.
+	spanContext struct {
+		traceID [16]byte
+		spanID  [8]byte
+		sampled bool
+	}
+
+	// span is a timed operation within a trace.
+	span struct {
+		tracer   *tracer
+		sc       spanContext
+		parentID [8]byte
+		name     string
+		kind     int
+		start    time.Time
+		end      time.Time
+		attrs    Fields
+		failed   bool
+		once     sync.Once
+	}
+
+	// tracer creates spans and exports them in batches.
+	tracer struct {
+		endpoint      string
+		serviceName   string
+		headers       map[string]string
+		flushInterval time.Duration
+		client        *http.Client
+		spans         chan *span
+		done          chan struct{}
+		wg            sync.WaitGroup
+		logger        func(error)
+	}
+
+	// spanContextKey is the context key of the current span context.
+	spanContextKey struct{}
+)
+
+func (ts TracingSettings) validateSettings() error {
+	var result error
+
+	if ts.Endpoint != "" {
+		if u, err := url.Parse(ts.Endpoint); err != nil || u.Scheme == "" || u.Host == "" {
+			result = multierror.Append(result, fmt.Errorf("tracing endpoint %s is not a valid url", ts.Endpoint))
+		}
+	}
+
+	if ts.FlushInterval < 0 {
+		result = multierror.Append(result, errors.New("tracing flush interval cannot be negative"))
+	}
+
+	return result
+}
+
+// newTracer starts the span exporter, nil if tracing is disabled.
+// The exporter has its own HTTP client, as the outbound transport's client certificate, proxies
+// and CAs are those of the provider, not the collector.
+func (ts TracingSettings) newTracer(logger func(error)) *tracer {
+	if ts.Endpoint == "" {
+		return nil
+	}
+
+	t := &tracer{
+		endpoint:      strings.TrimSuffix(ts.Endpoint, "/") + otlpTracesPath,
+		serviceName:   ts.ServiceName,
+		headers:       ts.Headers,
+		flushInterval: ts.FlushInterval,
+		client:        &http.Client{Transport: http.DefaultTransport.(*http.Transport).Clone()},
+		spans:         make(chan *span, tracerQueueSize),
+		done:          make(chan struct{}),
+		logger:        logger,
+	}
+
+	if t.serviceName == "" {
+		t.serviceName = "oauthproxy"
+	}
+	if t.flushInterval == 0 {
+		t.flushInterval = 5 * time.Second
+	}
+
+	t.wg.Add(1)
+	go t.exporter()
+
+	return t
+}
+
+// close stops the exporter after exporting any remaining spans.
+func (t *tracer) close() {
+	if t == nil {
+		return
+	}
+
+	close(t.done)
+	t.wg.Wait()
+}
+
+// parseTraceparent parses a W3C traceparent header value.
+func parseTraceparent(value string) (spanContext, bool) {
+	var sc spanContext
+
+	parts := strings.Split(strings.TrimSpace(value), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" {
+		return sc, false
+	}
+
+	traceID, err := hex.DecodeString(parts[1])
+	if err != nil || len(traceID) != 16 {
+		return sc, false
+	}
+	spanID, err := hex.DecodeString(parts[2])
+	if err != nil || len(spanID) != 8 {
+		return sc, false
+	}
+	flags, err := hex.DecodeString(parts[3])
+	if err != nil || len(flags) != 1 {
+		return sc, false
+	}
+
+	copy(sc.traceID[:], traceID)
+	copy(sc.spanID[:], spanID)
+	sc.sampled = flags[0]&1 == 1
+
+	if !sc.valid() {
+		return sc, false
+	}
+
+	return sc, true
+}
+
+// valid reports if the trace and span IDs are set.
+func (sc spanContext) valid() bool {
+	return sc.traceID != [16]byte{} && sc.spanID != [8]byte{}
+}
+
+// traceparent formats the span context as a W3C traceparent header value.
+func (sc spanContext) traceparent() string {
+	flags := "00"
+	if sc.sampled {
+		flags = "01"
+	}
+
+	return "00-" + hex.EncodeToString(sc.traceID[:]) + "-" + hex.EncodeToString(sc.spanID[:]) + "-" + flags
+}
+
+// withSpanContext returns a context holding the span context.
+func withSpanContext(ctx context.Context, sc spanContext) context.Context {
+	return context.WithValue(ctx, spanContextKey{}, sc)
+}
+
+// spanContextFrom returns the span context held in the context.
+func spanContextFrom(ctx context.Context) (spanContext, bool) {
+	sc, ok := ctx.Value(spanContextKey{}).(spanContext)
+	return sc, ok
+}
+
+// withInboundTrace attaches the caller's traceparent, if any, to the request context.
+func withInboundTrace(r *http.Request) *http.Request {
+	sc, ok := parseTraceparent(r.Header.Get(traceparentHeader))
+	if !ok {
+		return r
+	}
+
+	return r.WithContext(withSpanContext(r.Context(), sc))
+}
+
+// start begins a span as a child of the parent span context, or a new trace if there is none.
+// A nil tracer returns a nil span, whose methods do nothing.
+func (t *tracer) start(parent spanContext, hasParent bool, name string, kind int) *span {
+	if t == nil {
+		return nil
+	}
+
+	s := &span{
+		tracer: t,
+		name:   name,
+		kind:   kind,
+		start:  time.Now(),
+		attrs:  make(Fields),
+	}
+
+	if hasParent && parent.valid() {
+		s.sc.traceID = parent.traceID
+		s.sc.sampled = parent.sampled
+		s.parentID = parent.spanID
+	} else {
+		_, _ = rand.Read(s.sc.traceID[:])
+		s.sc.sampled = true
+	}
+	_, _ = rand.Read(s.sc.spanID[:])
+
+	return s
+}
+
+// startSpan begins a span whose parent is held in the context, returning the context holding the new span.
+func (t *tracer) startSpan(ctx context.Context, name string, kind int) (context.Context, *span) {
+	parent, ok := spanContextFrom(ctx)
+
+	s := t.start(parent, ok, name, kind)
+	if s == nil {
+		return ctx, nil
+	}
+
+	return withSpanContext(ctx, s.sc), s
+}
+
+// setAttr sets an attribute of the span.
+func (s *span) setAttr(key string, value interface{}) {
+	if s != nil {
+		s.attrs[key] = value
+	}
+}
+
+// setError marks the span as failed.
+func (s *span) setError(err error) {
+	if s != nil && err != nil {
+		s.failed = true
+		s.attrs["error.message"] = err.Error()
+	}
+}
+
+// finish ends the span and queues it for export.
+func (s *span) finish() {
+	if s == nil {
+		return
+	}
+
+	s.once.Do(func() {
+		s.end = time.Now()
+		if s.sc.sampled {
+			s.tracer.queue(s)
+		}
+	})
+}
+
+// queue adds a finished span to the export queue, dropping it if the queue is full.
+func (t *tracer) queue(s *span) {
+	select {
+	case t.spans <- s:
+	default:
+	}
+}
+
+// exporter exports queued spans in batches until the tracer is closed.
+func (t *tracer) exporter() {
+	defer t.wg.Done()
+
+	ticker := time.NewTicker(t.flushInterval)
+	defer ticker.Stop()
+
+	var batch []*span
+
+	flush := func() {
+		if len(batch) > 0 {
+			if err := t.export(batch); err != nil && t.logger != nil {
+				t.logger(err)
+			}
+			batch = nil
+		}
+	}
+
+	for {
+		select {
+		case s := <-t.spans:
+			batch = append(batch, s)
+			if len(batch) >= tracerBatchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		case <-t.done:
+			for {
+				select {
+				case s := <-t.spans:
+					batch = append(batch, s)
+				default:
+					flush()
+					return
+				}
+			}
+		}
+	}
+}
+
+// export sends spans to the collector.
+func (t *tracer) export(spans []*span) error {
+	body, err := json.Marshal(t.otlpRequest(spans))
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), tracerExportTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, "POST", t.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range t.headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("export spans: %w", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("export spans: collector returned status %d", resp.StatusCode)
+	}
+
+	return nil
+}
+
+// otlpRequest builds the OTLP/HTTP JSON export request body.
+func (t *tracer) otlpRequest(spans []*span) map[string]interface{} {
+	otlpSpans := make([]map[string]interface{}, 0, len(spans))
+
+	for _, s := range spans {
+		status := statusCodeUnset
+		if s.failed {
+			status = statusCodeError
+		}
+
+		otlpSpan := map[string]interface{}{
+			"traceId":           hex.EncodeToString(s.sc.traceID[:]),
+			"spanId":            hex.EncodeToString(s.sc.spanID[:]),
+			"name":              s.name,
+			"kind":              s.kind,
+			"startTimeUnixNano": strconv.FormatInt(s.start.UnixNano(), 10),
+			"endTimeUnixNano":   strconv.FormatInt(s.end.UnixNano(), 10),
+			"attributes":        otlpAttributes(s.attrs),
+			"status":            map[string]interface{}{"code": status},
+		}
+
+		if s.parentID != [8]byte{} {
+			otlpSpan["parentSpanId"] = hex.EncodeToString(s.parentID[:])
+		}
+
+		otlpSpans = append(otlpSpans, otlpSpan)
+	}
+
+	return map[string]interface{}{
+		"resourceSpans": []interface{}{
+			map[string]interface{}{
+				"resource": map[string]interface{}{
+					"attributes": otlpAttributes(Fields{"service.name": t.serviceName}),
+				},
+				"scopeSpans": []interface{}{
+					map[string]interface{}{
+						"scope": map[string]interface{}{"name": "github.com/nehemming/oauthproxy"},
+						"spans": otlpSpans,
+					},
+				},
+			},
+		},
+	}
+}
+
+// otlpAttributes converts fields to OTLP key values.
+func otlpAttributes(fields Fields) []interface{} {
+	attrs := make([]interface{}, 0, len(fields))
+
+	for k, v := range fields {
+		var value map[string]interface{}
+
+		switch tv := v.(type) {
+		case int:
+			value = map[string]interface{}{"intValue": strconv.Itoa(tv)}
+		case bool:
+			value = map[string]interface{}{"boolValue": tv}
+		default:
+			value = map[string]interface{}{"stringValue": fmt.Sprint(tv)}
+		}
+
+		attrs = append(attrs, map[string]interface{}{"key": k, "value": value})
+	}
+
+	return attrs
+}
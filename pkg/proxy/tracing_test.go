@@ -0,0 +1,143 @@
+/*
+Copyright © 2018-2021 Neil Hemming
+*/
+
+package proxy
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+type collectorStub struct {
+	mu     sync.Mutex
+	spans  []map[string]interface{}
+	header http.Header
+}
+
+func (c *collectorStub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		ResourceSpans []struct {
+			ScopeSpans []struct {
+				Spans []map[string]interface{} `json:"spans"`
+			} `json:"scopeSpans"`
+		} `json:"resourceSpans"`
+	}
+
+	if r.URL.Path != otlpTracesPath || json.NewDecoder(r.Body).Decode(&body) != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.header = r.Header
+	for _, rs := range body.ResourceSpans {
+		for _, ss := range rs.ScopeSpans {
+			c.spans = append(c.spans, ss.Spans...)
+		}
+	}
+}
+
+func TestTracingValidateSettings(t *testing.T) {
+	if err := (TracingSettings{Endpoint: "localhost"}).validateSettings(); err == nil {
+		t.Error("Bad endpoint not caught")
+	}
+
+	if err := (TracingSettings{Endpoint: "http://localhost:4318"}).validateSettings(); err != nil {
+		t.Error("Unexpected", err)
+	}
+}
+
+func TestParseTraceparent(t *testing.T) {
+	value := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+
+	sc, ok := parseTraceparent(value)
+	if !ok || !sc.sampled || sc.traceparent() != value {
+		t.Error("Round trip failed", sc.traceparent())
+	}
+
+	for _, bad := range []string{
+		"",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e47-00f067aa0ba902b7-01",
+	} {
+		if _, ok := parseTraceparent(bad); ok {
+			t.Error("Bad traceparent accepted", bad)
+		}
+	}
+}
+
+func TestTracingExportsSpansAndPropagates(t *testing.T) {
+	collector := &collectorStub{}
+	srv := httptest.NewServer(collector)
+	defer srv.Close()
+
+	rt := newRuntime(context.Background(), DefaultSettings().WithEndpoint("http://test"))
+	defer rt.close()
+
+	rt.tracer = TracingSettings{Endpoint: srv.URL, Headers: map[string]string{"X-Key": "k1"}}.newTracer(func(err error) {
+		t.Error("Export failed", err)
+	})
+
+	var downstreamParent string
+	rt.requester = func(ctx context.Context, req *http.Request) (*http.Response, error) {
+		downstreamParent = req.Header.Get(traceparentHeader)
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Header:     http.Header{},
+			Body:       ioutil.NopCloser(strings.NewReader(`{"keys":[]}`)),
+		}, nil
+	}
+
+	inbound := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	req := httptest.NewRequest("GET", "/keys", nil)
+	req.Header.Set(traceparentHeader, inbound)
+	rt.handleRequest(httptest.NewRecorder(), req)
+
+	rt.tracer.close()
+
+	sc, ok := parseTraceparent(downstreamParent)
+	if !ok || hex.EncodeToString(sc.traceID[:]) != "4bf92f3577b34da6a3ce929d0e0e4736" || downstreamParent == inbound {
+		t.Error("Trace not propagated downstream", downstreamParent)
+	}
+
+	collector.mu.Lock()
+	defer collector.mu.Unlock()
+
+	if collector.header.Get("X-Key") != "k1" {
+		t.Error("Export headers not sent")
+	}
+
+	names := make(map[string]map[string]interface{})
+	for _, s := range collector.spans {
+		names[s["name"].(string)] = s
+		if s["traceId"] != "4bf92f3577b34da6a3ce929d0e0e4736" {
+			t.Error("Span not in caller's trace", s)
+		}
+	}
+
+	for _, name := range []string{"oauthproxy document", "cache lookup", "queue wait", "downstream GET"} {
+		if _, ok := names[name]; !ok {
+			t.Error("Missing span", name, len(collector.spans))
+		}
+	}
+
+	if s := names["downstream GET"]; s != nil && s["spanId"] != hex.EncodeToString(sc.spanID[:]) {
+		t.Error("Downstream traceparent is not the downstream span", s["spanId"])
+	}
+
+	if s := names["oauthproxy document"]; s != nil && s["parentSpanId"] != "00f067aa0ba902b7" {
+		t.Error("Inbound span parent is not the caller", s["parentSpanId"])
+	}
+}
@@ -0,0 +1,211 @@
+/*
+Copyright © 2018-2021 Neil Hemming
+*/
+
+package proxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	multierror "github.com/hashicorp/go-multierror"
+	"golang.org/x/net/http/httpproxy"
+)
+
+type (
+	// TransportSettings configures the outbound HTTP transport used for downstream requests.
+	TransportSettings struct {
+		// HTTPProxy overrides the HTTP_PROXY environment variable
+		HTTPProxy string
+
+		// HTTPSProxy overrides the HTTPS_PROXY environment variable
+		HTTPSProxy string
+
+		// NoProxy overrides the NO_PROXY environment variable
+		NoProxy string
+
+		// CAFiles are additional PEM encoded CA bundles trusted for downstream connections
+		CAFiles []string
+
+		// ClientCertFile is the PEM encoded client certificate presented for mutual TLS
+		ClientCertFile string
+
+		// ClientKeyFile is the PEM encoded private key of the client certificate
+		ClientKeyFile string
+
+		// TLSMinVersion is the minimum TLS version accepted, one of 1.0, 1.1, 1.2 or 1.3
+		TLSMinVersion string
+
+		// MaxIdleConns is the maximum number of idle connections across all hosts, 0 is no limit
+		MaxIdleConns int
+
+		// MaxIdleConnsPerHost is the maximum number of idle connections per host
+		MaxIdleConnsPerHost int
+
+		// MaxConnsPerHost limits the total connections per host, 0 is no limit
+		MaxConnsPerHost int
+
+		// IdleConnTimeout is how long an idle connection is kept open
+		IdleConnTimeout time.Duration
+
+		// KeepAlive is the keep-alive period for active connections, negative disables keep-alives
+		KeepAlive time.Duration
+	}
+)
+
+// tlsVersions maps config names to tls versions.
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// DefaultTransportSettings returns the default outbound transport settings.
+func DefaultTransportSettings() TransportSettings {
+	return TransportSettings{
+		TLSMinVersion:       "1.2",
+		MaxIdleConns:        100,
+		MaxIdleConnsPerHost: 10,
+		IdleConnTimeout:     90 * time.Second,
+		KeepAlive:           30 * time.Second,
+	}
+}
+
+func (ts TransportSettings) validateSettings() error {
+	var result error
+
+	if _, ok := tlsVersions[ts.TLSMinVersion]; ts.TLSMinVersion != "" && !ok {
+		result = multierror.Append(result, fmt.Errorf("unknown TLS minimum version %s", ts.TLSMinVersion))
+	}
+
+	if (ts.ClientCertFile == "") != (ts.ClientKeyFile == "") {
+		result = multierror.Append(result, errors.New("client certificate and key must be provided together"))
+	}
+
+	proxies := []struct{ scheme, url string }{{"http", ts.HTTPProxy}, {"https", ts.HTTPSProxy}}
+	for _, p := range proxies {
+		if p.url == "" {
+			continue
+		}
+		if u, err := url.Parse(p.url); err != nil || u.Scheme == "" || u.Host == "" {
+			result = multierror.Append(result, fmt.Errorf("%s proxy url %s is not a valid url", p.scheme, redactedURL(p.url)))
+		}
+	}
+
+	if ts.MaxIdleConns < 0 || ts.MaxIdleConnsPerHost < 0 || ts.MaxConnsPerHost < 0 {
+		result = multierror.Append(result, errors.New("connection limits cannot be negative"))
+	}
+
+	return result
+}
+
+// newClient creates the http client used to make downstream requests.
+func (ts TransportSettings) newClient() (*http.Client, error) {
+	tlsConfig, err := ts.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: ts.KeepAlive,
+	}
+
+	transport := &http.Transport{
+		Proxy:                 ts.proxyFunc(),
+		DialContext:           dialer.DialContext,
+		TLSClientConfig:       tlsConfig,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          ts.MaxIdleConns,
+		MaxIdleConnsPerHost:   ts.MaxIdleConnsPerHost,
+		MaxConnsPerHost:       ts.MaxConnsPerHost,
+		IdleConnTimeout:       ts.IdleConnTimeout,
+		DisableKeepAlives:     ts.KeepAlive < 0,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+
+	return &http.Client{Transport: transport}, nil
+}
+
+// proxyFunc returns the proxy selection function, environment settings are used unless overridden.
+func (ts TransportSettings) proxyFunc() func(*http.Request) (*url.URL, error) {
+	cfg := httpproxy.FromEnvironment()
+
+	if ts.HTTPProxy != "" {
+		cfg.HTTPProxy = ts.HTTPProxy
+	}
+	if ts.HTTPSProxy != "" {
+		cfg.HTTPSProxy = ts.HTTPSProxy
+	}
+	if ts.NoProxy != "" {
+		cfg.NoProxy = ts.NoProxy
+	}
+
+	fn := cfg.ProxyFunc()
+
+	return func(req *http.Request) (*url.URL, error) {
+		return fn(req.URL)
+	}
+}
+
+// tlsConfig builds the tls config for downstream connections.
+func (ts TransportSettings) tlsConfig() (*tls.Config, error) {
+	cfg := &tls.Config{}
+
+	if ts.TLSMinVersion != "" {
+		v, ok := tlsVersions[ts.TLSMinVersion]
+		if !ok {
+			return nil, fmt.Errorf("unknown TLS minimum version %s", ts.TLSMinVersion)
+		}
+		cfg.MinVersion = v
+	}
+
+	if len(ts.CAFiles) > 0 {
+		pool, err := x509.SystemCertPool()
+		if err != nil || pool == nil {
+			pool = x509.NewCertPool()
+		}
+
+		for _, f := range ts.CAFiles {
+			pem, err := ioutil.ReadFile(f)
+			if err != nil {
+				return nil, fmt.Errorf("read CA file: %w", err)
+			}
+			if !pool.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("no certificates found in CA file %s", f)
+			}
+		}
+
+		cfg.RootCAs = pool
+	}
+
+	if ts.ClientCertFile != "" {
+		cert, err := tls.LoadX509KeyPair(ts.ClientCertFile, ts.ClientKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("load client certificate: %w", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+
+	return cfg, nil
+}
+
+// redactedURL returns the url with the password of any user info redacted.
+// URLs that cannot be parsed into a host are not shown as any password in them cannot be located.
+func redactedURL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil || u.Host == "" {
+		return "(not shown)"
+	}
+
+	return u.Redacted()
+}
@@ -0,0 +1,54 @@
+/*
+Copyright © 2018-2021 Neil Hemming
+*/
+
+package proxy
+
+import (
+	"net/http"
+	"strings"
+)
+
+// isUserinfoPath reports if the path is for the openid userinfo endpoint.
+func isUserinfoPath(path string) bool {
+	return strings.HasSuffix(path, "/userinfo")
+}
+
+// parseUserinfoRequest extracts the bearer token of a userinfo request.
+func (rt *runtime) parseUserinfoRequest(w http.ResponseWriter, r *http.Request, tr tokenRequest) (tokenRequest, bool) {
+	tr.kind = userinfoKind
+
+	auth := r.Header.Get("Authorization")
+	if len(auth) > 7 && strings.EqualFold(auth[:7], "bearer ") {
+		tr.token = strings.TrimSpace(auth[7:])
+	}
+
+	if tr.token == "" {
+		rt.logError("userinfo request without bearer token")
+		replyUnauthorized(w)
+		return tr, false
+	}
+
+	return tr, true
+}
+
+// prepareUserinfoRequest creates a downstream userinfo request using the bearer token.
+func (tr *tokenRequest) prepareUserinfoRequest(requestURL string) (*http.Request, error) {
+	req, err := http.NewRequest("GET", requestURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("Authorization", "Bearer "+tr.token)
+
+	return req, nil
+}
+
+// userinfoURL returns the downstream userinfo endpoint.
+func (rt *runtime) userinfoURL(tr tokenRequest) string {
+	if md := rt.providerMetadata(); md != nil && md.UserinfoEndpoint != "" {
+		return md.UserinfoEndpoint
+	}
+
+	return rt.config().endpoint + tr.path
+}
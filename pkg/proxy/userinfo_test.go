@@ -0,0 +1,29 @@
+/*
+Copyright © 2018-2021 Neil Hemming
+*/
+
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParseRequestUserinfoNoBearerFails(t *testing.T) {
+	settings := DefaultSettings().WithEndpoint("test")
+	rt := newRuntime(context.Background(), settings)
+	defer rt.close()
+
+	req, _ := http.NewRequest("GET", "http:/oauth2/userinfo", nil)
+
+	w := httptest.NewRecorder()
+	if _, match := rt.parseRequest(w, req); match {
+		t.Error("Unexpected match")
+	}
+
+	if w.Code != http.StatusUnauthorized {
+		t.Error("Unexpected status", w.Code)
+	}
+}